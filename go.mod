@@ -1,3 +1,3 @@
 module github.com/Rolls71/cosc340-sockets
 
-go 1.19
+go 1.20
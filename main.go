@@ -1,25 +1,295 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/Rolls71/cosc340-sockets/sockets"
 )
 
 // main accepts parameters in the following form:
-//   - "client [HOST_NAME] [HOST_PORT]"
-//   - "server [HOST_PORT]"
+//   - "client [HOST_NAME] [HOST_PORT] [-identity PATH] [-key-algorithm NAME]
+//     [-data-key PATH] [-cipher SUITE] [-tls] [-tls-ca PATH] [-tls-cert PATH]
+//     [-tls-key PATH] [-server-fingerprint FINGERPRINT] [LOG_FLAGS]"
+//   - "server [HOST_PORT] [-pool SIZE] [-pool-workers COUNT] [-identity PATH]
+//     [-key-algorithm NAME] [-metrics ADDRESS] [-admin SOCKET_PATH]
+//     [-snapshot PATH] [-replicas FINGERPRINTS] [-replication-log SIZE]
+//     [-replica-of ADDRESS] [-replica-identity PATH]
+//     [-cluster ADDRESSES] [-cluster-address ADDRESS]
+//     [-cluster-identity PATH] [-cluster-keys FINGERPRINTS]
+//     [-raft ADDRESSES] [-raft-address ADDRESS] [-raft-identity PATH]
+//     [-raft-keys FINGERPRINTS] [-raft-dir PATH]
+//     [-redis ADDRESS] [-redis-password PASSWORD]
+//     [-memcached ADDRESS] [-tls-cert PATH] [-tls-key PATH]
+//     [-tls-ca PATH] [-tls-client-ca PATH] [-tls-crl PATH]
+//     [-tls-identity key|subject] [-socket-mode MODE] [-socket-uids UIDS]
+//     [-socket-gids GIDS] [LOG_FLAGS]"
+//   - "gateway [HOST_PORT] [HTTP_ADDRESS] [SERVER_FLAGS]"
+//   - "admin [SOCKET_PATH] [COMMAND] [ARGUMENTS...]"
+//   - "certs [DIRECTORY] [-hosts NAMES] [-ca-key PATH] [-server-key PATH]
+//     [-client-key PATH] [-revoke CERTIFICATE_PATH]"
 //   - "rsa"
 //   - "aes"
+//   - "keypool"
+//   - "replication"
+//   - "cluster"
+//   - "raft"
+//   - "http"
+//   - "redis"
+//   - "memcached"
+//   - "tls"
+//   - "mtls"
+//   - "unix"
+//   - "ecdh"
+//   - "sequencing"
+//   - "keys"
+//   - "ciphers"
+//   - "rotation"
+//   - "reconnect"
+//
+// HOST_NAME and HOST_PORT may be replaced by a single unix:///path address to
+// use a Unix domain socket instead of TCP. SERVER_FLAGS are the flags accepted
+// by "server". LOG_FLAGS are "[-log-level LEVEL] [-log-format FORMAT] [-debug]".
 func main() {
 	switch os.Args[1] {
 	case "client":
-		sockets.Client(os.Args[2], os.Args[3])
+		if strings.HasPrefix(os.Args[2], "unix://") {
+			sockets.Client(os.Args[2], "", parseClientFlags(os.Args[3:]))
+			return
+		}
+		sockets.Client(os.Args[2], os.Args[3], parseClientFlags(os.Args[4:]))
 	case "server":
-		sockets.Server(os.Args[2])
+		sockets.Server(os.Args[2], parseServerFlags(os.Args[3:]))
+	case "gateway":
+		config := parseServerFlags(os.Args[4:])
+		config.GatewayAddr = os.Args[3]
+		sockets.Server(os.Args[2], config)
+	case "admin":
+		sockets.Admin(os.Args[2], os.Args[3:])
+	case "certs":
+		config, revoke := parseCertFlags(os.Args[2], os.Args[3:])
+		if revoke != "" && !sockets.RevokeCertificate(config, revoke) {
+			os.Exit(1)
+		}
+		if revoke == "" && !sockets.GenerateCertificates(config) {
+			os.Exit(1)
+		}
 	case "rsa":
 		sockets.TestRSA()
 	case "aes":
 		sockets.TestAES()
+	case "keypool":
+		sockets.TestKeyPool()
+	case "replication":
+		sockets.TestReplication()
+	case "cluster":
+		sockets.TestCluster()
+	case "raft":
+		sockets.TestRaft()
+	case "http":
+		sockets.TestGateway()
+	case "redis":
+		sockets.TestRedis()
+	case "memcached":
+		sockets.TestMemcached()
+	case "tls":
+		sockets.TestTLS()
+	case "mtls":
+		sockets.TestMutualTLS()
+	case "unix":
+		sockets.TestUnix()
+	case "ecdh":
+		sockets.TestKeyExchange()
+	case "sequencing":
+		sockets.TestSequencing()
+	case "keys":
+		sockets.TestIdentityKeys()
+	case "ciphers":
+		sockets.TestCipherSuites()
+	case "rotation":
+		sockets.TestRotation()
+	case "reconnect":
+		sockets.TestReconnect()
 	}
 }
+
+// parseServerFlags reads the optional server flags that follow the port.
+//
+// Returns the resulting server config.
+func parseServerFlags(args []string) sockets.ServerConfig {
+	config := sockets.ServerConfig{}
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	flags.IntVar(&config.KeyPoolSize, "pool", 8,
+		"number of RSA keypairs kept ready for new sessions")
+	flags.IntVar(&config.KeyPoolWorkers, "pool-workers", 2,
+		"number of goroutines refilling the key pool")
+	flags.StringVar(&config.IdentityFile, "identity", "",
+		"file holding the key that signs key exchanges, created if missing")
+	flags.StringVar(&config.KeyAlgorithm, "key-algorithm", "rsa-2048",
+		"algorithm of a new identity key: rsa-2048, rsa-3072, rsa-4096, ecdsa-p256 or ed25519")
+	flags.StringVar(&config.MetricsAddr, "metrics", "",
+		"address of the HTTP metrics listener, e.g. localhost:9090")
+	flags.StringVar(&config.AdminSocket, "admin", "",
+		"path of the Unix socket accepting admin commands")
+	flags.StringVar(&config.SnapshotFile, "snapshot", "snapshot.json",
+		"default file written by the admin SNAPSHOT command")
+	replicas := flags.String("replicas", "",
+		"comma separated key fingerprints of the replicas allowed to follow")
+	flags.IntVar(&config.ReplicationLogSize, "replication-log", 10000,
+		"number of recent changes kept for replicas that fall behind")
+	flags.StringVar(&config.ReplicaOf, "replica-of", "",
+		"address of the primary to follow as a read-only replica")
+	flags.StringVar(&config.ReplicaIdentity, "replica-identity", "replica.pem",
+		"file holding the replica's RSA key, created if missing")
+	cluster := flags.String("cluster", "",
+		"comma separated addresses of the cluster's initial nodes")
+	flags.StringVar(&config.ClusterAddress, "cluster-address", "",
+		"this node's address as listed in the cluster, e.g. localhost:8080")
+	flags.StringVar(&config.ClusterIdentity, "cluster-identity", "node.pem",
+		"file holding the node's RSA key, created if missing")
+	clusterKeys := flags.String("cluster-keys", "",
+		"comma separated key fingerprints of the cluster's nodes")
+	raftNodes := flags.String("raft", "",
+		"comma separated addresses of the Raft group's initial nodes")
+	flags.StringVar(&config.RaftAddress, "raft-address", "",
+		"this node's address as listed in the Raft group, e.g. localhost:8080")
+	flags.StringVar(&config.RaftIdentity, "raft-identity", "raft.pem",
+		"file holding the Raft node's RSA key, created if missing")
+	raftKeys := flags.String("raft-keys", "",
+		"comma separated key fingerprints of the Raft group's nodes")
+	flags.StringVar(&config.RaftDirectory, "raft-dir", "",
+		"directory keeping the node's Raft log and snapshot")
+	flags.StringVar(&config.RedisAddr, "redis", "",
+		"address of the RESP listener for Redis clients, e.g. localhost:6379")
+	flags.StringVar(&config.RedisPassword, "redis-password", "",
+		"password Redis clients must send with AUTH")
+	flags.StringVar(&config.MemcachedAddr, "memcached", "",
+		"address of the memcached listener, e.g. localhost:11211")
+	flags.StringVar(&config.TLSCert, "tls-cert", "",
+		"file holding the TLS certificate clients connect with, e.g. certs/server.crt")
+	flags.StringVar(&config.TLSKey, "tls-key", "",
+		"file holding the RSA key the TLS certificate was issued for")
+	flags.StringVar(&config.TLSCA, "tls-ca", "",
+		"file holding the CA certificate other nodes' certificates are checked against")
+	flags.StringVar(&config.TLSClientCA, "tls-client-ca", "",
+		"file holding the CA certificates clients must present a certificate from")
+	flags.StringVar(&config.TLSCRL, "tls-crl", "",
+		"file holding the revocation lists of the client CAs, e.g. certs/ca.crl")
+	flags.StringVar(&config.TLSIdentity, "tls-identity", "key",
+		"how a client certificate names its client: key or subject")
+	socketMode := flags.Uint("socket-mode", 0660,
+		"permissions of the Unix domain socket, if listening on one")
+	socketUIDs := flags.String("socket-uids", "",
+		"comma separated user IDs allowed to connect over the Unix domain socket")
+	socketGIDs := flags.String("socket-gids", "",
+		"comma separated group IDs allowed to connect over the Unix domain socket")
+	addLogFlags(flags, &config.Log)
+	flags.Parse(args)
+	if *replicas != "" {
+		config.ReplicaKeys = strings.Split(*replicas, ",")
+	}
+	if *cluster != "" {
+		config.ClusterNodes = strings.Split(*cluster, ",")
+	}
+	if *clusterKeys != "" {
+		config.ClusterKeys = strings.Split(*clusterKeys, ",")
+	}
+	if *raftNodes != "" {
+		config.RaftNodes = strings.Split(*raftNodes, ",")
+	}
+	if *raftKeys != "" {
+		config.RaftKeys = strings.Split(*raftKeys, ",")
+	}
+	config.SocketMode = os.FileMode(*socketMode)
+	config.SocketUIDs = parseIDs(*socketUIDs)
+	config.SocketGIDs = parseIDs(*socketGIDs)
+	return config
+}
+
+// parseIDs reads a comma separated list of user or group IDs, exiting if one
+// is not a number.
+//
+// Returns the IDs.
+func parseIDs(list string) []int {
+	ids := []int{}
+	for _, field := range strings.Split(list, ",") {
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			fmt.Println("Invalid ID:", field)
+			os.Exit(1)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// parseClientFlags reads the optional client flags that follow the port.
+//
+// Returns the resulting client config.
+func parseClientFlags(args []string) sockets.ClientConfig {
+	config := sockets.ClientConfig{}
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	flags.StringVar(&config.IdentityFile, "identity", "",
+		"file holding the client's identity key, created if missing")
+	flags.StringVar(&config.KeyAlgorithm, "key-algorithm", "rsa-2048",
+		"algorithm of a new identity key: rsa-2048, rsa-3072, rsa-4096, ecdsa-p256 or ed25519")
+	flags.StringVar(&config.DataKeyFile, "data-key", "",
+		"file holding the AES keys that encrypt values, created if missing")
+	flags.StringVar(&config.CipherSuite, "cipher", "aes-256-gcm",
+		"cipher suite encrypting new values: aes-256-gcm or aes-256-ctr-hmac-sha256")
+	flags.BoolVar(&config.TLS, "tls", false,
+		"connect to the server over TLS 1.3")
+	flags.StringVar(&config.TLSCA, "tls-ca", "",
+		"file holding the CA certificate the server's certificate is checked against")
+	flags.StringVar(&config.TLSCert, "tls-cert", "",
+		"file holding a TLS certificate to present to the server")
+	flags.StringVar(&config.TLSKey, "tls-key", "",
+		"file holding the RSA key the TLS certificate was issued for")
+	flags.StringVar(&config.ServerFingerprint, "server-fingerprint", "",
+		"key fingerprint of the identity the server must sign key exchanges with")
+	addLogFlags(flags, &config.Log)
+	flags.Parse(args)
+	return config
+}
+
+// parseCertFlags reads the optional flags that follow the directory
+// certificates are written to.
+//
+// Returns the resulting certificate config, and the certificate to revoke
+// instead of issuing certificates, if any.
+func parseCertFlags(directory string, args []string) (sockets.CertConfig, string) {
+	config := sockets.CertConfig{Directory: directory}
+	flags := flag.NewFlagSet("certs", flag.ExitOnError)
+	hosts := flags.String("hosts", "localhost,127.0.0.1",
+		"comma separated host names and IP addresses the server is reached at")
+	flags.StringVar(&config.CAKey, "ca-key", filepath.Join(directory, "ca.pem"),
+		"file holding the CA's RSA key, created if missing")
+	flags.StringVar(&config.ServerKey, "server-key",
+		filepath.Join(directory, "server.pem"),
+		"file holding the server's RSA key, created if missing")
+	flags.StringVar(&config.ClientKey, "client-key",
+		filepath.Join(directory, "client.pem"),
+		"file holding the client's RSA key, e.g. its -identity, created if missing")
+	revoke := flags.String("revoke", "",
+		"file holding a certificate to add to the revocation list")
+	flags.Parse(args)
+	config.Hosts = strings.Split(*hosts, ",")
+	return config, *revoke
+}
+
+// addLogFlags registers the logging flags shared by the client and server.
+func addLogFlags(flags *flag.FlagSet, config *sockets.LogConfig) {
+	flags.StringVar(&config.Level, "log-level", "info",
+		"minimum level logged: debug, info, warn or error")
+	flags.StringVar(&config.Format, "log-format", "logfmt",
+		"log output format: logfmt or json")
+	flags.BoolVar(&config.Debug, "debug", false,
+		"log at debug level and reveal secret values such as stored values")
+}
@@ -0,0 +1,304 @@
+package sockets
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminUsage = `Admin commands:
+* STATS - Show the role, latest change, number of sessions, stored keys and
+bytes and the key pool.
+* CLIENTS - List open sessions with their connection number, key fingerprint,
+remote address, connect time, protocol and number of stored keys.
+* KICK [connection number or fingerprint prefix] - Close the session with the
+connection number, or the sessions of the one client whose fingerprint starts
+with at least 8 given characters.
+* SNAPSHOT [path] - Write the stored data to a file, by default the server's
+snapshot file.
+* PROMOTE - Stop following the primary and accept changes, if a replica.
+* RING [addresses...] - Show the cluster's nodes, or replace them and move
+namespaces to their new owners.
+* RAFT [ADD|REMOVE address] - Show this node's part in the Raft group, or add
+or remove a node, if the leader.`
+
+// minKickPrefix is the shortest fingerprint prefix KICK accepts, so that a
+// short prefix cannot close the sessions of many clients at once.
+const minKickPrefix = 8
+
+// Admin connects to the admin socket at the given path, sends a single
+// command built from the given words and prints the server's response.
+func Admin(socketPath string, command []string) {
+	connection, err := net.Dial("unix", socketPath)
+	if err != nil {
+		fmt.Println("Error connecting to admin socket:", err.Error())
+		os.Exit(1)
+	}
+	defer connection.Close()
+
+	_, err = connection.Write([]byte(strings.Join(command, " ") + "\n"))
+	if err != nil {
+		fmt.Println("Error writing:", err.Error())
+		os.Exit(1)
+	}
+	_, err = io.Copy(os.Stdout, connection)
+	if err != nil {
+		fmt.Println("Error reading:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// serveAdmin listens for admin commands on a Unix socket at the given path.
+// The socket is only accessible to the user running the server. A stale socket
+// file left by a previous server is removed, but a socket that is still being
+// served is left alone.
+//
+// Returns the listener and true if successful.
+func (s *server) serveAdmin(socketPath string) (net.Listener, bool) {
+	listener, ok := s.listenSocket(socketPath, 0600)
+	if !ok {
+		return nil, false
+	}
+
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.adminSession(connection)
+		}
+	}()
+	s.log.info("Serving admin commands", "path", socketPath)
+	return listener, true
+}
+
+// adminSession reads a single command from an admin connection, writes the
+// response and closes the connection.
+func (s *server) adminSession(connection net.Conn) {
+	defer connection.Close()
+	connection.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		fmt.Fprintln(connection, adminUsage)
+		return
+	}
+	s.log.info("Admin command", "command", strings.Join(words, " "))
+
+	switch strings.ToUpper(words[0]) {
+	case "STATS":
+		s.adminStats(connection)
+	case "CLIENTS":
+		s.adminClients(connection)
+	case "KICK":
+		if len(words) != 2 {
+			fmt.Fprintln(connection, "KICK: ERROR missing session")
+			return
+		}
+		s.adminKick(connection, words[1])
+	case "SNAPSHOT":
+		path := s.config.SnapshotFile
+		if len(words) > 1 {
+			path = words[1]
+		}
+		namespaces, ok := s.store.snapshot(path)
+		if !ok {
+			fmt.Fprintln(connection, "SNAPSHOT: ERROR")
+			return
+		}
+		fmt.Fprintf(connection, "SNAPSHOT: OK %d namespaces written to %s\n",
+			namespaces, path)
+	case "RING":
+		s.adminRing(connection, words[1:])
+	case "RAFT":
+		s.adminRaft(connection, words[1:])
+	case "PROMOTE":
+		sequence, ok := s.promote()
+		if !ok {
+			fmt.Fprintln(connection, "PROMOTE: ERROR not a replica")
+			return
+		}
+		fmt.Fprintf(connection, "PROMOTE: OK primary at sequence %d\n",
+			sequence)
+	default:
+		fmt.Fprintln(connection, adminUsage)
+	}
+}
+
+// adminStats writes the server's role and latest change, the number of open
+// sessions, stored data and the state of the key pool.
+func (s *server) adminStats(w io.Writer) {
+	keys, bytes := 0, 0
+	namespaces := s.store.stats()
+	for _, namespace := range namespaces {
+		keys += namespace.keys
+		bytes += namespace.bytes
+	}
+	s.sessionsMutex.Lock()
+	sessions := len(s.sessions)
+	s.sessionsMutex.Unlock()
+	pool := s.pool.stats()
+
+	fmt.Fprintf(w, "role: %s\n", s.role())
+	fmt.Fprintf(w, "sequence: %d\n", s.store.log.position())
+	fmt.Fprintf(w, "sessions: %d\n", sessions)
+	fmt.Fprintf(w, "namespaces: %d\n", len(namespaces))
+	fmt.Fprintf(w, "keys: %d\n", keys)
+	fmt.Fprintf(w, "bytes: %d\n", bytes)
+	fmt.Fprintf(w, "key pool: %d/%d ready, %d hits, %d misses\n",
+		pool.Depth, pool.Capacity, pool.Hits, pool.Misses)
+}
+
+// role describes the part the server plays: a primary, a replica or a member
+// of a Raft group.
+//
+// Returns the description.
+func (s *server) role() string {
+	if s.raft != nil {
+		status := s.raft.status()
+		return fmt.Sprintf("raft %s in term %d", status.Role, status.Term)
+	}
+	if s.replica.Load() {
+		return "replica of " + s.config.ReplicaOf
+	}
+	return "primary"
+}
+
+// adminClients writes one line for each open session, ordered by connection
+// number.
+func (s *server) adminClients(w io.Writer) {
+	namespaces := s.store.stats()
+	s.sessionsMutex.Lock()
+	numbers := make([]uint64, 0, len(s.sessions))
+	for number := range s.sessions {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	fmt.Fprintf(w, "%-6s %-16s %-22s %-25s %-16s %s\n",
+		"CONN", "FINGERPRINT", "REMOTE", "CONNECTED", "PROTOCOL", "KEYS")
+	for _, number := range numbers {
+		current := s.sessions[number]
+		keyFingerprint := "-"
+		if current.id != "" {
+			keyFingerprint = fingerprint(current.id)[:16]
+		}
+		fmt.Fprintf(w, "%-6d %-16s %-22s %-25s %-16s %d\n",
+			current.number,
+			keyFingerprint,
+			current.connection.RemoteAddr().String(),
+			current.connectedAt.Format(time.RFC3339),
+			current.protocol.String(),
+			namespaces[current.id].keys)
+	}
+	s.sessionsMutex.Unlock()
+}
+
+// adminRing writes the cluster's ring. If node addresses are given, the ring
+// is replaced by one holding those nodes first.
+func (s *server) adminRing(w io.Writer, nodes []string) {
+	if s.config.ClusterAddress == "" {
+		fmt.Fprintln(w, "RING: ERROR not part of a cluster")
+		return
+	}
+	if len(nodes) == 0 {
+		s.ringMutex.RLock()
+		defer s.ringMutex.RUnlock()
+		fmt.Fprintln(w, "RING: "+s.ring.String())
+		return
+	}
+	ring, accepted := s.changeRing(nodes)
+	fmt.Fprintf(w, "RING: OK version %d accepted by %d other nodes\n",
+		ring.version, accepted)
+}
+
+// adminRaft writes this node's role and progress in its Raft group. If
+// "ADD [address]" or "REMOVE [address]" is given, the leader first changes the
+// group's members.
+func (s *server) adminRaft(w io.Writer, words []string) {
+	if s.raft == nil {
+		fmt.Fprintln(w, "RAFT: ERROR not part of a Raft group")
+		return
+	}
+	if len(words) > 0 {
+		action := strings.ToUpper(words[0])
+		if len(words) != 2 || (action != "ADD" && action != "REMOVE") {
+			fmt.Fprintln(w, "RAFT: ERROR expected ADD or REMOVE and an address")
+			return
+		}
+		members, ok := s.raft.changeMembers(words[1], action == "ADD")
+		if !ok {
+			fmt.Fprintln(w, "RAFT: ERROR "+members)
+			return
+		}
+		fmt.Fprintln(w, "RAFT: OK members "+members)
+		return
+	}
+	status := s.raft.status()
+	fmt.Fprintf(w, "role: %s\n", status.Role)
+	fmt.Fprintf(w, "term: %d\n", status.Term)
+	fmt.Fprintf(w, "leader: %s\n", status.Leader)
+	fmt.Fprintf(w, "commit: %d\n", status.Commit)
+	fmt.Fprintf(w, "applied: %d\n", status.Applied)
+	fmt.Fprintf(w, "snapshot: %d\n", status.Snapshot)
+	fmt.Fprintf(w, "members: %s\n", strings.Join(status.Nodes, " "))
+}
+
+// adminKick closes the session whose connection number equals target, if
+// target is a number, or otherwise the sessions of the one client whose key
+// fingerprint starts with target. A fingerprint prefix must be at least
+// minKickPrefix hexadecimal characters long, and is refused if it matches more
+// than one client. The sessions end as if their connections had failed, so
+// the clients' data is kept.
+func (s *server) adminKick(w io.Writer, target string) {
+	number, err := strconv.ParseUint(target, 10, 64)
+	isNumber := err == nil
+	prefix := strings.ToLower(target)
+	if !isNumber {
+		if len(prefix) < minKickPrefix ||
+			strings.Trim(prefix, "0123456789abcdef") != "" {
+			fmt.Fprintf(w, "KICK: ERROR expected a connection number or at "+
+				"least %d characters of a fingerprint\n", minKickPrefix)
+			return
+		}
+	}
+
+	s.sessionsMutex.Lock()
+	matched := []*session{}
+	clients := map[string]bool{}
+	for _, current := range s.sessions {
+		if isNumber && current.number == number ||
+			!isNumber && current.id != "" &&
+				strings.HasPrefix(fingerprint(current.id), prefix) {
+			matched = append(matched, current)
+			clients[current.id] = true
+		}
+	}
+	if len(clients) > 1 {
+		s.sessionsMutex.Unlock()
+		fmt.Fprintf(w, "KICK: ERROR fingerprint prefix matches %d clients\n",
+			len(clients))
+		return
+	}
+	for _, current := range matched {
+		current.log.warn("Session kicked by admin")
+		current.connection.Close()
+	}
+	s.sessionsMutex.Unlock()
+
+	if len(matched) == 0 {
+		fmt.Fprintln(w, "KICK: ERROR no matching session")
+		return
+	}
+	fmt.Fprintf(w, "KICK: OK %d sessions closed\n", len(matched))
+}
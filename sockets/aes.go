@@ -4,8 +4,12 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strings"
 )
 
 // GenerateAESKey generates a 32-byte key that can be used to create an AES-256
@@ -17,11 +21,42 @@ func GenerateAESKey() []byte {
 	key := make([]byte, 32)
 	_, err := io.ReadFull(rand.Reader, key)
 	if err != nil {
-		fmt.Println(err)
+		defaultLogger.error("Error generating AES key", "error", err)
 	}
 	return key
 }
 
+// LoadAESKey reads a hexadecimal AES-256 key from the file at path. If the file
+// does not exist, a new key is generated with GenerateAESKey and saved there.
+// The file may be copied to other clients that need to read the same values.
+//
+// Returns a 32-long byte array and true if successful. Otherwise returns an
+// empty byte array and false.
+func LoadAESKey(path string) ([]byte, bool) {
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := GenerateAESKey()
+		err = os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600)
+		if err != nil {
+			defaultLogger.error("Error saving AES key", "path", path,
+				"error", err)
+			return []byte{}, false
+		}
+		return key, true
+	}
+	if err != nil {
+		defaultLogger.error("Error reading AES key", "path", path, "error", err)
+		return []byte{}, false
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != 32 {
+		defaultLogger.error("File does not contain an AES-256 key", "path", path)
+		return []byte{}, false
+	}
+	return key, true
+}
+
 // EncryptAES takes a given key and plaintext and produces an encrypted byte
 // array. The key is first used to create an AES-256 cipher in
 // Galois/Counter mode. A series of random bytes are chosen by
@@ -33,20 +68,20 @@ func GenerateAESKey() []byte {
 func EncryptAES(key []byte, plaintext string) ([]byte, bool) {
 	c, err := aes.NewCipher(key)
 	if err != nil {
-		fmt.Println(err)
+		defaultLogger.error("Error creating AES cipher", "error", err)
 		return []byte{}, false
 	}
 
 	gcm, err := cipher.NewGCM(c)
 	if err != nil {
-		fmt.Println(err)
+		defaultLogger.error("Error creating GCM cipher", "error", err)
 		return []byte{}, false
 	}
 
 	randBytes := make([]byte, gcm.NonceSize())
 	_, err = io.ReadFull(rand.Reader, randBytes)
 	if err != nil {
-		fmt.Println(err)
+		defaultLogger.error("Error generating nonce", "error", err)
 	}
 
 	return gcm.Seal(randBytes, randBytes, []byte(plaintext), nil), true
@@ -61,26 +96,27 @@ func EncryptAES(key []byte, plaintext string) ([]byte, bool) {
 func DecryptAES(key, encryptedBytes []byte) ([]byte, bool) {
 	c, err := aes.NewCipher(key)
 	if err != nil {
-		fmt.Println(err)
+		defaultLogger.error("Error creating AES cipher", "error", err)
 		return []byte{}, false
 	}
 
 	gcm, err := cipher.NewGCM(c)
 	if err != nil {
-		fmt.Println(err)
+		defaultLogger.error("Error creating GCM cipher", "error", err)
 		return []byte{}, false
 	}
 
 	nonceSize := gcm.NonceSize()
 	if len(encryptedBytes) < nonceSize {
-		fmt.Println(err)
+		defaultLogger.warn("Ciphertext is shorter than the nonce",
+			"length", len(encryptedBytes))
 		return []byte{}, false
 	}
 
 	nonce, encryptedBytes := encryptedBytes[:nonceSize], encryptedBytes[nonceSize:]
 	decryptedBytes, err := gcm.Open(nil, nonce, encryptedBytes, nil)
 	if err != nil {
-		fmt.Println(err)
+		defaultLogger.warn("Error decrypting AES ciphertext", "error", err)
 		return []byte{}, false
 	}
 	return decryptedBytes, true
@@ -0,0 +1,353 @@
+package sockets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Values the client encrypts are sent in an envelope naming how they were
+// encrypted, so that the cipher suite used for new values can change while
+// values written earlier stay readable:
+//   - The prefix "ENC" and the envelope's format version, 1, as a byte.
+//   - The ID of the cipher suite as a byte.
+//   - The ID of the key, the first 8 bytes of the key's SHA256 hash.
+//   - The suite's nonce, then the ciphertext.
+//
+// The suites are:
+//   - 1, "aes-256-gcm": AES-256 in Galois/Counter mode with a 12-byte nonce,
+//     authenticating the envelope's header as additional data.
+//   - 2, "aes-256-ctr-hmac-sha256": AES-256 in counter mode with a 16-byte IV,
+//     followed by an HMAC-SHA256 of the header, IV and ciphertext. The
+//     encryption and authentication keys are derived from the key with HKDF.
+//
+// Values written before envelopes were added are AES-256-GCM ciphertexts as
+// produced by EncryptAES, and are still read.
+
+// envelopePrefix starts every envelope.
+const envelopePrefix = "ENC"
+
+// envelopeVersion is the format version of envelopes written.
+const envelopeVersion = 1
+
+// keyIDSize is the length of the key ID in an envelope.
+const keyIDSize = 8
+
+// envelopeHeaderSize is the length of an envelope before its nonce.
+const envelopeHeaderSize = len(envelopePrefix) + 2 + keyIDSize
+
+// IDs of cipher suites.
+const (
+	suiteAESGCM     = 1
+	suiteAESCTRHMAC = 2
+)
+
+// defaultCipherSuite is the suite encrypting new values unless a config names
+// another.
+const defaultCipherSuite = "aes-256-gcm"
+
+// Labels deriving the keys of the counter mode suite.
+const (
+	ctrEncryptionLabel     = "aes-256-ctr encryption"
+	ctrAuthenticationLabel = "hmac-sha256 authentication"
+)
+
+// cipherSuite is a way of encrypting values that envelopes may name.
+type cipherSuite struct {
+	name      string
+	nonceSize int
+	// seal encrypts plaintext, authenticating the envelope's header.
+	seal func(key, nonce, plaintext, header []byte) ([]byte, bool)
+	// open decrypts ciphertext, checking the envelope's header.
+	open func(key, nonce, ciphertext, header []byte) ([]byte, bool)
+}
+
+// cipherSuites are the suites values may be encrypted with, by ID.
+var cipherSuites = map[byte]cipherSuite{
+	suiteAESGCM: {
+		name:      "aes-256-gcm",
+		nonceSize: 12,
+		seal:      sealAESGCM,
+		open:      openAESGCM,
+	},
+	suiteAESCTRHMAC: {
+		name:      "aes-256-ctr-hmac-sha256",
+		nonceSize: aes.BlockSize,
+		seal:      sealAESCTRHMAC,
+		open:      openAESCTRHMAC,
+	},
+}
+
+// envelope is an encrypted value split into its parts.
+type envelope struct {
+	header     []byte // Every byte before the nonce.
+	suite      byte   // The ID of the cipher suite.
+	keyID      []byte // Identifies the key the value was encrypted with.
+	nonce      []byte
+	ciphertext []byte
+}
+
+// cipherSuiteID finds the ID of the cipher suite with the given name, or of
+// the default suite if no name is given.
+//
+// Returns the ID and true if the suite is known.
+func cipherSuiteID(name string) (byte, bool) {
+	if name == "" {
+		name = defaultCipherSuite
+	}
+	for id, suite := range cipherSuites {
+		if suite.name == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// cipherSuiteNames lists the names of the known cipher suites.
+//
+// Returns the names, ordered by ID.
+func cipherSuiteNames() []string {
+	names := []string{}
+	for id := byte(1); int(id) <= len(cipherSuites); id++ {
+		names = append(names, cipherSuites[id].name)
+	}
+	return names
+}
+
+// keyID identifies a key in the envelopes it encrypts.
+//
+// Returns the first keyIDSize bytes of the key's SHA256 hash.
+func keyID(key []byte) []byte {
+	hash := sha256.Sum256(key)
+	return hash[:keyIDSize]
+}
+
+// EncryptValue encrypts plaintext with the given key using the cipher suite
+// with the given name, or the default suite if no name is given, and puts the
+// result in an envelope.
+//
+// Returns the envelope and true if successful. Otherwise, returns an empty
+// byte array and false.
+func EncryptValue(suiteName string, key []byte, plaintext string) ([]byte, bool) {
+	id, ok := cipherSuiteID(suiteName)
+	if !ok {
+		defaultLogger.error("Unknown cipher suite", "suite", suiteName)
+		return []byte{}, false
+	}
+	suite := cipherSuites[id]
+	nonce := make([]byte, suite.nonceSize)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		defaultLogger.error("Error generating nonce", "error", err)
+		return []byte{}, false
+	}
+
+	header := append([]byte(envelopePrefix), envelopeVersion, id)
+	header = append(header, keyID(key)...)
+	ciphertext, ok := suite.seal(key, nonce, []byte(plaintext), header)
+	if !ok {
+		return []byte{}, false
+	}
+	sealed := make([]byte, 0, len(header)+len(nonce)+len(ciphertext))
+	sealed = append(sealed, header...)
+	sealed = append(sealed, nonce...)
+	return append(sealed, ciphertext...), true
+}
+
+// DecryptValue decrypts a value encrypted by EncryptValue with the given key,
+// using the cipher suite its envelope names. A value without an envelope is
+// decrypted with DecryptAES, as values were written before envelopes.
+//
+// Returns the plaintext and true if successful. Otherwise, returns an empty
+// byte array and false.
+func DecryptValue(key, encryptedBytes []byte) ([]byte, bool) {
+	sealed, isEnvelope := parseEnvelope(encryptedBytes)
+	if !isEnvelope {
+		return DecryptAES(key, encryptedBytes)
+	}
+	if !bytes.Equal(sealed.keyID, keyID(key)) {
+		defaultLogger.warn("Value was encrypted with another key",
+			"key_id", fmt.Sprintf("%x", sealed.keyID))
+		return []byte{}, false
+	}
+	return cipherSuites[sealed.suite].open(
+		key, sealed.nonce, sealed.ciphertext, sealed.header)
+}
+
+// parseEnvelope splits an encrypted value into the parts of its envelope.
+//
+// Returns the parts and true if the value is an envelope of a known version
+// and cipher suite.
+func parseEnvelope(encryptedBytes []byte) (envelope, bool) {
+	if len(encryptedBytes) < envelopeHeaderSize ||
+		!bytes.HasPrefix(encryptedBytes, []byte(envelopePrefix)) ||
+		encryptedBytes[len(envelopePrefix)] != envelopeVersion {
+		return envelope{}, false
+	}
+	id := encryptedBytes[len(envelopePrefix)+1]
+	suite, known := cipherSuites[id]
+	if !known || len(encryptedBytes) < envelopeHeaderSize+suite.nonceSize {
+		return envelope{}, false
+	}
+	nonceEnd := envelopeHeaderSize + suite.nonceSize
+	return envelope{
+		header:     encryptedBytes[:envelopeHeaderSize],
+		suite:      id,
+		keyID:      encryptedBytes[envelopeHeaderSize-keyIDSize : envelopeHeaderSize],
+		nonce:      encryptedBytes[envelopeHeaderSize:nonceEnd],
+		ciphertext: encryptedBytes[nonceEnd:],
+	}, true
+}
+
+// newGCM creates an AES-256 cipher in Galois/Counter mode with the given key.
+//
+// Returns the cipher and true if successful.
+func newGCM(key []byte) (cipher.AEAD, bool) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		defaultLogger.error("Error creating AES cipher", "error", err)
+		return nil, false
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		defaultLogger.error("Error creating GCM cipher", "error", err)
+		return nil, false
+	}
+	return gcm, true
+}
+
+// sealAESGCM encrypts plaintext for the "aes-256-gcm" suite.
+//
+// Returns the ciphertext and true if successful.
+func sealAESGCM(key, nonce, plaintext, header []byte) ([]byte, bool) {
+	gcm, ok := newGCM(key)
+	if !ok {
+		return []byte{}, false
+	}
+	return gcm.Seal(nil, nonce, plaintext, header), true
+}
+
+// openAESGCM decrypts ciphertext of the "aes-256-gcm" suite.
+//
+// Returns the plaintext and true if successful.
+func openAESGCM(key, nonce, ciphertext, header []byte) ([]byte, bool) {
+	gcm, ok := newGCM(key)
+	if !ok {
+		return []byte{}, false
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		defaultLogger.warn("Error decrypting AES ciphertext", "error", err)
+		return []byte{}, false
+	}
+	return plaintext, true
+}
+
+// ctrKeys derives the encryption and authentication keys of the
+// "aes-256-ctr-hmac-sha256" suite from a key.
+//
+// Returns the AES stream cipher for the given IV, the authentication key and
+// true if successful.
+func ctrKeys(key, iv []byte) (cipher.Stream, []byte, bool) {
+	c, err := aes.NewCipher(hkdf(key, nil, ctrEncryptionLabel, 32))
+	if err != nil {
+		defaultLogger.error("Error creating AES cipher", "error", err)
+		return nil, nil, false
+	}
+	return cipher.NewCTR(c, iv), hkdf(key, nil, ctrAuthenticationLabel, 32), true
+}
+
+// ctrTag computes the HMAC-SHA256 ending a value of the
+// "aes-256-ctr-hmac-sha256" suite.
+//
+// Returns the tag.
+func ctrTag(macKey, header, iv, ciphertext []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(header)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	return mac.Sum(nil)
+}
+
+// sealAESCTRHMAC encrypts plaintext for the "aes-256-ctr-hmac-sha256" suite.
+//
+// Returns the ciphertext followed by its tag and true if successful.
+func sealAESCTRHMAC(key, iv, plaintext, header []byte) ([]byte, bool) {
+	stream, macKey, ok := ctrKeys(key, iv)
+	if !ok {
+		return []byte{}, false
+	}
+	ciphertext := make([]byte, len(plaintext))
+	stream.XORKeyStream(ciphertext, plaintext)
+	return append(ciphertext, ctrTag(macKey, header, iv, ciphertext)...), true
+}
+
+// openAESCTRHMAC checks the tag of a value of the "aes-256-ctr-hmac-sha256"
+// suite and decrypts it.
+//
+// Returns the plaintext and true if successful.
+func openAESCTRHMAC(key, iv, ciphertext, header []byte) ([]byte, bool) {
+	if len(ciphertext) < sha256.Size {
+		defaultLogger.warn("Ciphertext is shorter than its tag",
+			"length", len(ciphertext))
+		return []byte{}, false
+	}
+	stream, macKey, ok := ctrKeys(key, iv)
+	if !ok {
+		return []byte{}, false
+	}
+	tag := ciphertext[len(ciphertext)-sha256.Size:]
+	ciphertext = ciphertext[:len(ciphertext)-sha256.Size]
+	if !hmac.Equal(tag, ctrTag(macKey, header, iv, ciphertext)) {
+		defaultLogger.warn("Invalid tag on AES ciphertext")
+		return []byte{}, false
+	}
+	plaintext := make([]byte, len(ciphertext))
+	stream.XORKeyStream(plaintext, ciphertext)
+	return plaintext, true
+}
+
+// TestCipherSuites encrypts a value with each cipher suite, shows the parts of
+// its envelope and decrypts it, then shows that a value written before
+// envelopes is still read and that changed values and other keys are refused.
+func TestCipherSuites() {
+	configureLogging(LogConfig{Level: "error"})
+	plaintext := "Hello there"
+	key := GenerateAESKey()
+	for _, name := range cipherSuiteNames() {
+		encryptedBytes, ok := EncryptValue(name, key, plaintext)
+		if !ok {
+			fmt.Println(name + ": error encrypting")
+			return
+		}
+		sealed, _ := parseEnvelope(encryptedBytes)
+		decryptedBytes, ok := DecryptValue(key, encryptedBytes)
+		fmt.Printf("%s: suite %d, key %x, %d-byte nonce, %d bytes in all, "+
+			"decrypts: %t\n", name, sealed.suite, sealed.keyID,
+			len(sealed.nonce), len(encryptedBytes),
+			ok && string(decryptedBytes) == plaintext)
+
+		tampered := bytes.Clone(encryptedBytes)
+		tampered[len(tampered)-1] ^= 1
+		_, ok = DecryptValue(key, tampered)
+		fmt.Println("  changed value decrypts:", ok)
+		switched := bytes.Clone(encryptedBytes)
+		switched[len(envelopePrefix)+1] = suiteAESGCM + suiteAESCTRHMAC -
+			switched[len(envelopePrefix)+1]
+		_, ok = DecryptValue(key, switched)
+		fmt.Println("  value claiming the other suite decrypts:", ok)
+		_, ok = DecryptValue(GenerateAESKey(), encryptedBytes)
+		fmt.Println("  value decrypts with another key:", ok)
+	}
+
+	legacy, _ := EncryptAES(key, plaintext)
+	decryptedBytes, ok := DecryptValue(key, legacy)
+	fmt.Printf("Value written before envelopes decrypts: %t (%s)\n", ok,
+		strings.TrimSpace(string(decryptedBytes)))
+}
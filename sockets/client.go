@@ -3,72 +3,125 @@ package sockets
 
 import (
 	"bufio"
+	"crypto"
 	"crypto/rsa"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 )
 
-var validCommands = [4]string{"PUT ", "GET ", "DELETE ", "DISCONNECT"}
-var isPuttingValue = false
-var isGettingValue = false
+var validCommands = [12]string{"PUT ", "GET ", "DELETE ", "DISCONNECT",
+	"CREATE ", "GRANT ", "REVOKE ", "ACCESS ", "SHARE ", "UNSHARE ", "GROUP ",
+	"ROTATE"}
 var endLineChars = 2
-var clientPrivateKey *rsa.PrivateKey
-var clientPublicKey rsa.PublicKey
-var serverKey rsa.PublicKey
+var clientPrivateKey crypto.Signer // The client's identity key.
+var clientPublicKey crypto.PublicKey
 var aesKey []byte
+var valueCipherSuite string // The cipher suite encrypting new values.
+var clientLog = defaultLogger
+var clientTLS *tls.Config    // Used to connect to servers, if they speak TLS.
+var serverFingerprint string // The identity servers must prove, if any.
+
+// ClientConfig holds the options used to run a Client.
+type ClientConfig struct {
+	IdentityFile string    // File holding the client's identity key, if any.
+	KeyAlgorithm string    // Algorithm of a new identity key, e.g. "ed25519".
+	DataKeyFile  string    // File holding the client's AES keys, if any.
+	CipherSuite  string    // Cipher suite encrypting new values, e.g. "aes-256-gcm".
+	Log          LogConfig // Logging level, format and debug mode.
+
+	TLSCA   string // File holding the CA certificate servers are checked against.
+	TLSCert string // File holding a certificate to present to servers, if any.
+	TLSKey  string // File holding the RSA key the certificate was issued for.
+	TLS     bool   // Whether to connect over TLS.
+
+	// ServerFingerprint is the fingerprint of the identity the server must
+	// sign key exchanges with. If it is not given, the identity a server
+	// first signs with is trusted on first use.
+	ServerFingerprint string
+
+	// OnStateChange is told when a connection to a server fails or is
+	// established, instead of the change being printed.
+	OnStateChange func(address string, state ConnectionState)
+}
 
 // Client attempts to establish a socket connection to a TCP server with the
-// given host name and port. After using net.Dial, Client will generate RSA keys
-// and an AES key for secure communication and data storage. Client will then
-// run two goroutines that continuously read user input and server input.
-func Client(serverHost, serverPort string) {
+// given host name and port, or to a server on a Unix domain socket if the host
+// name is a unix:// address, in which case the port is ignored. After using
+// net.Dial, Client will generate an identity key of the algorithm named by the
+// config and an AES key for secure communication and data storage, or load
+// them from the files named by the config so that the client keeps its
+// identity and can read values stored in earlier runs. Client will then run
+// two goroutines that continuously read user input and server input. If the
+// connection fails, the client reconnects and sends the requests awaiting
+// responses again where it is safe to do so.
+// Diagnostics are logged to standard error as described by the given config.
+func Client(serverHost, serverPort string, config ClientConfig) {
+	configureLogging(config.Log)
+	address := serverHost + ":" + serverPort
+	if strings.HasPrefix(serverHost, unixScheme) {
+		address = serverHost
+	}
+	clientLog = defaultLogger.with("server", address)
+	if config.OnStateChange != nil {
+		connectionStateChanged = config.OnStateChange
+	}
+	serverFingerprint = config.ServerFingerprint
+	if config.TLS {
+		ok := true
+		clientTLS, ok = clientTLSConfig(
+			config.TLSCA, config.TLSCert, config.TLSKey)
+		if !ok {
+			os.Exit(1)
+		}
+	}
+
 	if runtime.GOOS == "windows" {
 		endLineChars = 2
 	} else {
 		endLineChars = 1
 	}
 
-	// Connect to server and close connection upon return.
-	connection, err := net.Dial(serverType, serverHost+":"+serverPort)
-	if err != nil {
-		panic(err)
-	}
-	defer connection.Close()
-
-	clientPrivateKey, clientPublicKey = GenerateRSAKeys()
-	serverKey = rsa.PublicKey{}
-	aesKey = GenerateAESKey()
-
-	// Register session by sending CONNECT message.
-	_, err = connection.Write([]byte("CONNECT " + RSAKeyToString(clientPublicKey)))
-	if err != nil {
-		fmt.Println("Error writing:", err.Error())
-		return
-	}
-
-	buffer := make([]byte, 1024)
-	mLen, err := connection.Read(buffer)
-	if err != nil {
-		fmt.Println("Error reading:", err.Error())
-		os.Exit(1)
+	ok := true
+	if config.IdentityFile != "" {
+		clientPrivateKey, ok = LoadIdentityKey(
+			config.IdentityFile, config.KeyAlgorithm)
+	} else {
+		clientPrivateKey, ok = GenerateIdentityKey(config.KeyAlgorithm)
 	}
-	if string(buffer[:mLen]) == "CONNECT: ERROR" {
-		fmt.Println("Error: session ID is already taken.")
+	if !ok {
 		os.Exit(1)
 	}
-	if strings.HasPrefix(string(buffer[:mLen]), "CONNECT") {
+	clientPublicKey = clientPrivateKey.Public()
+	aesKey = GenerateAESKey()
+	if config.DataKeyFile != "" {
 		ok := true
-		serverKey, ok = StringToRSAKey(string(buffer[9:mLen]))
+		aesKey, retiredKeys, ok = LoadDataKeys(config.DataKeyFile)
 		if !ok {
-			fmt.Println("ERROR: Received invalid public RSA key")
 			os.Exit(1)
 		}
-		fmt.Println(RSAKeyToString(serverKey))
+		dataKeyFile = config.DataKeyFile
+	}
+	if _, ok := cipherSuiteID(config.CipherSuite); !ok {
+		clientLog.error("Unknown cipher suite", "suite", config.CipherSuite,
+			"suites", strings.Join(cipherSuiteNames(), ","))
+		os.Exit(1)
 	}
+	valueCipherSuite = config.CipherSuite
+
+	// Connect to server, register session by sending CONNECT message and
+	// close connection upon return.
+	connection, ok := dialConnection(address, clientHandshake)
+	if !ok {
+		os.Exit(1)
+	}
+	defer connection.Close()
 
 	fmt.Println(`
 KEY-VALUE STORE CLIENT
@@ -77,11 +130,29 @@ Connects to the given server and manipulates data with the following commands:
 The server responds \"PUT: OK\" or \"PUT: ERROR\", depending on whether the operation is successful.
 * GET [key] - Allows the client to retrieve the value associated with a given key, if such a value exists. 
 The server responds either with the associated value or a \"GET: ERROR\" message.
+Errors from servers speaking protocol version 3 also give a status code, category and message, e.g. \"GET: ERROR 404 NOT_FOUND\".
 * DELETE [key] - Allows the client to delete a key and its associated value. The server responds \"DELETE: OK\" 
 or \"DELETE: ERROR\", depending on whether the operation is successful.
 * DISCONNECT - The server will remove all values stored by the client from its system and respond \"DISCONNECT: OK\". 
 After receiving a \"DISCONNECT: OK\" message, the client exits.
-After sending any other than these commands, the server and client will disconnect.`)
+If the connection to the server is lost, the client reconnects and sends unanswered GET and PUT commands again.
+After sending any other than these commands, the server and client will disconnect.
+Commands may be entered before earlier ones are answered, and responses are printed as they arrive.
+Keys of the form @[namespace]/[key] refer to a shared namespace, which is managed with the following commands:
+* CREATE [namespace] - Creates a shared namespace owned by this client.
+* GRANT [namespace] [fingerprint] [read|readwrite] - Gives the client with the given key fingerprint access.
+* REVOKE [namespace] [fingerprint] - Removes a client's access to a namespace.
+* ACCESS [namespace] - Lists the fingerprints of the clients that can use a namespace.
+Values in shared namespaces are encrypted with their own data key, which only this client can unwrap until it is shared:
+* SHARE [key] [fingerprint] - Wraps the value's data key for the client with the given fingerprint.
+* UNSHARE [key] [fingerprint] - Removes that client's wrapped data key. Changing the value with PUT also unshares it.
+A group is a shared namespace whose members share a group key, so values need not be shared one at a time:
+* GROUP CREATE [name] - Creates a group owned by this client.
+* GROUP ADD [name] [fingerprint] - Gives the client with the given key fingerprint the group key and read/write access.
+* GROUP REMOVE [name] [fingerprint] - Removes a member and rekeys the group, so it cannot read values written afterwards.
+* ROTATE - Replaces the data key encrypting this client's values, and re-encrypts the stored values with the new key in the background.
+The outcome is printed once every value is re-encrypted. If a value cannot be decrypted, the old key is kept and ROTATE can be run again once the value is deleted.`)
+	fmt.Println("Your key fingerprint: " + KeyFingerprint(clientPublicKey))
 
 	// Wait for goroutines to return before ending program.
 	var wg sync.WaitGroup
@@ -96,124 +167,545 @@ After sending any other than these commands, the server and client will disconne
 	wg.Wait()
 }
 
-// readServerMessages will continuously check for server messages and RSA
-// decrypt them. If "DISCONNECT" or an unrecognised command is received, the
-// client will disconnect.
-func readServerMessages(connection net.Conn) {
+// readServerMessages will continuously read the server's messages, decrypt
+// them with the session keys or RSA and hand each response to the request
+// waiting on it. The connection is replaced if reading fails, unless the
+// client closed it, and the client will disconnect if any other error occurs.
+func readServerMessages(connection *serverConnection) {
 	for {
-		buffer := make([]byte, 1024)
-		mLen, err := connection.Read(buffer)
+		buffer, err := serverProtocolFor(connection).readMessage(connection)
+		if err != nil && connection.isClosed() {
+			return
+		}
 		if err != nil {
-			fmt.Println("Error reading:", err.Error())
-			os.Exit(1)
+			clientLog.warn("Error reading", "error", err)
+			connection.reconnect()
+			continue
 		}
 
-		if serverKey != (rsa.PublicKey{}) {
+		if serverKeyFor(connection) != (rsa.PublicKey{}) {
+			sequence := sequenceFor(connection)
 			ok := false
-			buffer, ok = DecryptRSA(clientPrivateKey, buffer[:mLen])
-			if !ok {
-				panic("ERROR: Failed to decrypt message")
+			privateKey, isRSA := clientPrivateKey.(*rsa.PrivateKey)
+			if keys := sessionKeysFor(connection); keys != nil {
+				buffer, ok = DecryptAES(keys.receive, buffer)
+			} else if isRSA {
+				buffer, ok = decryptRSABlocks(privateKey, buffer,
+					sequence.headerSize())
 			}
-			mLen = len(buffer)
-		}
-
-		if mLen == 0 {
-			continue
-		}
-
-		if isGettingValue && string(buffer[:mLen]) != "GET: ERROR" {
-			plaintext, ok := DecryptAES(aesKey, buffer[:mLen])
 			if !ok {
-				fmt.Println("Error during AES decryption")
+				clientLog.error("Failed to decrypt message")
 				os.Exit(1)
 			}
-			fmt.Printf("\u001b[0K%s\n> ", plaintext)
-		} else {
-			fmt.Printf("\u001b[0K%s\n> ", string(buffer[:mLen]))
-		}
-		switch {
-		case strings.HasPrefix(string(buffer[:mLen]), "CONNECT: "):
-			ok := true
-			serverKey, ok = StringToRSAKey(string(buffer[9:mLen]))
+			if sequence != nil {
+				opened, err := sequence.open(buffer)
+				if err != nil {
+					clientLog.error("Message out of sequence", "error", err)
+					connection.reconnect()
+					continue
+				}
+				buffer = opened
+			}
+			buffer, ok = serverProtocolFor(connection).decode(buffer)
 			if !ok {
-				fmt.Println("ERROR: Received invalid public RSA key")
+				clientLog.error("Failed to decompress message")
 				os.Exit(1)
 			}
-			fmt.Println(RSAKeyToString(serverKey))
+		}
+
+		if len(buffer) == 0 {
 			continue
-		case strings.HasPrefix(string(buffer[:mLen]), "PUT: "):
-		case strings.HasPrefix(string(buffer[:mLen]), "DELETE: "):
+		}
+
+		id, message, tagged := "", buffer, false
+		if serverProtocolFor(connection).has(capabilityPipelining) {
+			id, message, tagged = cutRequestID(buffer)
+		}
+		pending, ok := connection.requests.take(id, tagged)
+		if !ok {
+			clientLog.warn("Received a response to no request",
+				"response", secret(message))
 			continue
-		default:
-			if isGettingValue {
-				isGettingValue = false
-				continue
-			} else {
-				os.Exit(0)
-			}
+		}
+		response := decodeResponse(connection, pending.command, message)
+
+		// The namespace moved to another node of the cluster, so the ring
+		// is fetched again before the next command.
+		if response.category == categoryMoved {
+			ringStale.Store(true)
+		}
+		pending.result <- response
+
+		// The server closes the connection once it has answered DISCONNECT.
+		if pending.command == "DISCONNECT" {
+			return
 		}
 	}
 }
 
 // readUserInputs will continously check for user input and send each line to
-// the server. If an invalid command is entered, the command will not be sent.
-// The client will disconnect if an error occurs
-func readUserInputs(connection net.Conn) {
+// the server. If the server is part of a cluster, each command is sent to the
+// node owning its namespace instead. If an invalid command is entered, the
+// command will not be sent. Responses are printed as they arrive, so commands
+// may be entered before earlier ones are answered. The client will disconnect
+// if an error occurs
+func readUserInputs(seed net.Conn) {
+	joinCluster(seed)
+	go reencryptValues(seed) // Resumes a rotation stopped in an earlier run.
+	reader := bufio.NewReader(os.Stdin)
 	for {
-		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("> ")
-		input, _ := reader.ReadString('\n')
-		for _, command := range validCommands {
-			if !strings.HasPrefix(input, command) && !isPuttingValue {
-				continue
-			}
-			if isPuttingValue {
-				ciphertext, ok := EncryptAES(aesKey, input[:len(input)-endLineChars])
-				if !ok {
-					fmt.Println("Error during AES encryption")
-					os.Exit(1)
-				}
-				_, err := connection.Write([]byte(ciphertext)) // Cut end-line.
-				if err != nil {
-					fmt.Println("Error writing:", err.Error())
-					os.Exit(1)
-				}
-				isPuttingValue = false
-				break
-			} else if strings.HasPrefix(input, "PUT ") {
-				sendClientMessage(connection, input)
-				isPuttingValue = true
-				break
-			}
-			if strings.HasPrefix(input, "GET ") {
-				isGettingValue = true
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if ringStale.Swap(false) {
+			joinCluster(seed)
+		}
+		if !validCommand(input) {
+			continue
+		}
+		input = input[:len(input)-endLineChars] // Cut end-line.
+		connection := routeInput(seed, input)
+		command, argument, _ := strings.Cut(input, " ")
+		_, _, shared := splitSharedKey(strings.TrimSpace(argument))
+		switch {
+		case command == "PUT":
+			putInput(connection, reader, input)
+		case command == "SHARE":
+			shareValue(connection, strings.Fields(argument))
+		case command == "GROUP":
+			groupInput(connection, strings.Fields(argument))
+		case command == "ROTATE":
+			rotateInput(seed)
+		case command == "DELETE" && !shared:
+			noteRotationWrite(strings.TrimSpace(argument))
+			go printResponse(sendRequest(connection, input))
+		case command == "GET" && shared:
+			getSharedValue(connection, strings.TrimSpace(argument))
+		case command == "GET":
+			go printValue(sendRequest(connection, input))
+		case command == "DISCONNECT":
+			disconnectNodes(seed)
+			fmt.Println(requestResponse(connection, input))
+			os.Exit(0)
+		default:
+			go printResponse(sendRequest(connection, input))
+		}
+	}
+}
+
+// validCommand checks whether a line of input starts with a valid command.
+func validCommand(input string) bool {
+	for _, command := range validCommands {
+		if strings.HasPrefix(input, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// putInput carries out "PUT [key]" by sending the command, then reading the
+// value from the next line of input and sending it once encrypted. Values in
+// shared namespaces are encrypted with a group key or sealed with their own
+// data key so that they can be shared with other clients.
+func putInput(connection net.Conn, reader *bufio.Reader, input string) {
+	key := strings.TrimSpace(input[4:])
+	groupEpoch, groupKey, ok := prepareSharedPut(connection, key)
+	if !ok {
+		fmt.Println("PUT: ERROR no group key available")
+		return
+	}
+	_, _, shared := splitSharedKey(key)
+	if !shared {
+		noteRotationWrite(key)
+	}
+	dataKey := currentDataKey()
+	pending := beginRequest(connection, input)
+	fmt.Print("> ")
+	value, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	value = value[:len(value)-endLineChars] // Cut end-line.
+
+	ciphertext := []byte{}
+	if shared {
+		ciphertext, ok = encryptSharedValue(value, groupEpoch, groupKey)
+	} else {
+		ciphertext, ok = EncryptValue(valueCipherSuite, dataKey, value)
+	}
+	if !ok {
+		clientLog.error("Error encrypting value")
+		os.Exit(1)
+	}
+	endRequest(connection, pending, ciphertext)
+	go printResponse(pending.result)
+}
+
+// printResponse waits for a response and prints it.
+func printResponse(result <-chan response) {
+	fmt.Printf("\u001b[0K%s\n> ", <-result)
+}
+
+// printValue waits for the response to a GET and prints the value it holds,
+// decrypted with the client's data key, or a retired one during a rotation.
+func printValue(result <-chan response) {
+	response := <-result
+	if !response.ok() || response.payload == "" {
+		fmt.Printf("\u001b[0K%s\n> ", response)
+		return
+	}
+	plaintext, ok := decryptDataValue([]byte(response.payload))
+	if !ok {
+		fmt.Print("\u001b[0KGET: ERROR value cannot be decrypted by this client\n> ")
+		return
+	}
+	fmt.Printf("\u001b[0K%s\n> ", plaintext)
+}
+
+// shareValue carries out "SHARE [key] [fingerprint]" by giving the client
+// with the given fingerprint a copy of a sealed value's data key. The
+// recipient's public key is fetched from the server and checked against the
+// fingerprint, so the server cannot substitute a key of its own. The data key
+// is unwrapped locally and wrapped again for the recipient, so the server
+// never sees it.
+func shareValue(connection net.Conn, arguments []string) {
+	if len(arguments) != 2 {
+		fmt.Println("Usage: SHARE [key] [fingerprint]")
+		return
+	}
+	key, recipient := arguments[0], strings.ToLower(arguments[1])
+
+	recipientKey, ok := lookupPublicKey(connection, recipient)
+	if !ok {
+		fmt.Println("SHARE: ERROR unknown recipient")
+		return
+	}
+
+	dataKey, _, ok := unwrapSealedKey(clientPrivateKey,
+		[]byte(requestResponse(connection, "GET "+key).payload))
+	if !ok {
+		fmt.Println("SHARE: ERROR value is not sealed for this client")
+		return
+	}
+	wrappedKey, ok := wrapKey(recipientKey, dataKey)
+	if !ok {
+		fmt.Println("SHARE: ERROR failed to wrap data key")
+		return
+	}
+
+	fmt.Println(requestResponse(connection,
+		"SHARE "+key+" "+recipient+" "+hex.EncodeToString(wrappedKey)))
+}
+
+// setServerKey records the session key of the server at the other end of a
+// connection.
+func setServerKey(connection *serverConnection, serverKey rsa.PublicKey) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.serverKey = serverKey
+}
+
+// serverKeyFor finds the session key of the server at the other end of a
+// connection.
+//
+// Returns the key, or an empty key if keys have not yet been exchanged.
+func serverKeyFor(connection net.Conn) rsa.PublicKey {
+	c, ok := connection.(*serverConnection)
+	if !ok {
+		return rsa.PublicKey{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.serverKey
+}
+
+// setServerProtocol records the protocol agreed with the server at the other
+// end of a connection.
+func setServerProtocol(connection *serverConnection, agreed protocol) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.protocol = agreed
+}
+
+// serverProtocolFor finds the protocol agreed with the server at the other end
+// of a connection.
+//
+// Returns the protocol, which is version 1 if none was agreed.
+func serverProtocolFor(connection net.Conn) protocol {
+	c, ok := connection.(*serverConnection)
+	if !ok {
+		return protocol{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.protocol
+}
+
+// setSessionKeys records the keys exchanged with the server at the other end
+// of a connection, or nil if none were.
+func setSessionKeys(connection *serverConnection, keys *sessionKeys) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.keys = keys
+}
+
+// sessionKeysFor finds the keys exchanged with the server at the other end of
+// a connection.
+//
+// Returns the keys, or nil if none were exchanged.
+func sessionKeysFor(connection net.Conn) *sessionKeys {
+	c, ok := connection.(*serverConnection)
+	if !ok {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.keys
+}
+
+// startSequence starts numbering the messages of a client's session with a
+// server, if sequencing was agreed. It is called once the connection is in
+// use, so that no message sent on a failed connection is numbered.
+func startSequence(connection *serverConnection) {
+	var started *sequence
+	if serverProtocolFor(connection).has(capabilitySequencing) {
+		started = newSequence(serverKeyFor(connection))
+	}
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.sequence = started
+}
+
+// sequenceFor finds the numbering of the messages of a client's session with
+// a server.
+//
+// Returns the sequence, or nil if messages are not numbered.
+func sequenceFor(connection net.Conn) *sequence {
+	c, ok := connection.(*serverConnection)
+	if !ok {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.sequence
+}
+
+// pendingRequest is a request sent to a server that awaits its response.
+type pendingRequest struct {
+	id      uint64
+	command string        // The command sent, needed to read old responses.
+	result  chan response // Receives the response.
+
+	// The request is kept so that it can be sent again after reconnecting.
+	message    string // The message sent, without its request ID.
+	value      []byte // The value following the message, if any.
+	complete   bool   // Whether the value, if any, was written.
+	abandoned  bool   // Whether it failed as the connection was lost.
+	generation uint64 // The connection it was last sent on.
+}
+
+// requestQueue holds the requests sent on a connection that await their
+// responses.
+type requestQueue struct {
+	writeMutex sync.Mutex    // Held while a request and its value are written.
+	turn       chan struct{} // Holds the request awaited without pipelining.
+	mutex      sync.Mutex
+	nextID     uint64
+	pending    []*pendingRequest // In the order they were sent.
+}
+
+// add records a request sending the given message. q.mutex must be held.
+//
+// Returns the pending request.
+func (q *requestQueue) add(message string) *pendingRequest {
+	q.nextID++
+	command, _, _ := strings.Cut(message, " ")
+	pending := &pendingRequest{
+		id:      q.nextID,
+		command: command,
+		result:  make(chan response, 1),
+		message: message,
+	}
+	q.pending = append(q.pending, pending)
+	return pending
+}
+
+// take removes the request a response answers. A response tagged with an ID
+// answers the request with that ID, while untagged responses answer requests
+// in the order they were sent, as servers carry them out in that order.
+//
+// Returns the request and true if one is waiting.
+func (q *requestQueue) take(id string, tagged bool) (*pendingRequest, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, pending := range q.pending {
+		if !tagged || strconv.FormatUint(pending.id, 10) == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			if !tagged {
+				<-q.turn
 			}
-			sendClientMessage(connection, input)
-			break
+			return pending, true
 		}
 	}
+	return nil, false
 }
 
-// sendClientMessage will RSA encrypt the given message and send it along the
-// given connection. If public keys have not yet been exchanged, the message
-// will not be encrypted. Disconnects the client if an error occurs.
-func sendClientMessage(connection net.Conn, input string) {
-	if serverKey == (rsa.PublicKey{}) {
-		_, err := connection.Write([]byte(input[:len(input)-endLineChars])) // Cut end-line.
-		if err != nil {
-			fmt.Println("Error writing:", err.Error())
-			os.Exit(1)
+// newRequestQueue creates an empty queue of requests.
+//
+// Returns a pointer to the new queue.
+func newRequestQueue() *requestQueue {
+	return &requestQueue{turn: make(chan struct{}, 1)}
+}
+
+// requestsFor finds the queue of requests sent on a connection, which is a
+// serverConnection, as only those have their responses read.
+//
+// Returns the queue.
+func requestsFor(connection net.Conn) *requestQueue {
+	return connection.(*serverConnection).requests
+}
+
+// beginRequest sends a message to the server, tagged with a new request ID,
+// without waiting for earlier requests to be answered. If pipelining was not
+// agreed, the server only reads a message whole if it arrives alone, so the
+// message is not tagged and is sent once earlier requests are answered. No
+// other request is sent on the connection until endRequest, so that a value
+// can follow the message.
+//
+// Returns the pending request.
+func beginRequest(connection net.Conn, message string) *pendingRequest {
+	queue := requestsFor(connection)
+	queue.writeMutex.Lock()
+	if !serverProtocolFor(connection).has(capabilityPipelining) {
+		queue.turn <- struct{}{}
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	pending := queue.add(message)
+	pending.send(connection)
+	return pending
+}
+
+// endRequest sends the value following a request begun on a connection, if it
+// is not nil, and lets other requests be sent. If the connection was replaced
+// since the request was begun, the whole request is sent again, unless it
+// failed instead.
+func endRequest(connection net.Conn, pending *pendingRequest, value []byte) {
+	queue := requestsFor(connection)
+	defer queue.writeMutex.Unlock()
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	pending.value, pending.complete = value, true
+	switch {
+	case pending.abandoned:
+	case pending.generation != connectionGeneration(connection):
+		pending.send(connection)
+	case value != nil:
+		writeClientValue(connection, value)
+	}
+}
+
+// send writes the request along a connection, tagged with its ID if
+// pipelining was agreed, followed by its value if any.
+func (pending *pendingRequest) send(connection net.Conn) {
+	message := pending.message
+	if serverProtocolFor(connection).has(capabilityPipelining) {
+		message = "#" + strconv.FormatUint(pending.id, 10) + " " + message
+	}
+	pending.generation = connectionGeneration(connection)
+	writeClientMessage(connection, message)
+	if pending.value != nil {
+		writeClientValue(connection, pending.value)
+	}
+}
+
+// sendRequest sends a message to the server as beginRequest does.
+//
+// Returns a channel that receives the response.
+func sendRequest(connection net.Conn, message string) <-chan response {
+	pending := beginRequest(connection, message)
+	endRequest(connection, pending, nil)
+	return pending.result
+}
+
+// requestResponse sends a message to the server and waits for the response
+// instead of printing it.
+//
+// Returns the response.
+func requestResponse(connection net.Conn, message string) response {
+	return <-sendRequest(connection, message)
+}
+
+// decodeResponse reads a response from the server at the other end of a
+// connection, which is an envelope from servers speaking version 3 or later.
+// The command the response answers is needed for earlier versions, and is
+// taken from the response if not given.
+//
+// Returns the response.
+func decodeResponse(connection net.Conn, command string, message []byte) response {
+	if serverProtocolFor(connection).version >= protocolV3 {
+		if decoded, ok := parseResponse(string(message)); ok {
+			return decoded
 		}
+	}
+	return parseLegacyResponse(command, string(message))
+}
+
+// writeClientMessage will encrypt the given message with the session keys, or
+// RSA if none were exchanged, and send it along the given connection. If
+// public keys have not yet been exchanged, the message will not be encrypted.
+// Disconnects the client if an error occurs.
+func writeClientMessage(connection net.Conn, message string) {
+	if serverKeyFor(connection) == (rsa.PublicKey{}) {
+		writeClientBytes(connection, []byte(message))
 		return
 	}
-	encryptedBytes, ok := EncryptRSA(serverKey, input[:len(input)-endLineChars])
+	writeClientEncrypted(connection,
+		serverProtocolFor(connection).encode(message))
+}
+
+// writeClientValue sends the given value following PUT along the given
+// connection. Values are already encrypted with a data key, so they are sent
+// as they are, unless messages are numbered, in which case they are numbered
+// and encrypted like any other message.
+func writeClientValue(connection net.Conn, value []byte) {
+	if sequenceFor(connection) != nil {
+		writeClientEncrypted(connection, string(value))
+		return
+	}
+	writeClientBytes(connection, value)
+}
+
+// writeClientEncrypted numbers the given message if sequencing was agreed,
+// encrypts it with the session keys, or RSA if none were exchanged, and sends
+// it along the given connection. Disconnects the client if encryption fails.
+func writeClientEncrypted(connection net.Conn, message string) {
+	sequence := sequenceFor(connection)
+	if sequence != nil {
+		message = sequence.seal(message)
+	}
+	encryptedBytes, ok := []byte{}, false
+	if keys := sessionKeysFor(connection); keys != nil {
+		encryptedBytes, ok = EncryptAES(keys.send, message)
+	} else {
+		encryptedBytes, ok = encryptRSABlocks(serverKeyFor(connection),
+			message, sequence.headerSize())
+	}
 	if !ok {
-		fmt.Println("Error encrypting message")
+		clientLog.error("Error encrypting message")
 		os.Exit(1)
 	}
-	_, err := connection.Write(encryptedBytes) // Cut end-line.
+	writeClientBytes(connection, encryptedBytes)
+}
+
+// writeClientBytes sends the given bytes along the given connection as they
+// are. If an error occurs, the request is sent again or fails once the
+// connection is replaced.
+func writeClientBytes(connection net.Conn, value []byte) {
+	_, err := serverProtocolFor(connection).writeMessage(connection, value)
 	if err != nil {
-		fmt.Println("Error writing:", err.Error())
-		os.Exit(1)
+		clientLog.warn("Error writing", "error", err)
 	}
 }
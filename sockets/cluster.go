@@ -0,0 +1,655 @@
+package sockets
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Nodes of a cluster divide the namespaces between them with consistent
+// hashing. Each client's own namespace, named by its key fingerprint, and each
+// shared namespace, named "@name", is owned by the node that follows it on a
+// hash ring. Clients fetch the ring with NODES, connect to every node and send
+// each command to the node owning its namespace. A node answers commands for
+// namespaces it does not own as MOVED.
+//
+// Changing the ring with the admin RING command pushes it to every node, which
+// then migrates the namespaces it no longer owns to their new owners. Nodes
+// talk to each other over the same authenticated channel as clients, using
+// their own RSA identities.
+
+// virtualNodes is the number of points each node has on the hash ring. More
+// points spread namespaces more evenly between nodes.
+const virtualNodes = 64
+
+// hashRing assigns namespaces to the nodes of a cluster.
+type hashRing struct {
+	version uint64            // Increases whenever the membership changes.
+	nodes   []string          // Node addresses, sorted.
+	points  []uint64          // Hashes of the nodes' points on the ring, sorted.
+	owners  map[uint64]string // Node address of each point.
+}
+
+// newHashRing places virtualNodes points on a ring for each of the given node
+// addresses.
+//
+// Returns a pointer to the new ring.
+func newHashRing(version uint64, nodes []string) *hashRing {
+	ring := &hashRing{version: version, owners: map[uint64]string{}}
+	ring.nodes = append([]string{}, nodes...)
+	sort.Strings(ring.nodes)
+	for _, node := range ring.nodes {
+		for i := 0; i < virtualNodes; i++ {
+			point := ringHash(node + "#" + strconv.Itoa(i))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = node
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i] < ring.points[j]
+	})
+	return ring
+}
+
+// parseHashRing reads a ring written by hashRing.String.
+//
+// Returns the ring and true if the fields are valid.
+func parseHashRing(fields []string) (*hashRing, bool) {
+	if len(fields) == 0 {
+		return nil, false
+	}
+	version, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return newHashRing(version, fields[1:]), true
+}
+
+// ringHash hashes a string to a position on the hash ring.
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// owner finds the node owning a namespace, which is the node of the first
+// point at or after the namespace's hash.
+//
+// Returns the node's address, or an empty string if the ring has no nodes.
+func (ring *hashRing) owner(namespace string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	point := ringHash(namespace)
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i] >= point
+	})
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[ring.points[i]]
+}
+
+// String writes the ring's version followed by its node addresses.
+func (ring *hashRing) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%d %s",
+		ring.version, strings.Join(ring.nodes, " ")))
+}
+
+// keyNamespace finds the namespace holding a key used by the client with the
+// given ID.
+//
+// Returns "@name" for keys in a shared namespace and the client's fingerprint
+// otherwise.
+func keyNamespace(id, key string) string {
+	if name, _, shared := splitSharedKey(key); shared {
+		return "@" + name
+	}
+	return fingerprint(id)
+}
+
+// commandNamespace finds the namespace a command sent by the client with the
+// given ID refers to.
+//
+// Returns the namespace and true if the command refers to one.
+func commandNamespace(id, command, argument string) (string, bool) {
+	arguments := strings.Fields(argument)
+	switch command {
+	case "PUT", "GET", "DELETE", "SHARE", "UNSHARE", "EXPIRE",
+		"ITEM", "SETITEM", "INCR", "DECR":
+		if len(arguments) > 0 {
+			return keyNamespace(id, arguments[0]), true
+		}
+	case "CREATE", "GRANT", "REVOKE", "ACCESS":
+		if len(arguments) > 0 {
+			return "@" + arguments[0], true
+		}
+	case "GROUP":
+		if len(arguments) > 1 {
+			return "@" + arguments[1], true
+		}
+	case "KEYS":
+		if len(arguments) > 0 {
+			return "@" + strings.TrimPrefix(arguments[0], "@"), true
+		}
+		return fingerprint(id), true
+	}
+	return "", false
+}
+
+// owns checks whether this server owns a namespace. A server that is not part
+// of a cluster owns every namespace.
+func (s *server) owns(namespace string) bool {
+	s.ringMutex.RLock()
+	defer s.ringMutex.RUnlock()
+	return s.ring == nil || s.ring.owner(namespace) == s.config.ClusterAddress
+}
+
+// movedCommand checks whether a command refers to a namespace owned by
+// another node of the cluster.
+func (s *server) movedCommand(current *session, command, argument string) bool {
+	namespace, ok := commandNamespace(current.id, command, argument)
+	return ok && !s.owns(namespace)
+}
+
+// isPeer checks whether the client with the given ID is another node of the
+// cluster.
+func (s *server) isPeer(id string) bool {
+	return keyListed(s.config.ClusterKeys, id)
+}
+
+// nodesCommand carries out "NODES", which describes the cluster so that
+// clients can route commands.
+//
+// Returns the response, whose payload is "[version] [this node] [nodes...]",
+// or NOT_FOUND if the server is not part of a cluster.
+func (s *server) nodesCommand() string {
+	s.metrics.command("NODES", true)
+	s.ringMutex.RLock()
+	defer s.ringMutex.RUnlock()
+	if s.ring == nil {
+		return replyError("NODES", categoryNotFound, "not part of a cluster")
+	}
+	return reply("NODES", fmt.Sprintf("%d %s %s", s.ring.version,
+		s.config.ClusterAddress, strings.Join(s.ring.nodes, " ")))
+}
+
+// ringCommand carries out "RING [version] [nodes...]", sent by another node
+// whose membership was changed by an admin.
+//
+// Returns the response to send to the peer.
+func (s *server) ringCommand(current *session, argument string) string {
+	ring, ok := parseHashRing(strings.Fields(argument))
+	ok = ok && s.isPeer(current.id) && s.setRing(ring)
+	s.metrics.command("RING", ok)
+	if !ok {
+		current.log.warn("Refused ring", "ring", argument)
+		return replyError("RING", categoryDenied, "ring refused")
+	}
+	return reply("RING", "")
+}
+
+// setRing replaces the server's ring with a newer one and starts moving the
+// namespaces this node no longer owns to their new owners.
+//
+// Returns false if the server already has a ring at least as new.
+func (s *server) setRing(ring *hashRing) bool {
+	s.ringMutex.Lock()
+	defer s.ringMutex.Unlock()
+	if s.ring != nil && ring.version <= s.ring.version {
+		return false
+	}
+	s.ring = ring
+	s.log.info("Ring changed", "ring", ring.String())
+	go s.rebalance()
+	return true
+}
+
+// changeRing sets the nodes of the cluster, pushing the new ring to every node
+// that was or will be a member so that each can move its namespaces.
+//
+// Returns the new ring and the number of other nodes that accepted it.
+func (s *server) changeRing(nodes []string) (*hashRing, int) {
+	s.ringMutex.RLock()
+	version := uint64(1)
+	members := map[string]bool{}
+	if s.ring != nil {
+		version = s.ring.version + 1
+		for _, node := range s.ring.nodes {
+			members[node] = true
+		}
+	}
+	s.ringMutex.RUnlock()
+	for _, node := range nodes {
+		members[node] = true
+	}
+	delete(members, s.config.ClusterAddress)
+
+	ring := newHashRing(version, nodes)
+	accepted := 0
+	for _, node := range sortedKeys(members) {
+		response, ok := s.peerRequest(node, "RING "+ring.String())
+		if !ok || response != "RING: OK" {
+			s.log.warn("Node refused ring", "node", node, "response", response)
+			continue
+		}
+		accepted++
+	}
+	s.setRing(ring)
+	return ring, accepted
+}
+
+// rebalance moves every namespace this node holds but no longer owns to its
+// owner. Namespaces are only removed here once their owner has stored them.
+func (s *server) rebalance() {
+	s.rebalanceMutex.Lock()
+	defer s.rebalanceMutex.Unlock()
+	s.ringMutex.RLock()
+	ring := s.ring
+	s.ringMutex.RUnlock()
+
+	moves := s.store.misplaced(ring, s.config.ClusterAddress)
+	for _, node := range sortedKeys(moves) {
+		namespaces := moves[node]
+		changes := s.store.export(namespaces)
+		if !s.migrate(node, changes) {
+			s.log.warn("Error moving namespaces", "node", node,
+				"namespaces", len(namespaces))
+			continue
+		}
+		s.store.evict(namespaces)
+		s.log.info("Moved namespaces", "node", node,
+			"namespaces", len(namespaces))
+	}
+}
+
+// migrate sends changes recreating a set of namespaces to another node with
+// "MIGRATE", followed by one frame per change and finally a synced change.
+//
+// Returns true if the node stored every change.
+func (s *server) migrate(node string, changes []mutation) bool {
+	if s.nodeKey == nil {
+		return false
+	}
+	connection, sessionKey, ok := dialServer(node,
+		s.nodeKey.PublicKey, s.peerTLS)
+	if !ok {
+		return false
+	}
+	defer connection.Close()
+	response, ok := serverRequest(connection, sessionKey, s.nodeKey, "MIGRATE")
+	if !ok || response != "MIGRATE: READY" {
+		return false
+	}
+	for _, change := range append(changes, mutation{Op: opSynced}) {
+		encoded, err := json.Marshal(change)
+		if err != nil {
+			return false
+		}
+		if _, ok := writeFrame(connection, sessionKey, encoded); !ok {
+			return false
+		}
+	}
+	buffer := make([]byte, messageBufferSize)
+	mLen, err := connection.Read(buffer)
+	if err != nil {
+		return false
+	}
+	decrypted, ok := DecryptRSA(s.nodeKey, buffer[:mLen])
+	return ok && strings.HasPrefix(string(decrypted), "MIGRATE: OK")
+}
+
+// migrateCommand carries out "MIGRATE" for another node by applying the
+// changes it sends until a synced change arrives.
+func (s *server) migrateCommand(current *session) {
+	if !s.isPeer(current.id) {
+		s.metrics.command("MIGRATE", false)
+		s.sendServerMessage(current, "MIGRATE: ERROR")
+		return
+	}
+	if !s.sendServerMessage(current, "MIGRATE: READY") {
+		return
+	}
+	applied := 0
+	for {
+		frame, ok := readFrame(current.connection)
+		if !ok {
+			current.log.warn("Lost connection to migrating node")
+			s.metrics.command("MIGRATE", false)
+			return
+		}
+		plaintext, ok := DecryptRSA(current.privateKey, frame)
+		change := mutation{}
+		if !ok || json.Unmarshal(plaintext, &change) != nil {
+			current.log.warn("Received invalid change from node")
+			s.metrics.command("MIGRATE", false)
+			return
+		}
+		if change.Op == opSynced {
+			break
+		}
+		// Changes are numbered again in this node's own log.
+		change.Sequence = 0
+		s.store.apply(change, true)
+		applied++
+	}
+	s.metrics.command("MIGRATE", true)
+	current.log.info("Received namespaces from node", "changes", applied)
+	s.sendServerMessage(current, fmt.Sprintf("MIGRATE: OK %d", applied))
+}
+
+// peerRequest connects to another node with this node's identity and sends it
+// a single command.
+//
+// Returns the response and true if successful.
+func (s *server) peerRequest(node, request string) (string, bool) {
+	if s.nodeKey == nil {
+		return "", false
+	}
+	connection, sessionKey, ok := dialServer(node,
+		s.nodeKey.PublicKey, s.peerTLS)
+	if !ok {
+		return "", false
+	}
+	defer connection.Close()
+	return serverRequest(connection, sessionKey, s.nodeKey, request)
+}
+
+// misplaced finds the namespaces holding data that the given ring assigns to
+// another node.
+//
+// Returns the namespaces, as client IDs or "@name", by the node owning them.
+func (s *store) misplaced(ring *hashRing, self string) map[string][]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	moves := map[string][]string{}
+	for _, id := range sortedKeys(s.clients) {
+		owner := ring.owner(fingerprint(id))
+		if len(s.clients[id].clientData) > 0 && owner != "" && owner != self {
+			moves[owner] = append(moves[owner], id)
+		}
+	}
+	for _, name := range sortedKeys(s.namespaces) {
+		owner := ring.owner("@" + name)
+		if owner != "" && owner != self {
+			moves[owner] = append(moves[owner], "@"+name)
+		}
+	}
+	return moves
+}
+
+// export describes the given namespaces, as client IDs or "@name", as changes
+// that recreate them on another node.
+//
+// Returns the changes.
+func (s *store) export(namespaces []string) []mutation {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	changes := []mutation{}
+	for _, namespace := range namespaces {
+		if strings.HasPrefix(namespace, "@") {
+			if s.namespaces[namespace[1:]] != nil {
+				changes = append(changes, s.sharedChanges(namespace[1:])...)
+			}
+			continue
+		}
+		if _, exists := s.clients[namespace]; exists {
+			changes = append(changes, s.clientChanges(namespace)...)
+		}
+	}
+	return changes
+}
+
+// evict removes the given namespaces, as client IDs or "@name", once they have
+// moved to another node. Clients stay registered, as they may still be
+// connected to this node.
+func (s *store) evict(namespaces []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, namespace := range namespaces {
+		if strings.HasPrefix(namespace, "@") {
+			delete(s.namespaces, namespace[1:])
+			s.record(mutation{Op: opDrop, Namespace: namespace[1:]})
+			continue
+		}
+		data := s.clients[namespace].clientData
+		for _, key := range sortedKeys(data) {
+			delete(data, key)
+			s.record(mutation{Op: opDelete, Client: namespace, Key: key})
+		}
+	}
+}
+
+// clusterRing is the ring this client routes commands with, or nil if the
+// server it connected to is not part of a cluster.
+var clusterRing *hashRing
+
+// nodeConnections are this client's connections by node address.
+var nodeConnections = map[string]net.Conn{}
+
+// clusterMutex guards clusterRing and nodeConnections, which a rotation reads
+// while user input may join the cluster again.
+var clusterMutex sync.Mutex
+
+// ringStale is set when a node answers that a namespace has moved, so that the
+// ring is fetched again before the next command.
+var ringStale atomic.Bool
+
+// joinCluster asks the server this client connected to for the cluster's ring
+// and connects to each node not yet connected. Nothing changes if the server
+// is not part of a cluster.
+func joinCluster(seed net.Conn) {
+	response := requestResponse(seed, "NODES")
+	fields := strings.Fields(response.payload)
+	if !response.ok() || len(fields) < 2 {
+		return
+	}
+	ring, ok := parseHashRing(append(fields[0:1], fields[2:]...))
+	if !ok {
+		return
+	}
+	clusterMutex.Lock()
+	clusterRing = ring
+	nodeConnections[fields[1]] = seed
+	missing := []string{}
+	for _, node := range ring.nodes {
+		if _, connected := nodeConnections[node]; !connected {
+			missing = append(missing, node)
+		}
+	}
+	clusterMutex.Unlock()
+	for _, node := range missing {
+		connection, ok := dialConnection(node, nodeHandshake)
+		if !ok {
+			continue
+		}
+		clusterMutex.Lock()
+		nodeConnections[node] = connection
+		clusterMutex.Unlock()
+		go readServerMessages(connection)
+	}
+	clientLog.info("Routing commands to cluster", "ring", ring.String())
+}
+
+// routeInput finds the connection to the node owning the namespace a line of
+// input refers to. Commands without a namespace are sent to the seed.
+//
+// Returns the connection.
+func routeInput(seed net.Conn, input string) net.Conn {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+	if clusterRing == nil {
+		return seed
+	}
+	command, argument, _ := strings.Cut(strings.TrimSpace(input), " ")
+	namespace, ok := commandNamespace(
+		PublicKeyToString(clientPublicKey), command, argument)
+	if !ok {
+		return seed
+	}
+	connection, exists := nodeConnections[clusterRing.owner(namespace)]
+	if !exists {
+		return seed
+	}
+	return connection
+}
+
+// disconnectNodes sends DISCONNECT to every node other than the seed and waits
+// for each to answer.
+func disconnectNodes(seed net.Conn) {
+	clusterMutex.Lock()
+	connections := []net.Conn{}
+	for _, connection := range nodeConnections {
+		if connection != seed {
+			connections = append(connections, connection)
+		}
+	}
+	clusterMutex.Unlock()
+	for _, connection := range connections {
+		requestResponse(connection, "DISCONNECT")
+	}
+}
+
+// TestCluster runs three nodes on localhost ports, spreads namespaces over the
+// first two and then rebalances as the third node joins and the first leaves.
+func TestCluster() {
+	configureLogging(LogConfig{Level: "warn"})
+	directory, err := os.MkdirTemp("", "cluster")
+	if err != nil {
+		fmt.Println("Error creating directory:", err.Error())
+		return
+	}
+	defer os.RemoveAll(directory)
+
+	listeners := []net.Listener{}
+	addresses := []string{}
+	identities := []string{}
+	fingerprints := []string{}
+	for i := 1; i <= 3; i++ {
+		listener, err := net.Listen(serverType, serverHost+":0")
+		if err != nil {
+			fmt.Println("Error listening:", err.Error())
+			return
+		}
+		path := filepath.Join(directory, fmt.Sprintf("node%d.pem", i))
+		_, publicKey, ok := LoadRSAKeys(path)
+		if !ok {
+			return
+		}
+		listeners = append(listeners, listener)
+		addresses = append(addresses, listener.Addr().String())
+		identities = append(identities, path)
+		fingerprints = append(fingerprints, RSAKeyFingerprint(publicKey))
+	}
+	nodes := []*server{}
+	for i, listener := range listeners {
+		members := addresses[:2]
+		if i == 2 {
+			members = nil
+		}
+		node := newServer(ServerConfig{
+			KeyPoolSize: 2, KeyPoolWorkers: 1,
+			ClusterNodes: members, ClusterAddress: addresses[i],
+			ClusterIdentity: identities[i], ClusterKeys: fingerprints})
+		nodes = append(nodes, node)
+		go node.serve(listener)
+	}
+	fmt.Println("Nodes listening on", strings.Join(addresses, ", "))
+
+	privateKey, publicKey := GenerateRSAKeys()
+	id := RSAKeyToString(publicKey)
+	connections := []net.Conn{}
+	sessionKeys := []rsa.PublicKey{}
+	for _, address := range addresses {
+		connection, sessionKey, ok := dialServer(address, publicKey, nil)
+		if !ok {
+			fmt.Println("Error connecting to", address)
+			return
+		}
+		defer connection.Close()
+		connections = append(connections, connection)
+		sessionKeys = append(sessionKeys, sessionKey)
+	}
+	// The data is stored directly on the owning node, as a client would after
+	// routing each command.
+	nodeByAddress := map[string]*server{}
+	for i, node := range nodes {
+		nodeByAddress[addresses[i]] = node
+	}
+	ring := newHashRing(1, addresses[:2])
+	for i := 1; i <= 12; i++ {
+		name := fmt.Sprintf("team%d", i)
+		owner := nodeByAddress[ring.owner("@"+name)].store
+		owner.createNamespace(id, name)
+		owner.put(id, "@"+name+"/plan", storedValue{data: "plan " + name})
+	}
+	nodeByAddress[ring.owner(fingerprint(id))].store.put(
+		id, "greeting", storedValue{data: "hello"})
+	printClusterKeys(nodes, addresses)
+
+	steps := [][]string{addresses, addresses[1:]}
+	for _, members := range steps {
+		ring, accepted := nodes[1].changeRing(members)
+		fmt.Printf("Ring version %d has %d nodes, %d others accepted it\n",
+			ring.version, len(members), accepted)
+		waitForBalance(nodes, addresses, ring)
+		printClusterKeys(nodes, addresses)
+	}
+
+	ring = nodes[1].ring
+	for _, request := range []string{"GET greeting", "GET @team1/plan"} {
+		command, argument, _ := strings.Cut(request, " ")
+		namespace, _ := commandNamespace(id, command, argument)
+		owner := 0
+		for i, address := range addresses {
+			if ring.owner(namespace) == address {
+				owner = i
+			}
+		}
+		fmt.Printf("Node %d: %s -> %s\n", owner+1, request,
+			testRequest(connections[owner], sessionKeys[owner],
+				privateKey, request))
+		fmt.Printf("Node 1: %s -> %s\n", request,
+			testRequest(connections[0], sessionKeys[0], privateKey, request))
+	}
+}
+
+// printClusterKeys prints the number of keys held by each node.
+func printClusterKeys(nodes []*server, addresses []string) {
+	for i, node := range nodes {
+		keys := 0
+		for _, namespace := range node.store.stats() {
+			keys += namespace.keys
+		}
+		fmt.Printf("  node %d (%s) holds %d keys\n", i+1, addresses[i], keys)
+	}
+}
+
+// waitForBalance waits up to ten seconds for every node to hold only the
+// namespaces the given ring assigns to it.
+func waitForBalance(nodes []*server, addresses []string, ring *hashRing) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		balanced := true
+		for i, node := range nodes {
+			if len(node.store.misplaced(ring, addresses[i])) > 0 {
+				balanced = false
+			}
+		}
+		if balanced {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	fmt.Println("Nodes did not finish rebalancing")
+}
@@ -0,0 +1,445 @@
+package sockets
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HTTP gateway serves the store as a JSON API for tools that cannot speak
+// the TCP protocol:
+//   - "GET /v1/health" describes the server and needs no signature.
+//   - "GET /v1/keys" lists the caller's keys, or the keys of the shared
+//     namespace given as "?namespace=[name]".
+//   - "GET /v1/keys/[key]" returns {"key": key, "value": base64}.
+//   - "PUT /v1/keys/[key]" stores the body {"value": base64}.
+//   - "DELETE /v1/keys/[key]" removes a key.
+//
+// Keys may name shared namespaces as "@name/key". Values are stored exactly as
+// given, so callers should encrypt them as the TCP client does.
+//
+// Every other request is signed with the caller's identity key using
+// SignIdentity. The caller sends its public key in the X-Client-Key header, in
+// the form used by PublicKeyToString, the current Unix time in X-Timestamp and
+// the base64 encoded signature in X-Signature. The signed text is the method,
+// the request URI, the timestamp and the hex SHA256 hash of the body,
+// separated by newlines. A caller is registered as a client on its first
+// request, and its data is kept until a TCP session of the same client
+// disconnects. Only a few new clients are registered each minute, so that
+// callers cannot create clients without limit.
+
+// Headers carrying a gateway request's signature.
+const (
+	gatewayKeyHeader       = "X-Client-Key"
+	gatewayTimestampHeader = "X-Timestamp"
+	gatewaySignatureHeader = "X-Signature"
+)
+
+const (
+	// gatewayClockSkew is how far a request's timestamp may be from the
+	// server's clock. Signatures are remembered for twice as long, so that a
+	// request cannot be replayed.
+	gatewayClockSkew = 5 * time.Minute
+
+	// gatewayMaxBody is the largest request body the gateway reads, which
+	// leaves room for a value of messageBufferSize bytes encoded as base64.
+	gatewayMaxBody = 4 * messageBufferSize
+
+	// gatewayRegistrations is how many new clients the gateway registers in
+	// any gatewayRegistrationWindow. Requests from further new clients are
+	// refused until the window has passed.
+	gatewayRegistrations      = 10
+	gatewayRegistrationWindow = time.Minute
+)
+
+// gateway serves a server's store over HTTP.
+type gateway struct {
+	server *server
+	mutex  sync.Mutex
+	seen   map[string]time.Time // Recent signatures by when they were seen.
+
+	registered []time.Time // When recent new clients were registered.
+}
+
+// gatewayValue is the JSON body of a stored value.
+type gatewayValue struct {
+	Key   string `json:"key,omitempty"`
+	Value []byte `json:"value"`
+}
+
+// serveGateway starts an HTTP listener on the given address that serves the
+// gateway. The listener runs until the program exits.
+func (s *server) serveGateway(address string) {
+	g := &gateway{server: s, seen: map[string]time.Time{}}
+	httpServer := &http.Server{
+		Addr:              address,
+		Handler:           g.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil {
+			s.log.error("Error serving gateway", "error", err)
+		}
+	}()
+	s.log.info("Serving HTTP gateway", "url", "http://"+address+"/v1/")
+}
+
+// handler routes the gateway's endpoints.
+//
+// Returns the HTTP handler.
+func (g *gateway) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/health", g.health)
+	mux.HandleFunc("/v1/keys", g.list)
+	mux.HandleFunc("/v1/keys/", g.key)
+	return mux
+}
+
+// health describes the server's role and whether it is serving requests.
+func (g *gateway) health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeGatewayError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeGatewayJSON(w, http.StatusOK, map[string]string{
+		"status": "ok",
+		"role":   g.server.role(),
+	})
+}
+
+// list carries out "GET /v1/keys".
+func (g *gateway) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeGatewayError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	current, _, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+	response := g.server.sessionlessCommand(current, "KEYS", r.URL.Query().Get("namespace"), nil)
+	if g.failed(w, response) {
+		return
+	}
+	keys := []string{}
+	for _, key := range strings.Split(response.payload, "\n") {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	writeGatewayJSON(w, http.StatusOK, map[string][]string{"keys": keys})
+}
+
+// key carries out GET, PUT and DELETE on "/v1/keys/[key]".
+func (g *gateway) key(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+	if key == "" || strings.ContainsAny(key, "\n\r") {
+		writeGatewayError(w, http.StatusBadRequest, "invalid key")
+		return
+	}
+	command := ""
+	switch r.Method {
+	case http.MethodGet:
+		command = "GET"
+	case http.MethodPut:
+		command = "PUT"
+	case http.MethodDelete:
+		command = "DELETE"
+	default:
+		writeGatewayError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	current, body, ok := g.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var value []byte
+	if command == "PUT" {
+		request := gatewayValue{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeGatewayError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if request.Value == nil || len(request.Value) > messageBufferSize {
+			writeGatewayError(w, http.StatusBadRequest, fmt.Sprintf(
+				"value must be given and at most %d bytes", messageBufferSize))
+			return
+		}
+		value = request.Value
+	}
+	response := g.server.sessionlessCommand(current, command, key, value)
+	if g.failed(w, response) {
+		return
+	}
+	switch command {
+	case "GET":
+		writeGatewayJSON(w, http.StatusOK,
+			gatewayValue{Key: key, Value: []byte(response.payload)})
+	case "PUT":
+		writeGatewayJSON(w, http.StatusOK, map[string]string{"key": key})
+	case "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// authenticate reads a request's body and checks its signature, writing an
+// error response if the signature is missing, wrong, stale or already used.
+//
+// Returns a session for the signing client, the body and true if the request
+// is authentic.
+func (g *gateway) authenticate(
+	w http.ResponseWriter,
+	r *http.Request,
+) (*session, []byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, gatewayMaxBody))
+	if err != nil {
+		writeGatewayError(w, http.StatusRequestEntityTooLarge, "body too large")
+		return nil, nil, false
+	}
+	g.server.metrics.add(metricBytesIn, "", float64(len(body)))
+
+	id := r.Header.Get(gatewayKeyHeader)
+	timestamp := r.Header.Get(gatewayTimestampHeader)
+	signature, err := base64.StdEncoding.DecodeString(
+		r.Header.Get(gatewaySignatureHeader))
+	if id == "" || err != nil || len(signature) == 0 {
+		g.server.metrics.error("gateway_auth")
+		writeGatewayError(w, http.StatusUnauthorized, "missing signature")
+		return nil, nil, false
+	}
+	publicKey, ok := StringToPublicKey(id)
+	if !ok {
+		g.server.metrics.error("gateway_auth")
+		writeGatewayError(w, http.StatusUnauthorized, "invalid client key")
+		return nil, nil, false
+	}
+	id = PublicKeyToString(publicKey)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	signedAt := time.Unix(seconds, 0)
+	if err != nil || time.Since(signedAt).Abs() > gatewayClockSkew {
+		g.server.metrics.error("gateway_auth")
+		writeGatewayError(w, http.StatusUnauthorized, "stale timestamp")
+		return nil, nil, false
+	}
+	text := gatewaySignedText(r.Method, r.URL.RequestURI(), timestamp, body)
+	if !VerifyIdentity(publicKey, text, signature) {
+		g.server.metrics.error("gateway_auth")
+		writeGatewayError(w, http.StatusUnauthorized, "invalid signature")
+		return nil, nil, false
+	}
+	if !g.firstUse(signature) {
+		g.server.metrics.error("gateway_auth")
+		writeGatewayError(w, http.StatusUnauthorized, "replayed request")
+		return nil, nil, false
+	}
+	if !g.server.store.hasClient(id) && !g.admitClient() {
+		g.server.metrics.error("gateway_registration")
+		writeGatewayError(w, http.StatusTooManyRequests,
+			"too many new clients, try again later")
+		return nil, nil, false
+	}
+
+	current := &session{
+		id: id,
+		log: g.server.log.with(
+			"gateway", r.RemoteAddr,
+			"client", fingerprint(id)[:16]),
+	}
+	current.log.debug("Gateway request", "method", r.Method,
+		"path", r.URL.Path)
+	return current, body, true
+}
+
+// firstUse records a signature, forgetting signatures old enough that their
+// timestamps would be refused anyway. VerifyIdentity accepts only one form of
+// each signature, so a request cannot be replayed with an altered signature.
+//
+// Returns false if the signature has been seen before.
+func (g *gateway) firstUse(signature []byte) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	for seen, at := range g.seen {
+		if now.Sub(at) > 2*gatewayClockSkew {
+			delete(g.seen, seen)
+		}
+	}
+	key := string(signature)
+	if _, seen := g.seen[key]; seen {
+		return false
+	}
+	g.seen[key] = now
+	return true
+}
+
+// admitClient records the registration of a new client, unless
+// gatewayRegistrations clients have been registered in the last
+// gatewayRegistrationWindow.
+//
+// Returns true if the client may be registered.
+func (g *gateway) admitClient() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	recent := g.registered[:0]
+	for _, at := range g.registered {
+		if now.Sub(at) < gatewayRegistrationWindow {
+			recent = append(recent, at)
+		}
+	}
+	g.registered = recent
+	if len(g.registered) >= gatewayRegistrations {
+		return false
+	}
+	g.registered = append(g.registered, now)
+	return true
+}
+
+// failed writes the error response matching a command's response, if the
+// command failed. Response statuses follow HTTP, so they are used as they
+// are, along with the category. A NOT_LEADER response also names the leader.
+//
+// Returns true if the command failed.
+func (g *gateway) failed(w http.ResponseWriter, outcome response) bool {
+	if outcome.ok() {
+		return false
+	}
+	message := outcome.message
+	if message == "" {
+		message = "request refused"
+	}
+	body := map[string]string{"error": message, "category": outcome.category}
+	if outcome.category == categoryNotLeader {
+		body["leader"] = outcome.payload
+	}
+	writeGatewayJSON(w, outcome.status, body)
+	return true
+}
+
+// gatewaySignedText builds the text a gateway request's signature covers.
+//
+// Returns the text to sign.
+func gatewaySignedText(method, uri, timestamp string, body []byte) string {
+	hash := sha256.Sum256(body)
+	return strings.Join(
+		[]string{method, uri, timestamp, hex.EncodeToString(hash[:])}, "\n")
+}
+
+// writeGatewayJSON writes value as a JSON response with the given status.
+func writeGatewayJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeGatewayError writes a JSON error response with the given status.
+func writeGatewayError(w http.ResponseWriter, status int, message string) {
+	writeGatewayJSON(w, status, map[string]string{"error": message})
+}
+
+// newGatewayRequest builds a gateway request signed with the given key.
+//
+// Returns the request and true if successful.
+func newGatewayRequest(
+	privateKey crypto.Signer,
+	method, url string,
+	body []byte,
+) (*http.Request, bool) {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	text := gatewaySignedText(method, request.URL.RequestURI(), timestamp, body)
+	request.Header.Set(gatewayKeyHeader, PublicKeyToString(privateKey.Public()))
+	request.Header.Set(gatewayTimestampHeader, timestamp)
+	request.Header.Set(gatewaySignatureHeader,
+		base64.StdEncoding.EncodeToString(SignIdentity(privateKey, text)))
+	return request, true
+}
+
+// TestGateway runs a server with an HTTP gateway on localhost ports, then
+// stores, lists, reads and deletes a key over HTTP. It also shows that unsigned,
+// replayed and tampered requests are refused, as are requests from new clients
+// once too many have registered.
+func TestGateway() {
+	configureLogging(LogConfig{Level: "warn"})
+	s, address := startTestServer(ServerConfig{KeyPoolSize: 2, KeyPoolWorkers: 1})
+	listener, err := net.Listen(serverType, serverHost+":0")
+	if err != nil {
+		fmt.Println("Error listening:", err.Error())
+		return
+	}
+	defer listener.Close()
+	g := &gateway{server: s, seen: map[string]time.Time{}}
+	go http.Serve(listener, g.handler())
+	base := "http://" + listener.Addr().String()
+	fmt.Println("Server listening on", address)
+	fmt.Println("Gateway listening on", base)
+
+	privateKey, _ := GenerateIdentityKey(keyRSA2048)
+	send := func(request *http.Request) {
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			fmt.Println("Error sending request:", err.Error())
+			return
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		fmt.Printf("%s %s -> %d %s\n", request.Method, request.URL.RequestURI(),
+			response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	signed := func(method, path string, body []byte) *http.Request {
+		request, _ := newGatewayRequest(privateKey, method, base+path, body)
+		return request
+	}
+
+	health, _ := http.NewRequest(http.MethodGet, base+"/v1/health", nil)
+	send(health)
+	put, _ := json.Marshal(gatewayValue{Value: []byte("hello")})
+	send(signed(http.MethodPut, "/v1/keys/greeting", put))
+	send(signed(http.MethodGet, "/v1/keys/greeting", nil))
+	send(signed(http.MethodGet, "/v1/keys", nil))
+
+	unsigned, _ := http.NewRequest(http.MethodGet, base+"/v1/keys/greeting", nil)
+	send(unsigned)
+	replayed := signed(http.MethodGet, "/v1/keys/greeting", nil)
+	send(replayed)
+	replayed.Body = io.NopCloser(bytes.NewReader(nil))
+	send(replayed)
+	tampered := signed(http.MethodPut, "/v1/keys/greeting", put)
+	other, _ := json.Marshal(gatewayValue{Value: []byte("tampered")})
+	tampered.Body = io.NopCloser(bytes.NewReader(other))
+	tampered.ContentLength = int64(len(other))
+	send(tampered)
+
+	send(signed(http.MethodDelete, "/v1/keys/greeting", nil))
+	send(signed(http.MethodGet, "/v1/keys/greeting", nil))
+
+	fmt.Printf("Sending requests from %d new clients...\n", gatewayRegistrations)
+	for i := 0; i < gatewayRegistrations; i++ {
+		privateKey, _ = GenerateIdentityKey(keyEd25519)
+		request := signed(http.MethodGet, "/v1/keys", nil)
+		if i < gatewayRegistrations-1 {
+			response, err := http.DefaultClient.Do(request)
+			if err == nil {
+				response.Body.Close()
+			}
+			continue
+		}
+		send(request)
+	}
+}
@@ -0,0 +1,482 @@
+package sockets
+
+import (
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// groupValuePrefix marks a value encrypted with a group key. A group value is
+// sent as the prefix, the group key's epoch as a 4-byte big endian integer and
+// finally the value encrypted by EncryptValue.
+const groupValuePrefix = "GROUP"
+
+// A group is a shared namespace whose members share a symmetric group key.
+// The group key is never seen by the server: it is wrapped with wrapKey for
+// each member and stored next to the namespace. Removing a member starts a new
+// epoch with a new group key, so a removed member cannot read anything written
+// after they left.
+
+// createGroup creates a shared namespace owned by the client with the given
+// ID, along with the first group key wrapped for the owner.
+//
+// Returns false if there is no client ID, or the name is invalid or already
+// taken.
+func (s *store) createGroup(id, name string, wrappedKey []byte) bool {
+	if id == "" || !s.createNamespace(id, name) {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.namespaces[name].groupKeys = []map[string][]byte{
+		{fingerprint(id): wrappedKey},
+	}
+	s.recordNamespace(name)
+	return true
+}
+
+// groupKey finds the group key of a namespace wrapped for the client with the
+// given ID. An epoch of -1 selects the current epoch.
+//
+// Returns the epoch, the wrapped key and whether the namespace is a group.
+// The wrapped key is empty if the client has no key for that epoch.
+func (s *store) groupKey(id, name string, epoch int) (int, []byte, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	namespace := s.namespaces[name]
+	if namespace == nil || len(namespace.groupKeys) == 0 ||
+		namespace.permissionOf(id) == permissionNone {
+		return 0, []byte{}, false
+	}
+	if epoch < 0 {
+		epoch = len(namespace.groupKeys) - 1
+	}
+	if epoch >= len(namespace.groupKeys) {
+		return epoch, []byte{}, true
+	}
+	wrappedKey, exists := namespace.groupKeys[epoch][fingerprint(id)]
+	if !exists {
+		return epoch, []byte{}, true
+	}
+	return epoch, wrappedKey, true
+}
+
+// addGroupMember gives the client with the given fingerprint read/write access
+// to a group and stores the current group key wrapped for them. Only the owner
+// may add members.
+//
+// Returns false if the namespace is not a group owned by the client.
+func (s *store) addGroupMember(id, name, member string, wrappedKey []byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	namespace := s.namespaces[name]
+	member = s.canonicalFingerprint(member)
+	if namespace == nil || len(namespace.groupKeys) == 0 ||
+		namespace.permissionOf(id) != permissionOwner ||
+		!validFingerprint(member) || member == namespace.owner {
+		return false
+	}
+	namespace.grants[member] = permissionReadWrite
+	namespace.groupKeys[len(namespace.groupKeys)-1][member] = wrappedKey
+	s.recordNamespace(name)
+	return true
+}
+
+// removeGroupMember removes a member's access to a group and starts a new
+// epoch. The new epoch has no keys until the owner stores a new group key
+// wrapped for each remaining member with rekeyGroup. Only the owner may remove
+// members.
+//
+// Returns the new epoch and true if successful.
+func (s *store) removeGroupMember(id, name, member string) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	namespace := s.namespaces[name]
+	member = s.canonicalFingerprint(member)
+	if namespace == nil || len(namespace.groupKeys) == 0 ||
+		namespace.permissionOf(id) != permissionOwner {
+		return 0, false
+	}
+	if _, exists := namespace.grants[member]; !exists {
+		return 0, false
+	}
+	delete(namespace.grants, member)
+	namespace.groupKeys = append(namespace.groupKeys, map[string][]byte{})
+	s.recordNamespace(name)
+	return len(namespace.groupKeys) - 1, true
+}
+
+// rekeyGroup stores a group key for the given epoch wrapped for a current
+// member of the group. Only the owner may store keys.
+//
+// Returns false if the member or epoch is unknown.
+func (s *store) rekeyGroup(
+	id, name string,
+	epoch int,
+	member string,
+	wrappedKey []byte,
+) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	namespace := s.namespaces[name]
+	member = s.canonicalFingerprint(member)
+	if namespace == nil || epoch < 0 || epoch >= len(namespace.groupKeys) ||
+		namespace.permissionOf(id) != permissionOwner {
+		return false
+	}
+	if _, isMember := namespace.grants[member]; !isMember &&
+		member != namespace.owner {
+		return false
+	}
+	namespace.groupKeys[epoch][member] = wrappedKey
+	s.recordNamespace(name)
+	return true
+}
+
+// groupCommand carries out a command managing groups:
+//   - "GROUP CREATE [name] [wrapped key]" creates a group with its first key.
+//   - "GROUP KEY [name] [epoch]" fetches the client's wrapped group key for an
+//     epoch, or for the current epoch if none is given.
+//   - "GROUP ADD [name] [fingerprint] [wrapped key]" adds a member.
+//   - "GROUP REMOVE [name] [fingerprint]" removes a member and starts a new
+//     epoch.
+//   - "GROUP REKEY [name] [epoch] [fingerprint] [wrapped key]" stores a
+//     member's wrapped key for an epoch.
+//
+// Wrapped keys are encoded as hexadecimal.
+//
+// Returns the response to send to the client.
+func (s *server) groupCommand(current *session, argument string) string {
+	arguments := strings.Fields(argument)
+	if len(arguments) < 2 {
+		s.metrics.command("GROUP", false)
+		return replyError("GROUP", categoryInvalid, "expected an action and group")
+	}
+	action, name := strings.ToUpper(arguments[0]), arguments[1]
+	arguments = arguments[2:]
+
+	ok := false
+	envelope := reply("GROUP", "")
+	switch {
+	case action == "CREATE" && len(arguments) == 1:
+		wrappedKey, err := hex.DecodeString(arguments[0])
+		ok = err == nil && s.store.createGroup(current.id, name, wrappedKey)
+	case action == "KEY" && len(arguments) <= 1:
+		epoch := -1
+		if len(arguments) == 1 {
+			parsed, err := strconv.Atoi(arguments[0])
+			if err != nil {
+				break
+			}
+			epoch = parsed
+		}
+		epoch, wrappedKey, isGroup := s.store.groupKey(current.id, name, epoch)
+		ok = true
+		switch {
+		case !isGroup:
+			envelope = replyError("GROUP", categoryNotFound, "not a group")
+		case len(wrappedKey) == 0:
+			ok = false
+		default:
+			envelope = reply("GROUP", fmt.Sprintf("KEY %d %s",
+				epoch, hex.EncodeToString(wrappedKey)))
+		}
+	case action == "ADD" && len(arguments) == 2:
+		wrappedKey, err := hex.DecodeString(arguments[1])
+		ok = err == nil && s.store.addGroupMember(
+			current.id, name, arguments[0], wrappedKey)
+	case action == "REMOVE" && len(arguments) == 1:
+		epoch := 0
+		epoch, ok = s.store.removeGroupMember(current.id, name, arguments[0])
+		envelope = reply("GROUP", fmt.Sprintf("EPOCH %d", epoch))
+	case action == "REKEY" && len(arguments) == 3:
+		epoch, err := strconv.Atoi(arguments[0])
+		wrappedKey, hexErr := hex.DecodeString(arguments[2])
+		ok = err == nil && hexErr == nil && s.store.rekeyGroup(
+			current.id, name, epoch, arguments[1], wrappedKey)
+	}
+	s.metrics.command("GROUP", ok)
+
+	if !ok {
+		current.log.info("Group command refused", "action", action,
+			"group", name)
+		return replyError("GROUP", categoryDenied, "group command refused")
+	}
+	if action != "KEY" {
+		current.log.info("Group command", "action", action, "group", name)
+	}
+	return envelope
+}
+
+// encodeGroupValue combines a group key epoch and the ciphertext encrypted with
+// that epoch's key into a group value.
+//
+// Returns the encoded value.
+func encodeGroupValue(epoch int, ciphertext []byte) []byte {
+	value := append([]byte(groupValuePrefix), make([]byte, 4)...)
+	binary.BigEndian.PutUint32(value[len(groupValuePrefix):], uint32(epoch))
+	return append(value, ciphertext...)
+}
+
+// decodeGroupValue splits a group value into its epoch and ciphertext.
+//
+// Returns the epoch, the ciphertext and true if the message is a group value.
+func decodeGroupValue(message []byte) (int, []byte, bool) {
+	headerSize := len(groupValuePrefix) + 4
+	if len(message) < headerSize ||
+		!strings.HasPrefix(string(message), groupValuePrefix) {
+		return 0, []byte{}, false
+	}
+	epoch := binary.BigEndian.Uint32(message[len(groupValuePrefix):])
+	return int(epoch), message[headerSize:], true
+}
+
+// groupKeys caches the group keys this client has unwrapped, by group name and
+// epoch.
+var groupKeys = map[string]map[int][]byte{}
+
+// fetchGroupKey finds the group key for an epoch of the named group, asking the
+// server for it if it has not been unwrapped yet. An epoch of -1 asks the
+// server for the current epoch.
+//
+// Returns the epoch, the group key, whether the namespace is a group and
+// whether the key could be found.
+func fetchGroupKey(
+	connection net.Conn,
+	name string,
+	epoch int,
+) (int, []byte, bool, bool) {
+	if key, cached := groupKeys[name][epoch]; cached {
+		return epoch, key, true, true
+	}
+
+	request := "GROUP KEY " + name
+	if epoch >= 0 {
+		request += " " + strconv.Itoa(epoch)
+	}
+	response := requestResponse(connection, request)
+	if response.category == categoryNotFound {
+		return 0, []byte{}, false, true
+	}
+	fields := strings.Fields(response.payload)
+	if !response.ok() || len(fields) != 3 || fields[0] != "KEY" {
+		return 0, []byte{}, true, false
+	}
+	epoch, err := strconv.Atoi(fields[1])
+	wrappedKey, hexErr := hex.DecodeString(fields[2])
+	if err != nil || hexErr != nil {
+		return 0, []byte{}, true, false
+	}
+	key, ok := unwrapKey(clientPrivateKey, wrappedKey)
+	if !ok {
+		return 0, []byte{}, true, false
+	}
+	if groupKeys[name] == nil {
+		groupKeys[name] = map[int][]byte{}
+	}
+	groupKeys[name][epoch] = key
+	return epoch, key, true, true
+}
+
+// groupInput carries out the client's "GROUP" commands:
+//   - "GROUP CREATE [name]" generates a group key and creates the group.
+//   - "GROUP ADD [name] [fingerprint]" wraps every epoch's group key for the
+//     new member, so they can also read values written before they joined.
+//   - "GROUP REMOVE [name] [fingerprint]" removes the member, then generates a
+//     new group key and wraps it for each remaining member.
+func groupInput(connection net.Conn, arguments []string) {
+	if len(arguments) < 2 {
+		fmt.Println("Usage: GROUP [CREATE|ADD|REMOVE] [name] [fingerprint]")
+		return
+	}
+	action, name := strings.ToUpper(arguments[0]), arguments[1]
+	switch {
+	case action == "CREATE" && len(arguments) == 2:
+		key := GenerateAESKey()
+		wrappedKey, ok := wrapKey(clientPublicKey, key)
+		if !ok {
+			fmt.Println("GROUP: ERROR failed to wrap group key")
+			return
+		}
+		fmt.Println(requestResponse(connection,
+			"GROUP CREATE "+name+" "+hex.EncodeToString(wrappedKey)))
+	case action == "ADD" && len(arguments) == 3:
+		addGroupMember(connection, name, strings.ToLower(arguments[2]))
+	case action == "REMOVE" && len(arguments) == 3:
+		removeGroupMember(connection, name, strings.ToLower(arguments[2]))
+	default:
+		fmt.Println("Usage: GROUP [CREATE|ADD|REMOVE] [name] [fingerprint]")
+	}
+}
+
+// addGroupMember adds the client with the given fingerprint to a group and
+// wraps the group key of every epoch for them.
+func addGroupMember(connection net.Conn, name, member string) {
+	memberKey, ok := lookupPublicKey(connection, member)
+	if !ok {
+		fmt.Println("GROUP: ERROR unknown member")
+		return
+	}
+	current, key, isGroup, ok := fetchGroupKey(connection, name, -1)
+	if !isGroup || !ok {
+		fmt.Println("GROUP: ERROR no group key available")
+		return
+	}
+	wrappedKey, ok := wrapKey(memberKey, key)
+	if !ok {
+		fmt.Println("GROUP: ERROR failed to wrap group key")
+		return
+	}
+	response := requestResponse(connection,
+		"GROUP ADD "+name+" "+member+" "+hex.EncodeToString(wrappedKey))
+	if !response.ok() {
+		fmt.Println(response)
+		return
+	}
+
+	for epoch := 0; epoch < current; epoch++ {
+		_, key, _, ok := fetchGroupKey(connection, name, epoch)
+		if !ok {
+			continue
+		}
+		wrappedKey, ok := wrapKey(memberKey, key)
+		if !ok {
+			continue
+		}
+		requestResponse(connection, fmt.Sprintf("GROUP REKEY %s %d %s %s",
+			name, epoch, member, hex.EncodeToString(wrappedKey)))
+	}
+	fmt.Println(response)
+}
+
+// removeGroupMember removes the client with the given fingerprint from a
+// group and rekeys the group, wrapping a new group key for each remaining
+// member.
+func removeGroupMember(connection net.Conn, name, member string) {
+	response := requestResponse(connection, "GROUP REMOVE "+name+" "+member)
+	if !response.ok() {
+		fmt.Println(response)
+		return
+	}
+	epoch, err := strconv.Atoi(strings.TrimPrefix(response.payload, "EPOCH "))
+	if err != nil {
+		fmt.Println("GROUP: ERROR invalid epoch")
+		return
+	}
+
+	key := GenerateAESKey()
+	access := requestResponse(connection, "ACCESS "+name)
+	rekeyed := 0
+	for _, line := range strings.Split(access.payload, "\n") {
+		if !access.ok() || strings.TrimSpace(line) == "" {
+			continue
+		}
+		remaining := strings.Fields(line)[0]
+		remainingKey, ok := lookupPublicKey(connection, remaining)
+		if !ok {
+			fmt.Println("GROUP: ERROR unknown member " + remaining)
+			continue
+		}
+		wrappedKey, ok := wrapKey(remainingKey, key)
+		if !ok {
+			continue
+		}
+		rekey := requestResponse(connection,
+			fmt.Sprintf("GROUP REKEY %s %d %s %s",
+				name, epoch, remaining, hex.EncodeToString(wrappedKey)))
+		if rekey.ok() {
+			rekeyed++
+		}
+	}
+	fmt.Printf("GROUP: OK rekeyed epoch %d for %d members\n", epoch, rekeyed)
+}
+
+// lookupPublicKey fetches the public key of the client with the given
+// fingerprint from the server. The key is checked against the fingerprint, so
+// the server cannot substitute a key of its own.
+//
+// Returns the public key and true if successful.
+func lookupPublicKey(
+	connection net.Conn,
+	keyFingerprint string,
+) (crypto.PublicKey, bool) {
+	response := requestResponse(connection, "PUBKEY "+keyFingerprint)
+	if !response.ok() {
+		return nil, false
+	}
+	publicKey, ok := StringToPublicKey(response.payload)
+	if !ok || KeyFingerprint(publicKey) != strings.ToLower(keyFingerprint) {
+		return nil, false
+	}
+	return publicKey, true
+}
+
+// prepareSharedPut looks up the current group key before a PUT to a key in a
+// shared namespace, as the server expects the value to follow the PUT
+// directly. Keys in other namespaces need no preparation.
+//
+// Returns the group key's epoch and the group key, which is nil if the
+// namespace is not a group, and false if the namespace is a group but its key
+// is unavailable.
+func prepareSharedPut(connection net.Conn, key string) (int, []byte, bool) {
+	name, _, shared := splitSharedKey(key)
+	if !shared {
+		return 0, nil, true
+	}
+	epoch, groupKey, isGroup, ok := fetchGroupKey(connection, name, -1)
+	if !isGroup || !ok {
+		return 0, nil, ok
+	}
+	return epoch, groupKey, true
+}
+
+// encryptSharedValue encrypts a value to be stored in a shared namespace. In a
+// group the key found by prepareSharedPut is used, otherwise the value is
+// sealed with its own data key.
+//
+// Returns the encrypted value and true if successful.
+func encryptSharedValue(
+	plaintext string,
+	groupEpoch int,
+	groupKey []byte,
+) ([]byte, bool) {
+	if groupKey == nil {
+		return sealValue(clientPublicKey, plaintext)
+	}
+	ciphertext, ok := EncryptValue(valueCipherSuite, groupKey, plaintext)
+	if !ok {
+		return []byte{}, false
+	}
+	return encodeGroupValue(groupEpoch, ciphertext), true
+}
+
+// getSharedValue fetches a value from a shared namespace and decrypts it with
+// either its wrapped data key or the group key of the epoch it was written in.
+func getSharedValue(connection net.Conn, key string) {
+	name, _, _ := splitSharedKey(key)
+	response := requestResponse(connection, "GET "+key)
+	if !response.ok() {
+		fmt.Println(response)
+		return
+	}
+
+	value := []byte(response.payload)
+	plaintext, ok := []byte{}, false
+	if epoch, ciphertext, isGroupValue := decodeGroupValue(value); isGroupValue {
+		_, groupKey, _, found := fetchGroupKey(connection, name, epoch)
+		if found {
+			plaintext, ok = DecryptValue(groupKey, ciphertext)
+		}
+	} else {
+		plaintext, ok = unsealValue(clientPrivateKey, value)
+	}
+	if !ok {
+		fmt.Println("GET: ERROR value cannot be decrypted by this client")
+		return
+	}
+	fmt.Println(string(plaintext))
+}
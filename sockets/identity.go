@@ -0,0 +1,509 @@
+package sockets
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A party's identity key may be an RSA key of 2048, 3072 or 4096 bits, an
+// ECDSA key on P-256 or an Ed25519 key. Public keys are written as the name
+// of their type, a colon and their PKIX encoding in unpadded URL-safe base64,
+// e.g. "ed25519:MCowBQYDK2VwAyEA...", so that keys of any type can be read
+// back. Servers before protocol version 4 only read RSA keys written as
+// "[modulus]-[exponent]", which are still read.
+//
+// Signatures use RSASSA-PSS with SHA256, ECDSA with SHA256 or Ed25519. An
+// ECDSA signature is only valid with the lower of its two values of s, so that
+// a signature cannot be altered into another valid one and replayed. Keys
+// wrapped for an RSA key are encrypted with EncryptRSA. Keys wrapped for an
+// elliptic curve key are encrypted with AES using a key derived with HKDF
+// from an X25519 or P-256 exchange between a new key and the recipient's,
+// whose public key starts the wrapped key. Ed25519 keys are used for X25519 by
+// mapping them to the Montgomery form of their curve.
+
+// Algorithms of identity keys.
+const (
+	keyRSA2048   = "rsa-2048"
+	keyRSA3072   = "rsa-3072"
+	keyRSA4096   = "rsa-4096"
+	keyECDSAP256 = "ecdsa-p256"
+	keyEd25519   = "ed25519"
+)
+
+// rsaKeySizes are the sizes in bits of RSA identity keys. Keys of other sizes
+// are refused, as smaller keys are weak and larger ones are slow to verify.
+var rsaKeySizes = map[int]bool{2048: true, 3072: true, 4096: true}
+
+// defaultKeyAlgorithm is the algorithm of identity keys unless a config names
+// another.
+const defaultKeyAlgorithm = keyRSA2048
+
+// Names of key types in their string form.
+const (
+	keyTypeRSA     = "rsa"
+	keyTypeECDSA   = "ecdsa"
+	keyTypeEd25519 = "ed25519"
+)
+
+// wrappedKeyLabel derives the keys that encrypt keys wrapped for elliptic
+// curve keys.
+const wrappedKeyLabel = "wrapped key"
+
+// GenerateIdentityKey generates an identity key with the given algorithm, or
+// the default algorithm if none is given.
+//
+// Returns the private key and true if the algorithm is known.
+func GenerateIdentityKey(algorithm string) (crypto.Signer, bool) {
+	var privateKey crypto.Signer
+	var err error
+	switch algorithm {
+	case "", keyRSA2048:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case keyRSA3072:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 3072)
+	case keyRSA4096:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	case keyECDSAP256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		defaultLogger.error("Unknown key algorithm", "algorithm", algorithm)
+		return nil, false
+	}
+	if err != nil {
+		defaultLogger.error("Error generating key", "algorithm", algorithm,
+			"error", err)
+		return nil, false
+	}
+	return privateKey, true
+}
+
+// LoadIdentityKey reads an identity key of any type from a PEM file, which may
+// also hold an RSA key written by LoadRSAKeys. If the file does not exist, a
+// key with the given algorithm is generated and saved to it.
+//
+// Returns the private key and true if successful.
+func LoadIdentityKey(path, algorithm string) (crypto.Signer, bool) {
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		privateKey, ok := GenerateIdentityKey(algorithm)
+		if !ok {
+			return nil, false
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err == nil {
+			block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+			err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+		}
+		if err != nil {
+			defaultLogger.error("Error saving key", "path", path, "error", err)
+			return nil, false
+		}
+		return privateKey, true
+	}
+	if err != nil {
+		defaultLogger.error("Error reading key", "path", path, "error", err)
+		return nil, false
+	}
+
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		defaultLogger.error("File does not contain a key", "path", path)
+		return nil, false
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil || keyType(&privateKey.PublicKey) == "" {
+			defaultLogger.error("Error parsing RSA key", "path", path,
+				"error", err)
+			return nil, false
+		}
+		return privateKey, true
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		privateKey, ok := parsed.(crypto.Signer)
+		if err != nil || !ok || keyType(privateKey.Public()) == "" {
+			defaultLogger.error("Error parsing key", "path", path, "error", err)
+			return nil, false
+		}
+		return privateKey, true
+	}
+	defaultLogger.error("File does not contain a key", "path", path,
+		"type", block.Type)
+	return nil, false
+}
+
+// keyType names the type of a public key in its string form. RSA keys must
+// have one of rsaKeySizes and ECDSA keys must be on P-256.
+//
+// Returns the name, or "" if the type or size is not supported.
+func keyType(publicKey crypto.PublicKey) string {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if rsaKeySizes[key.N.BitLen()] {
+			return keyTypeRSA
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return keyTypeECDSA
+		}
+	case ed25519.PublicKey:
+		return keyTypeEd25519
+	}
+	return ""
+}
+
+// PublicKeyToString converts a public key of any supported type to its string
+// form, "[type]:[PKIX encoding]".
+//
+// Returns the string, or "" if the key is not supported.
+func PublicKeyToString(publicKey crypto.PublicKey) string {
+	name := keyType(publicKey)
+	encoded, err := x509.MarshalPKIXPublicKey(publicKey)
+	if name == "" || err != nil {
+		return ""
+	}
+	return name + ":" + base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// StringToPublicKey converts a public key's string form, as produced by
+// PublicKeyToString or legacyRSAKeyString, into the key.
+//
+// Returns the key and true if successful.
+func StringToPublicKey(publicKey string) (crypto.PublicKey, bool) {
+	name, encoded, found := strings.Cut(publicKey, ":")
+	if !found {
+		return parseLegacyRSAKey(publicKey)
+	}
+	der, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		defaultLogger.warn("Failed to decode public key", "error", err)
+		return nil, false
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil || keyType(parsed) != name {
+		defaultLogger.warn("Failed to parse public key", "type", name)
+		return nil, false
+	}
+	return parsed, true
+}
+
+// legacyRSAKeyString converts an RSA public key to the form read by servers
+// before protocol version 4, "[modulus]-[exponent]".
+//
+// Returns the string, or "" if the key is not an RSA key.
+func legacyRSAKeyString(publicKey crypto.PublicKey) string {
+	key, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return ""
+	}
+	return key.N.String() + "-" + strconv.Itoa(key.E)
+}
+
+// parseLegacyRSAKey converts an RSA public key's legacy string form into the
+// key.
+//
+// Returns the key and true if successful.
+func parseLegacyRSAKey(publicKey string) (crypto.PublicKey, bool) {
+	modulus, exponent, found := strings.Cut(publicKey, "-")
+	if !found {
+		defaultLogger.warn("Public key has no type")
+		return nil, false
+	}
+	bi := big.NewInt(0)
+	_, ok := bi.SetString(modulus, 10)
+	if !ok {
+		defaultLogger.warn("Failed to convert public key to big int")
+		return nil, false
+	}
+	e, err := strconv.Atoi(exponent)
+	if err != nil {
+		defaultLogger.warn("Failed to convert exponent to int")
+		return nil, false
+	}
+	key := &rsa.PublicKey{N: bi, E: e}
+	if keyType(key) == "" {
+		defaultLogger.warn("Unsupported RSA key size", "bits", bi.BitLen())
+		return nil, false
+	}
+	return key, true
+}
+
+// idFingerprints lists the fingerprints identifying the key a client ID
+// holds: that of the ID and, for RSA keys, that of the legacy form printed
+// by clients and servers before protocol version 4. IDs that are not RSA keys
+// in their current form, such as those of Redis and memcached clients, only
+// have the one.
+//
+// Returns the fingerprints.
+func idFingerprints(id string) []string {
+	fingerprints := []string{fingerprint(id)}
+	if !strings.HasPrefix(id, keyTypeRSA+":") {
+		return fingerprints
+	}
+	publicKey, ok := StringToPublicKey(id)
+	if legacy := legacyRSAKeyString(publicKey); ok && legacy != "" &&
+		legacy != id {
+		fingerprints = append(fingerprints, fingerprint(legacy))
+	}
+	return fingerprints
+}
+
+// KeyFingerprint identifies a public key of any supported type by the SHA256
+// hash of its string form.
+//
+// Returns the hash as a hexadecimal string.
+func KeyFingerprint(publicKey crypto.PublicKey) string {
+	return fingerprint(PublicKeyToString(publicKey))
+}
+
+// ecdsaSignature is the ASN.1 form of an ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// SignIdentity signs the given plaintext with an identity key of any supported
+// type, using SignRSA for RSA keys.
+//
+// Returns a signature byte array, or nil if the key is not supported.
+func SignIdentity(privateKey crypto.Signer, plainText string) []byte {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return SignRSA(key, plainText)
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256([]byte(plainText))
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			panic(err)
+		}
+		// Of the two valid values of s, the lower is used, as VerifyIdentity
+		// refuses the higher.
+		order := key.Curve.Params().N
+		if s.Cmp(new(big.Int).Rsh(order, 1)) > 0 {
+			s.Sub(order, s)
+		}
+		signature, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+		if err != nil {
+			panic(err)
+		}
+		return signature
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, []byte(plainText))
+	}
+	return nil
+}
+
+// VerifyIdentity verifies a signature made by SignIdentity with the given
+// public key, using VerifyRSA for RSA keys.
+//
+// Returns true if the signature is valid.
+func VerifyIdentity(
+	publicKey crypto.PublicKey,
+	plainText string,
+	signature []byte,
+) bool {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return VerifyRSA(*key, plainText, signature)
+	case *ecdsa.PublicKey:
+		parsed := ecdsaSignature{}
+		rest, err := asn1.Unmarshal(signature, &parsed)
+		if err != nil || len(rest) > 0 || parsed.S.Cmp(
+			new(big.Int).Rsh(key.Curve.Params().N, 1)) > 0 {
+			return false
+		}
+		hash := sha256.Sum256([]byte(plainText))
+		return ecdsa.VerifyASN1(key, hash[:], signature)
+	case ed25519.PublicKey:
+		return len(key) == ed25519.PublicKeySize &&
+			ed25519.Verify(key, []byte(plainText), signature)
+	}
+	return false
+}
+
+// wrapKey encrypts a key so that only the holder of the given public key's
+// private key can read it.
+//
+// Returns the wrapped key and true if successful.
+func wrapKey(publicKey crypto.PublicKey, key []byte) ([]byte, bool) {
+	if recipient, ok := publicKey.(*rsa.PublicKey); ok {
+		return EncryptRSA(*recipient, string(key))
+	}
+	recipient, ok := exchangePublicKey(publicKey)
+	if !ok {
+		return []byte{}, false
+	}
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return []byte{}, false
+	}
+	secret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return []byte{}, false
+	}
+	share := ephemeral.PublicKey().Bytes()
+	wrappingKey := hkdf(secret, append(append([]byte{}, share...),
+		recipient.Bytes()...), wrappedKeyLabel, 32)
+	ciphertext, ok := EncryptAES(wrappingKey, string(key))
+	if !ok {
+		return []byte{}, false
+	}
+	return append(share, ciphertext...), true
+}
+
+// unwrapKey decrypts a key wrapped by wrapKey for the given private key's
+// public key.
+//
+// Returns the key and true if successful.
+func unwrapKey(privateKey crypto.Signer, wrappedKey []byte) ([]byte, bool) {
+	if key, ok := privateKey.(*rsa.PrivateKey); ok {
+		return DecryptRSA(key, wrappedKey)
+	}
+	recipient, ok := exchangePrivateKey(privateKey)
+	if !ok {
+		return []byte{}, false
+	}
+	shareSize := len(recipient.PublicKey().Bytes())
+	if len(wrappedKey) < shareSize {
+		return []byte{}, false
+	}
+	share, err := recipient.Curve().NewPublicKey(wrappedKey[:shareSize])
+	if err != nil {
+		return []byte{}, false
+	}
+	secret, err := recipient.ECDH(share)
+	if err != nil {
+		return []byte{}, false
+	}
+	wrappingKey := hkdf(secret, append(append([]byte{}, share.Bytes()...),
+		recipient.PublicKey().Bytes()...), wrappedKeyLabel, 32)
+	return DecryptAES(wrappingKey, wrappedKey[shareSize:])
+}
+
+// exchangePublicKey converts an elliptic curve identity key to the key used
+// for key exchange. An Ed25519 key's point is mapped from the Edwards curve to
+// the Montgomery curve used by X25519, u = (1 + y) / (1 - y).
+//
+// Returns the key and true if the key supports key exchange.
+func exchangePublicKey(publicKey crypto.PublicKey) (*ecdh.PublicKey, bool) {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		exchangeKey, err := key.ECDH()
+		return exchangeKey, err == nil
+	case ed25519.PublicKey:
+		if len(key) != ed25519.PublicKeySize {
+			return nil, false
+		}
+		p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255),
+			big.NewInt(19))
+		y := new(big.Int).SetBytes(reverseBytes(key))
+		y.SetBit(y, 255, 0)
+		denominator := new(big.Int).Sub(big.NewInt(1), y)
+		if denominator.Mod(denominator, p).Sign() == 0 {
+			return nil, false
+		}
+		u := new(big.Int).Add(big.NewInt(1), y)
+		u.Mul(u, denominator.ModInverse(denominator, p)).Mod(u, p)
+		exchangeKey, err := ecdh.X25519().NewPublicKey(
+			reverseBytes(u.FillBytes(make([]byte, 32))))
+		return exchangeKey, err == nil
+	}
+	return nil, false
+}
+
+// exchangePrivateKey converts an elliptic curve identity key to the key used
+// for key exchange. An Ed25519 key's X25519 scalar is the first half of the
+// SHA512 hash of its seed, as when signing.
+//
+// Returns the key and true if the key supports key exchange.
+func exchangePrivateKey(privateKey crypto.Signer) (*ecdh.PrivateKey, bool) {
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		exchangeKey, err := key.ECDH()
+		return exchangeKey, err == nil
+	case ed25519.PrivateKey:
+		hash := sha512.Sum512(key.Seed())
+		exchangeKey, err := ecdh.X25519().NewPrivateKey(hash[:32])
+		return exchangeKey, err == nil
+	}
+	return nil, false
+}
+
+// reverseBytes converts between little and big endian integers.
+//
+// Returns a reversed copy of the bytes.
+func reverseBytes(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	for i := range b {
+		reversed[len(b)-1-i] = b[i]
+	}
+	return reversed
+}
+
+// TestIdentityKeys generates an identity key of each algorithm, and shows the
+// length of its string form, a signature made with it and a key wrapped for
+// it. A client with each key then connects to a server and creates a
+// namespace.
+func TestIdentityKeys() {
+	configureLogging(LogConfig{Level: "error"})
+	_, address := startTestServer(ServerConfig{KeyPoolSize: 2, KeyPoolWorkers: 1})
+	for _, algorithm := range []string{keyRSA2048, keyRSA3072, keyECDSAP256,
+		keyEd25519} {
+		privateKey, ok := GenerateIdentityKey(algorithm)
+		if !ok {
+			return
+		}
+		publicKey := privateKey.Public()
+		encoded := PublicKeyToString(publicKey)
+		decoded, ok := StringToPublicKey(encoded)
+		fmt.Printf("%s: key is %d characters, e.g. %s..., read back: %t\n",
+			algorithm, len(encoded), encoded[:24],
+			ok && PublicKeyToString(decoded) == encoded)
+
+		signature := SignIdentity(privateKey, "hello")
+		fmt.Printf("  signature is %d bytes, verifies: %t, verifies other text: %t\n",
+			len(signature), VerifyIdentity(decoded, "hello", signature),
+			VerifyIdentity(decoded, "goodbye", signature))
+
+		dataKey := GenerateAESKey()
+		wrappedKey, ok := wrapKey(decoded, dataKey)
+		unwrappedKey, unwrapped := unwrapKey(privateKey, wrappedKey)
+		fmt.Printf("  wrapped data key is %d bytes, unwraps: %t\n",
+			len(wrappedKey), ok && unwrapped &&
+				string(unwrappedKey) == string(dataKey))
+
+		clientPrivateKey, clientPublicKey = privateKey, publicKey
+		connection, reply, keys, ok := connectServer(address)
+		if !ok || keys == nil {
+			fmt.Println("  error connecting:", reply)
+			continue
+		}
+		sessionKey, agreed, _ := parseConnectReply(reply)
+		serverKey, _ := StringToRSAKey(sessionKey)
+		outgoing, incoming := newSequence(serverKey), newSequence(serverKey)
+		request := "CREATE team-" + algorithm
+		fmt.Printf("  connects with %s, %s -> %s\n", agreed.String(), request,
+			strings.TrimSpace(keyExchangeRequest(connection, agreed, keys,
+				outgoing, incoming, request)))
+		connection.Close()
+	}
+}
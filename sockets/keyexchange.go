@@ -0,0 +1,429 @@
+package sockets
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Once the "ecdh" capability is agreed, messages after CONNECT are encrypted
+// with AES keys that only last for the session, rather than with the parties'
+// RSA keys, so that recorded sessions cannot be decrypted if a key leaks
+// later. It also lets clients whose identity keys are not RSA keys connect:
+//   - The client adds "KEYSHARE [public key]" to its offer, holding a new X25519
+//     public key, and ends it with "SIGNATURE [signature]", signing the whole
+//     message before the signature with its own identity key.
+//   - The server checks the signature against the client's ID and replies
+//     "CONNECT: ERROR SIGNATURE" if it is not valid. Otherwise it adds
+//     "KEYSHARE [public key] IDENTITY [key]" to its reply, holding its own new
+//     X25519 public key and its identity key, and ends it with "SIGNATURE
+//     [signature]", signing the client's message and its reply with that
+//     identity.
+//
+// Keys and signatures are hexadecimal. Both sides derive two AES-256 keys from
+// the shared X25519 secret with HKDF-SHA256, salted with the hash of both
+// messages, one for each direction. The X25519 keys are discarded once the
+// session keys are derived. Values following PUT are sent as they are, as
+// they are already encrypted with the client's data key.
+//
+// The client authenticates the server by its identity key. If the client was
+// given the fingerprint of the server's identity, every reply must be signed
+// with that identity. Otherwise the client trusts the identity a server first
+// proves, and requires the same identity on every later connection to that
+// address while it runs, such as when it reconnects, so servers should keep
+// their identity in a file. The first connection is then only as trustworthy
+// as the network, so the fingerprint should be given wherever the server's
+// identity is known. A reply that does not agree "ecdh" proves no identity,
+// so it is refused if the fingerprint was given or the server proved an
+// identity before. Otherwise the client carries on with the session key of
+// earlier versions, warning that the server is not authenticated.
+
+// capabilityKeyExchange is the capability agreeing an X25519 key exchange.
+const capabilityKeyExchange = "ecdh"
+
+// keyExchangeCurve is the curve of the parties' ephemeral keys.
+var keyExchangeCurve = ecdh.X25519()
+
+var knownServers = map[string]string{} // Identities trusted, by address.
+var knownServersMutex sync.Mutex
+
+// Labels deriving a key for each direction.
+const (
+	clientKeyLabel = "client to server"
+	serverKeyLabel = "server to client"
+)
+
+// sessionKeys are the AES keys protecting a session's messages.
+type sessionKeys struct {
+	send    []byte // Encrypts the messages this side sends.
+	receive []byte // Decrypts the messages this side receives.
+}
+
+// signMessage ends a CONNECT message or reply with the signature of the given
+// text, which is the message itself unless the signature covers more.
+//
+// Returns the signed message.
+func signMessage(privateKey crypto.Signer, message, text string) string {
+	return message + " SIGNATURE " +
+		hex.EncodeToString(SignIdentity(privateKey, text))
+}
+
+// cutSignature splits the signature from the end of a CONNECT message or
+// reply.
+//
+// Returns the message before the signature, the signature and true if the
+// message is signed.
+func cutSignature(message string) (string, []byte, bool) {
+	before, encoded, found := strings.Cut(message, " SIGNATURE ")
+	if !found {
+		return message, nil, false
+	}
+	signature, err := hex.DecodeString(encoded)
+	if err != nil {
+		return message, nil, false
+	}
+	return before, signature, true
+}
+
+// messageField finds the value following a name in a CONNECT message or
+// reply, where names and values alternate after the key.
+//
+// Returns the value, or "" if the name is absent.
+func messageField(message, name string) string {
+	fields := strings.Fields(message)
+	for i := 2; i+1 < len(fields); i += 2 {
+		if fields[i] == name {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// offerKeyShare adds a new X25519 public key to a client's offer.
+//
+// Returns the offer, the matching private key and true if successful.
+func offerKeyShare(offer connectOffer) (connectOffer, *ecdh.PrivateKey, bool) {
+	ephemeral, err := keyExchangeCurve.GenerateKey(rand.Reader)
+	if err != nil {
+		clientLog.error("Error generating key share", "error", err)
+		return offer, nil, false
+	}
+	offer.keyShare = ephemeral.PublicKey().Bytes()
+	return offer, ephemeral, true
+}
+
+// offerSigned checks that a client's CONNECT message is signed with the key
+// its offer names as the client's ID.
+func offerSigned(message string, offer connectOffer) bool {
+	signed, signature, found := cutSignature(message)
+	clientKey, ok := StringToPublicKey(offer.id)
+	return found && ok && VerifyIdentity(clientKey, signed, signature)
+}
+
+// acceptKeyShare completes the key exchange a client's signed CONNECT message
+// offers, adding the server's key share and identity to the given reply and
+// signing it.
+//
+// Returns the signed reply, the session's keys and true if successful.
+func (s *server) acceptKeyShare(
+	current *session,
+	message string,
+	offer connectOffer,
+	reply string,
+) (string, *sessionKeys, bool) {
+	clientShare, err := keyExchangeCurve.NewPublicKey(offer.keyShare)
+	if err != nil {
+		current.log.warn("Invalid key share", "error", err)
+		return "", nil, false
+	}
+	ephemeral, err := keyExchangeCurve.GenerateKey(rand.Reader)
+	if err != nil {
+		current.log.error("Error generating key share", "error", err)
+		return "", nil, false
+	}
+	secret, err := ephemeral.ECDH(clientShare)
+	if err != nil {
+		current.log.warn("Error completing key exchange", "error", err)
+		return "", nil, false
+	}
+
+	reply += " KEYSHARE " + hex.EncodeToString(ephemeral.PublicKey().Bytes()) +
+		" IDENTITY " + current.protocol.keyString(s.identity.Public())
+	reply = signMessage(s.identity, reply, message+"\n"+reply)
+	return reply, deriveSessionKeys(secret, message, reply, false), true
+}
+
+// completeKeyExchange checks the signature on the reply of the server at
+// address to a client's CONNECT message, and that the server's identity is
+// trusted, then completes the key exchange.
+//
+// Returns the session's keys and true if the server's reply is valid.
+func completeKeyExchange(
+	ephemeral *ecdh.PrivateKey,
+	message string,
+	reply string,
+	address string,
+) (*sessionKeys, bool) {
+	signed, signature, found := cutSignature(reply)
+	serverKey, ok := StringToPublicKey(messageField(signed, "IDENTITY"))
+	if !found || !ok ||
+		!VerifyIdentity(serverKey, message+"\n"+signed, signature) {
+		clientLog.error("Invalid signature on key exchange")
+		return nil, false
+	}
+	if !trustServerIdentity(address, KeyFingerprint(serverKey)) {
+		return nil, false
+	}
+	encoded, err := hex.DecodeString(messageField(signed, "KEYSHARE"))
+	if err != nil {
+		clientLog.error("Invalid key share", "error", err)
+		return nil, false
+	}
+	serverShare, err := keyExchangeCurve.NewPublicKey(encoded)
+	if err != nil {
+		clientLog.error("Invalid key share", "error", err)
+		return nil, false
+	}
+	secret, err := ephemeral.ECDH(serverShare)
+	if err != nil {
+		clientLog.error("Error completing key exchange", "error", err)
+		return nil, false
+	}
+	return deriveSessionKeys(secret, message, reply, true), true
+}
+
+// trustServerIdentity checks the identity the server at address proved. It
+// must match serverFingerprint if one was given, or otherwise the identity the
+// server first proved, which is trusted on first use.
+//
+// Returns true if the identity is trusted.
+func trustServerIdentity(address, identity string) bool {
+	knownServersMutex.Lock()
+	defer knownServersMutex.Unlock()
+	expected := serverFingerprint
+	if expected == "" {
+		expected = knownServers[address]
+	}
+	if expected == "" {
+		clientLog.info("Trusting server identity on first use",
+			"server", address, "fingerprint", identity)
+		knownServers[address] = identity
+		return true
+	}
+	if identity != expected {
+		clientLog.error("Server identity is not the expected one",
+			"identity", identity, "expected", expected)
+		return false
+	}
+	clientLog.debug("Server identity", "fingerprint", identity)
+	return true
+}
+
+// allowUnauthenticatedServer checks whether the client may carry on with the
+// server at address without a key exchange, in which the server proves no
+// identity. It may not if the server's fingerprint was given or the server
+// proved an identity before, as anyone could then impersonate the server by
+// leaving the key exchange out of its reply.
+//
+// Returns true if the server has no identity to prove.
+func allowUnauthenticatedServer(address string) bool {
+	knownServersMutex.Lock()
+	defer knownServersMutex.Unlock()
+	expected := serverFingerprint
+	if expected == "" {
+		expected = knownServers[address]
+	}
+	if expected != "" {
+		clientLog.error("Server did not prove its identity",
+			"server", address, "expected", expected)
+		return false
+	}
+	clientLog.warn("Server does not prove its identity, so it is not authenticated",
+		"server", address)
+	return true
+}
+
+// deriveSessionKeys derives the keys of one side of a session from the shared
+// secret and the CONNECT message and reply that agreed it.
+//
+// Returns the keys.
+func deriveSessionKeys(secret []byte, message, reply string, client bool) *sessionKeys {
+	transcript := sha256.Sum256([]byte(message + "\n" + reply))
+	clientKey := hkdf(secret, transcript[:], clientKeyLabel, 32)
+	serverKey := hkdf(secret, transcript[:], serverKeyLabel, 32)
+	if client {
+		return &sessionKeys{send: clientKey, receive: serverKey}
+	}
+	return &sessionKeys{send: serverKey, receive: clientKey}
+}
+
+// hkdf derives a key of the given length from a secret with HKDF-SHA256, as
+// described by RFC 5869.
+//
+// Returns the key.
+func hkdf(secret, salt []byte, info string, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	pseudorandomKey := extract.Sum(nil)
+
+	key := []byte{}
+	block := []byte{}
+	for counter := byte(1); len(key) < length; counter++ {
+		expand := hmac.New(sha256.New, pseudorandomKey)
+		expand.Write(block)
+		expand.Write([]byte(info))
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		key = append(key, block...)
+	}
+	return key[:length]
+}
+
+// TestKeyExchange connects to a server agreeing a key exchange, sends requests
+// protected by the session keys, and shows the server refusing an offer signed
+// by another key and the client refusing a server with the wrong identity,
+// whether it was given or trusted on first use, or proving no identity where
+// one is expected.
+func TestKeyExchange() {
+	configureLogging(LogConfig{Level: "error"})
+	s, address := startTestServer(ServerConfig{KeyPoolSize: 2, KeyPoolWorkers: 1})
+	clientPrivateKey, _ = GenerateIdentityKey(keyEd25519)
+	clientPublicKey = clientPrivateKey.Public()
+	fmt.Println("Server identity:", KeyFingerprint(s.identity.Public()))
+
+	connection, reply, keys, ok := connectServer(address)
+	if !ok || keys == nil {
+		fmt.Println("Error agreeing session keys")
+		return
+	}
+	sessionKey, agreed, _ := parseConnectReply(reply)
+	fmt.Println("Agreed protocol:", agreed.String())
+	var outgoing, incoming *sequence
+	if agreed.has(capabilitySequencing) {
+		serverKey, _ := StringToRSAKey(sessionKey)
+		outgoing, incoming = newSequence(serverKey), newSequence(serverKey)
+	}
+	for _, request := range []string{"CREATE team", "ACCESS team"} {
+		fmt.Printf("%s -> %s\n", request, keyExchangeRequest(
+			connection, agreed, keys, outgoing, incoming, request))
+	}
+	connection.Close()
+
+	// An offer whose signature does not match the client's ID is refused.
+	otherKey, _ := GenerateIdentityKey(keyEd25519)
+	connection, err := dialTransport(address, nil)
+	if err != nil {
+		fmt.Println("Error connecting:", err.Error())
+		return
+	}
+	offer, _, _ := offerKeyShare(connectOffer{id: PublicKeyToString(clientPublicKey),
+		versions: supportedVersions, capabilities: []string{capabilityKeyExchange}})
+	message := "CONNECT " + offer.String()
+	connection.Write([]byte(signMessage(otherKey, message, message)))
+	buffer := make([]byte, messageBufferSize)
+	mLen, _ := connection.Read(buffer)
+	fmt.Println("Offer signed by another key ->", string(buffer[:mLen]))
+	connection.Close()
+
+	// A client expecting another server identity refuses the reply.
+	serverFingerprint = KeyFingerprint(clientPublicKey)
+	_, _, _, ok = connectServer(address)
+	fmt.Println("Client expecting another server identity connects:", ok)
+	serverFingerprint = ""
+
+	// A client that trusted another identity at this address refuses it too.
+	clientPrivateKey, _ = GenerateIdentityKey(keyEd25519)
+	clientPublicKey = clientPrivateKey.Public()
+	knownServersMutex.Lock()
+	trusted := knownServers[address]
+	knownServers[address] = KeyFingerprint(clientPublicKey)
+	knownServersMutex.Unlock()
+	fmt.Println("Trusted server identity on first use:",
+		trusted == KeyFingerprint(s.identity.Public()))
+	_, _, _, ok = connectServer(address)
+	fmt.Println("Client that trusted another server identity connects:", ok)
+
+	// A server that leaves out the key exchange proves no identity, so it is
+	// only used where no identity is expected.
+	listener, err := net.Listen(serverType, serverHost+":0")
+	if err != nil {
+		fmt.Println("Error listening:", err.Error())
+		return
+	}
+	defer listener.Close()
+	go func() {
+		_, sessionKey := GenerateRSAKeys()
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connection.Read(make([]byte, messageBufferSize))
+			connection.Write([]byte(connectReply(
+				connectOffer{versions: supportedVersions},
+				RSAKeyToString(sessionKey), protocol{version: protocolV4})))
+			connection.Close()
+		}
+	}()
+	unauthenticated := listener.Addr().String()
+	_, _, _, ok = connectServer(unauthenticated)
+	fmt.Println("Client connects to a server proving no identity:", ok)
+	serverFingerprint = KeyFingerprint(s.identity.Public())
+	_, _, _, ok = connectServer(unauthenticated)
+	fmt.Println("Client expecting an identity connects to it:", ok)
+	serverFingerprint = ""
+	knownServersMutex.Lock()
+	knownServers[unauthenticated] = KeyFingerprint(s.identity.Public())
+	knownServersMutex.Unlock()
+	_, _, _, ok = connectServer(unauthenticated)
+	fmt.Println("Client that trusted an identity there connects to it:", ok)
+}
+
+// keyExchangeRequest sends a command protected by session keys for a
+// demonstration, numbered by the given sequences if sequencing was agreed.
+//
+// Returns the response, or a description of the error.
+func keyExchangeRequest(
+	connection net.Conn,
+	agreed protocol,
+	keys *sessionKeys,
+	outgoing, incoming *sequence,
+	request string,
+) string {
+	message := agreed.encode(request)
+	if outgoing != nil {
+		message = outgoing.seal(message)
+	}
+	encryptedBytes, ok := EncryptAES(keys.send, message)
+	if !ok {
+		return "error"
+	}
+	if _, err := agreed.writeMessage(connection, encryptedBytes); err != nil {
+		return "error"
+	}
+	buffer, err := agreed.readMessage(connection)
+	if err != nil {
+		return "error"
+	}
+	decryptedBytes, ok := DecryptAES(keys.receive, buffer)
+	if !ok {
+		return "error"
+	}
+	if incoming != nil {
+		if decryptedBytes, err = incoming.open(decryptedBytes); err != nil {
+			return err.Error()
+		}
+	}
+	response, ok := agreed.decode(decryptedBytes)
+	if !ok {
+		return "error"
+	}
+	return string(response)
+}
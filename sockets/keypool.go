@@ -0,0 +1,139 @@
+package sockets
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// keyPool keeps a number of freshly generated RSA keypairs ready so that
+// client sessions do not have to wait on GenerateRSAKeys during CONNECT. Keys
+// are produced by worker goroutines and each key is handed out at most once.
+type keyPool struct {
+	keys      chan *rsa.PrivateKey // Keys ready to be handed to a session.
+	done      chan struct{}        // Closed to stop the worker goroutines.
+	generated atomic.Uint64        // Keys generated by the workers.
+	hits      atomic.Uint64        // Keys taken from the pool.
+	misses    atomic.Uint64        // Keys generated on demand by take.
+}
+
+// keyPoolStats is a snapshot of the state of a keyPool.
+type keyPoolStats struct {
+	Depth     int    // Keys currently ready.
+	Capacity  int    // Maximum number of keys kept ready.
+	Generated uint64 // Keys generated by the workers.
+	Hits      uint64 // Keys taken from the pool.
+	Misses    uint64 // Keys generated on demand because the pool was empty.
+}
+
+// newKeyPool creates a pool holding up to size keypairs and starts the given
+// number of worker goroutines to fill it. A pool with a size of zero never
+// holds keys, and every call to take generates a new keypair.
+//
+// Returns a pointer to the new pool.
+func newKeyPool(size, workers int) *keyPool {
+	if size < 0 {
+		size = 0
+	}
+	pool := &keyPool{
+		keys: make(chan *rsa.PrivateKey, size),
+		done: make(chan struct{}),
+	}
+	if size == 0 {
+		return pool
+	}
+	for i := 0; i < workers; i++ {
+		go pool.fill()
+	}
+	return pool
+}
+
+// fill continuously generates keypairs and adds them to the pool, blocking
+// while the pool is full, until the pool is closed.
+func (pool *keyPool) fill() {
+	for {
+		privateKey, _ := GenerateRSAKeys()
+		pool.generated.Add(1)
+		select {
+		case pool.keys <- privateKey:
+		case <-pool.done:
+			return
+		}
+	}
+}
+
+// take removes a keypair from the pool. If the pool is empty a keypair is
+// generated immediately instead, so take never waits on the workers.
+//
+// Returns a pointer to the private key and a copy of the public key.
+func (pool *keyPool) take() (*rsa.PrivateKey, rsa.PublicKey) {
+	select {
+	case privateKey := <-pool.keys:
+		pool.hits.Add(1)
+		return privateKey, privateKey.PublicKey
+	default:
+		pool.misses.Add(1)
+		return GenerateRSAKeys()
+	}
+}
+
+// stats reports the current depth of the pool and its usage counters.
+//
+// Returns a keyPoolStats snapshot.
+func (pool *keyPool) stats() keyPoolStats {
+	return keyPoolStats{
+		Depth:     len(pool.keys),
+		Capacity:  cap(pool.keys),
+		Generated: pool.generated.Load(),
+		Hits:      pool.hits.Load(),
+		Misses:    pool.misses.Load(),
+	}
+}
+
+// close stops the worker goroutines. Keys already in the pool can still be
+// taken.
+func (pool *keyPool) close() {
+	close(pool.done)
+}
+
+// TestKeyPool runs a demonstration comparing the latency of CONNECT handshakes
+// with a server that generates session keys on demand and with a server that
+// takes them from a pre-generated key pool.
+func TestKeyPool() {
+	const connections = 10
+
+	configureLogging(LogConfig{Level: "error"})
+	clientLog = defaultLogger
+	for _, size := range []int{0, connections} {
+		s, address := startTestServer(ServerConfig{
+			KeyPoolSize: size, KeyPoolWorkers: 1})
+		var total time.Duration
+		for i := 0; i < connections; i++ {
+			// Clients arrive once the workers have refilled the pool, so
+			// that generating keys does not compete with the handshake.
+			for s.pool.stats().Depth < size {
+				time.Sleep(50 * time.Millisecond)
+			}
+			clientPrivateKey, _ = GenerateIdentityKey(keyEd25519)
+			clientPublicKey = clientPrivateKey.Public()
+			start := time.Now()
+			connection, reply, _, ok := connectServer(address)
+			total += time.Since(start)
+			if !ok || !strings.HasPrefix(reply, "CONNECT") ||
+				strings.HasPrefix(reply, "CONNECT: ERROR") {
+				fmt.Println("Error connecting:", reply)
+				return
+			}
+			connection.Close()
+		}
+		stats := s.pool.stats()
+		fmt.Printf("Average CONNECT latency with a pool of %d: %s\n",
+			size, total/connections)
+		fmt.Printf("  pool depth %d/%d, generated %d, hits %d, misses %d\n",
+			stats.Depth, stats.Capacity, stats.Generated, stats.Hits,
+			stats.Misses)
+		s.pool.close()
+	}
+}
@@ -0,0 +1,191 @@
+package sockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogConfig holds the options used to configure logging.
+type LogConfig struct {
+	Level  string // Minimum level logged: debug, info, warn or error.
+	Format string // Output format: logfmt or json.
+	Debug  bool   // Log at debug level and reveal secret values.
+}
+
+// logLevel orders log entries by severity.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// secret marks a logged value, such as a stored value or a decrypted message,
+// that must be redacted unless debug mode has been enabled.
+type secret string
+
+const redacted = "[REDACTED]"
+
+// logger writes leveled, structured log entries. Each entry carries the
+// logger's fields followed by the fields given with the entry. Loggers created
+// with the same parent share its output and lock.
+type logger struct {
+	output        io.Writer
+	mutex         *sync.Mutex
+	level         logLevel
+	json          bool
+	revealSecrets bool
+	fields        []any // Alternating field names and values.
+}
+
+// defaultLogger is used by code that does not belong to a session.
+var defaultLogger = newLogger(os.Stderr, LogConfig{})
+
+// newLogger creates a logger writing to output with the given config. Unknown
+// levels fall back to info and unknown formats fall back to logfmt.
+//
+// Returns a pointer to the new logger.
+func newLogger(output io.Writer, config LogConfig) *logger {
+	level := levelInfo
+	for l, name := range levelNames {
+		if strings.EqualFold(config.Level, name) {
+			level = l
+		}
+	}
+	if config.Debug {
+		level = levelDebug
+	}
+	return &logger{
+		output:        output,
+		mutex:         &sync.Mutex{},
+		level:         level,
+		json:          strings.EqualFold(config.Format, "json"),
+		revealSecrets: config.Debug,
+	}
+}
+
+// configureLogging replaces the default logger with one built from the given
+// config, writing to standard error.
+func configureLogging(config LogConfig) {
+	defaultLogger = newLogger(os.Stderr, config)
+	if config.Debug {
+		defaultLogger.warn("Debug mode enabled, secret values will be logged")
+	}
+}
+
+// with creates a logger that adds the given fields to every entry.
+//
+// Returns a pointer to the new logger.
+func (l *logger) with(fields ...any) *logger {
+	child := *l
+	child.fields = append(append([]any{}, l.fields...), fields...)
+	return &child
+}
+
+func (l *logger) debug(message string, fields ...any) {
+	l.log(levelDebug, message, fields)
+}
+
+func (l *logger) info(message string, fields ...any) {
+	l.log(levelInfo, message, fields)
+}
+
+func (l *logger) warn(message string, fields ...any) {
+	l.log(levelWarn, message, fields)
+}
+
+func (l *logger) error(message string, fields ...any) {
+	l.log(levelError, message, fields)
+}
+
+// log writes a single entry if its level is enabled.
+func (l *logger) log(level logLevel, message string, fields []any) {
+	if level < l.level {
+		return
+	}
+	all := append([]any{
+		"time", time.Now().Format(time.RFC3339Nano),
+		"level", levelNames[level],
+		"msg", message,
+	}, l.fields...)
+	all = append(all, fields...)
+
+	var line string
+	if l.json {
+		line = l.formatJSON(all)
+	} else {
+		line = l.formatLogfmt(all)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fmt.Fprintln(l.output, line)
+}
+
+// formatLogfmt formats fields as space separated key=value pairs, quoting
+// values that contain spaces, quotes or equals signs.
+//
+// Returns the formatted line.
+func (l *logger) formatLogfmt(fields []any) string {
+	pairs := make([]string, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := l.formatValue(fields[i+1])
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		pairs = append(pairs, fmt.Sprint(fields[i])+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// formatJSON formats fields as a single JSON object, keeping their order.
+//
+// Returns the formatted line.
+func (l *logger) formatJSON(fields []any) string {
+	pairs := make([]string, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		var value []byte
+		switch v := fields[i+1].(type) {
+		case int, int64, uint64, float64, bool:
+			value, _ = json.Marshal(v)
+		default:
+			value, _ = json.Marshal(l.formatValue(v))
+		}
+		pairs = append(pairs, string(key)+":"+string(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue converts a field value to a string, redacting secrets unless
+// debug mode has been enabled.
+//
+// Returns the formatted value.
+func (l *logger) formatValue(value any) string {
+	switch v := value.(type) {
+	case secret:
+		if !l.revealSecrets {
+			return redacted
+		}
+		return string(v)
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,581 @@
+package sockets
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The memcached listener lets services written for memcached use the server as
+// a cache through the memcached text protocol. It supports get, gets, set,
+// add, replace, cas, delete, incr, decr, version and quit.
+//
+// Every memcached client shares a single namespace, owned by a client with
+// the ID memcachedClientID, whose values are stored exactly as sent along
+// with their flags. The protocol has no authentication, so the namespace
+// should only hold data that any caller who can reach the listener may read.
+// A value's version is its cas unique, which changes whenever it is stored.
+
+const (
+	// memcachedClientID is the client ID owning the values stored over the
+	// memcached protocol.
+	memcachedClientID = "memcached"
+
+	// memcachedMaxKey is the longest key memcached accepts.
+	memcachedMaxKey = 250
+
+	// memcachedMaxValue is the largest value stored, which matches the
+	// largest value a TCP client can store.
+	memcachedMaxValue = messageBufferSize
+
+	// memcachedRelativeLimit is the longest expiry time given in seconds
+	// from now. Longer times are Unix times, as in memcached.
+	memcachedRelativeLimit = 30 * 24 * 60 * 60
+
+	// memcachedVersion is the version reported by the "version" command.
+	memcachedVersion = "1.6.0 cosc340-sockets"
+)
+
+// itemCondition is when putItem stores a value, named after the memcached
+// command that stores it.
+type itemCondition string
+
+const (
+	itemSet     itemCondition = "set"     // Always.
+	itemAdd     itemCondition = "add"     // Only if no value is stored.
+	itemReplace itemCondition = "replace" // Only if a value is stored.
+	itemCas     itemCondition = "cas"     // Only if the stored value has a version.
+)
+
+// memcachedConnection holds the state of a single memcached connection.
+type memcachedConnection struct {
+	server  *server
+	current *session
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+}
+
+// putItem stores value under key on behalf of the given client if the given
+// condition holds, where version is the version a cas expects.
+//
+// Returns true if the value was stored, otherwise the response category giving
+// the reason it was not.
+func (s *store) putItem(
+	id, key string,
+	value storedValue,
+	condition itemCondition,
+	version uint64,
+) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, resolved, ok := s.resolve(id, key, true)
+	if !ok {
+		return categoryDenied, false
+	}
+	current, exists := data[resolved]
+	exists = exists && !current.expired(time.Now())
+	switch {
+	case condition == itemAdd && exists:
+		return categoryExists, false
+	case (condition == itemReplace || condition == itemCas) && !exists:
+		return categoryNotFound, false
+	case condition == itemCas && current.version != version:
+		return categoryExists, false
+	}
+	value.version = s.nextVersion()
+	data[resolved] = value
+	s.recordValue(id, key)
+	return "", true
+}
+
+// increment adds delta to the decimal number stored under key on behalf of
+// the given client, or subtracts it if decrement is true. As in memcached, an
+// increment wraps around at 64 bits and a decrement stops at zero.
+//
+// Returns the new number and true if it was stored, otherwise the response
+// category giving the reason it was not.
+func (s *store) increment(
+	id, key string,
+	delta uint64,
+	decrement bool,
+) (uint64, string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, resolved, ok := s.resolve(id, key, true)
+	if !ok {
+		return 0, categoryDenied, false
+	}
+	value, exists := data[resolved]
+	if !exists || value.expired(time.Now()) {
+		return 0, categoryNotFound, false
+	}
+	number, err := strconv.ParseUint(strings.TrimSpace(value.data), 10, 64)
+	if err != nil || len(value.wrappedKeys) > 0 {
+		return 0, categoryNotNumber, false
+	}
+	switch {
+	case !decrement:
+		number += delta
+	case delta > number:
+		number = 0
+	default:
+		number -= delta
+	}
+	value.data = strconv.FormatUint(number, 10)
+	value.version = s.nextVersion()
+	data[resolved] = value
+	s.recordValue(id, key)
+	return number, "", true
+}
+
+// itemCommand carries out "ITEM [key]", which reads a value along with its
+// flags and version. It is used by the memcached listener.
+//
+// Returns the response, whose payload is "[flags] [version] [value]".
+func (s *server) itemCommand(current *session, key string) string {
+	value, ok := s.store.get(current.id, key)
+	ok = ok && len(value.wrappedKeys) == 0
+	s.metrics.command("ITEM", ok)
+	if !ok {
+		return replyError("ITEM", categoryNotFound, "")
+	}
+	return reply("ITEM",
+		fmt.Sprintf("%d %d %s", value.flags, value.version, value.data))
+}
+
+// setItemCommand carries out "SETITEM [key] [condition] [flags] [expires]
+// [version]" once the value has been read. The condition is "set", "add",
+// "replace" or "cas", which compares the stored version with the given one.
+// The expiry is a Unix time in milliseconds, or zero if the value never
+// expires. It is used by the memcached listener.
+//
+// Returns the response to send to the client.
+func (s *server) setItemCommand(
+	current *session,
+	argument string,
+	message []byte,
+) string {
+	arguments := strings.Fields(argument)
+	if len(arguments) != 5 {
+		s.metrics.command("SETITEM", false)
+		return replyError("SETITEM", categoryInvalid, "expected five arguments")
+	}
+	condition := itemCondition(arguments[1])
+	flags, flagsErr := strconv.ParseUint(arguments[2], 10, 32)
+	expires, expiresErr := strconv.ParseInt(arguments[3], 10, 64)
+	version, versionErr := strconv.ParseUint(arguments[4], 10, 64)
+	if flagsErr != nil || expiresErr != nil || versionErr != nil ||
+		expires < 0 || (condition != itemSet && condition != itemAdd &&
+		condition != itemReplace && condition != itemCas) {
+		s.metrics.command("SETITEM", false)
+		return replyError("SETITEM", categoryInvalid, "invalid item")
+	}
+
+	value := storedValue{data: string(message), flags: uint32(flags)}
+	if expires > 0 {
+		value.expires = time.UnixMilli(expires)
+	}
+	reason, ok := s.store.putItem(current.id, arguments[0], value,
+		condition, version)
+	s.metrics.command("SETITEM", ok)
+	if !ok {
+		return replyError("SETITEM", reason, "")
+	}
+	return reply("SETITEM", "")
+}
+
+// incrementCommand carries out "INCR [key] [amount]" and "DECR [key]
+// [amount]". It is used by the memcached listener.
+//
+// Returns the response, whose payload is the new number.
+func (s *server) incrementCommand(
+	current *session,
+	command, argument string,
+) string {
+	arguments := strings.Fields(argument)
+	if len(arguments) != 2 {
+		s.metrics.command(command, false)
+		return replyError(command, categoryInvalid, "expected a key and amount")
+	}
+	delta, err := strconv.ParseUint(arguments[1], 10, 64)
+	if err != nil {
+		s.metrics.command(command, false)
+		return replyError(command, categoryInvalid, "invalid amount")
+	}
+	number, reason, ok := s.store.increment(current.id, arguments[0], delta,
+		command == "DECR")
+	s.metrics.command(command, ok)
+	if !ok {
+		return replyError(command, reason, "")
+	}
+	return reply(command, strconv.FormatUint(number, 10))
+}
+
+// serveMemcached listens for memcached clients on the given address.
+//
+// Returns the listener and true if successful.
+func (s *server) serveMemcached(address string) (net.Listener, bool) {
+	listener, err := net.Listen(serverType, address)
+	if err != nil {
+		s.log.error("Error listening for memcached clients", "error", err)
+		return nil, false
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.memcachedSession(connection)
+		}
+	}()
+	s.log.info("Serving memcached clients", "address", listener.Addr().String())
+	return listener, true
+}
+
+// memcachedSession reads commands from a memcached connection and replies to
+// each, until the client quits or the connection fails. Replies to pipelined
+// commands are sent together once every buffered command has been read.
+func (s *server) memcachedSession(connection net.Conn) {
+	defer connection.Close()
+	current := &session{
+		connection:  connection,
+		number:      s.connections.Add(1),
+		connectedAt: time.Now(),
+		id:          memcachedClientID,
+	}
+	current.log = s.log.with(
+		"conn", current.number,
+		"remote", connection.RemoteAddr().String(),
+		"protocol", "memcached")
+	current.log.debug("memcached client connected")
+	m := &memcachedConnection{
+		server:  s,
+		current: current,
+		reader:  bufio.NewReaderSize(connection, messageBufferSize),
+		writer:  bufio.NewWriter(connection),
+	}
+
+	for {
+		line, err := m.reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			current.log.warn("Closing memcached connection",
+				"error", "line too long")
+			m.reply("CLIENT_ERROR line too long")
+			m.writer.Flush()
+			return
+		}
+		if err != nil {
+			current.log.debug("memcached client disconnected")
+			return
+		}
+		s.metrics.add(metricBytesIn, "", float64(len(line)))
+		quit := m.execute(strings.Fields(string(line)))
+		if quit || m.reader.Buffered() == 0 {
+			if err := m.writer.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// execute carries out a single command line, reading the data block that
+// follows a storage command, and writes the reply.
+//
+// Returns true if the client asked to close the connection.
+func (m *memcachedConnection) execute(arguments []string) bool {
+	if len(arguments) == 0 {
+		m.reply("ERROR")
+		return false
+	}
+	switch name := arguments[0]; name {
+	case "get", "gets":
+		m.get(arguments[1:], name == "gets")
+	case "set", "add", "replace", "cas":
+		m.store(itemCondition(name), arguments[1:])
+	case "delete":
+		m.delete(arguments[1:])
+	case "incr", "decr":
+		m.increment(strings.ToUpper(name), arguments[1:])
+	case "version":
+		m.reply("VERSION " + memcachedVersion)
+	case "quit":
+		return true
+	default:
+		m.reply("ERROR")
+	}
+	return false
+}
+
+// get carries out "get [keys...]" and "gets [keys...]", which also sends
+// each value's cas unique. Keys with no value are left out.
+func (m *memcachedConnection) get(keys []string, withVersion bool) {
+	if len(keys) == 0 || !validMemcachedKeys(keys) {
+		m.reply("CLIENT_ERROR bad command line format")
+		return
+	}
+	for _, key := range keys {
+		item := m.command("ITEM", key, nil)
+		if !item.ok() {
+			if m.unavailable(item) {
+				return
+			}
+			continue
+		}
+		fields := strings.SplitN(item.payload, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		header := fmt.Sprintf("VALUE %s %s %d", key, fields[0], len(fields[2]))
+		if withVersion {
+			header += " " + fields[1]
+		}
+		m.reply(header)
+		m.reply(fields[2])
+	}
+	m.reply("END")
+}
+
+// store carries out the storage commands "[command] [key] [flags] [expiry]
+// [bytes] [noreply]" and "cas [key] [flags] [expiry] [bytes] [cas unique]
+// [noreply]", each followed by a data block of the given size.
+func (m *memcachedConnection) store(condition itemCondition, arguments []string) {
+	fields := 4
+	if condition == itemCas {
+		fields = 5
+	}
+	noreply := len(arguments) == fields+1 && arguments[fields] == "noreply"
+	if len(arguments) != fields && !noreply {
+		m.reply("CLIENT_ERROR bad command line format")
+		return
+	}
+	flags, flagsErr := strconv.ParseUint(arguments[1], 10, 32)
+	expiry, expiryErr := strconv.ParseInt(arguments[2], 10, 64)
+	size, sizeErr := strconv.Atoi(arguments[3])
+	version := uint64(0)
+	var versionErr error
+	if condition == itemCas {
+		version, versionErr = strconv.ParseUint(arguments[4], 10, 64)
+	}
+	if flagsErr != nil || expiryErr != nil || sizeErr != nil ||
+		versionErr != nil || size < 0 || !validMemcachedKeys(arguments[:1]) {
+		m.reply("CLIENT_ERROR bad command line format")
+		return
+	}
+
+	if size > memcachedMaxValue {
+		io.CopyN(io.Discard, m.reader, int64(size)+2)
+		m.reply("SERVER_ERROR object too large for cache")
+		return
+	}
+	block := make([]byte, size+2)
+	if _, err := io.ReadFull(m.reader, block); err != nil {
+		return
+	}
+	if string(block[size:]) != "\r\n" {
+		m.reply("CLIENT_ERROR bad data chunk")
+		return
+	}
+
+	argument := fmt.Sprintf("%s %s %d %d %d", arguments[0], condition, flags,
+		memcachedDeadline(expiry), version)
+	stored := m.command("SETITEM", argument, block[:size])
+	switch {
+	case m.unavailable(stored):
+	case noreply:
+	case stored.ok():
+		m.reply("STORED")
+	case condition == itemCas && stored.category == categoryExists:
+		m.reply("EXISTS")
+	case condition == itemCas && stored.category == categoryNotFound:
+		m.reply("NOT_FOUND")
+	default:
+		m.reply("NOT_STORED")
+	}
+}
+
+// delete carries out "delete [key] [noreply]".
+func (m *memcachedConnection) delete(arguments []string) {
+	noreply := len(arguments) == 2 && arguments[1] == "noreply"
+	if (len(arguments) != 1 && !noreply) || !validMemcachedKeys(arguments[:1]) {
+		m.reply("CLIENT_ERROR bad command line format")
+		return
+	}
+	deleted := m.command("DELETE", arguments[0], nil)
+	switch {
+	case m.unavailable(deleted):
+	case noreply:
+	case !deleted.ok():
+		m.reply("NOT_FOUND")
+	default:
+		m.reply("DELETED")
+	}
+}
+
+// increment carries out "incr [key] [delta] [noreply]" and "decr [key]
+// [delta] [noreply]".
+func (m *memcachedConnection) increment(command string, arguments []string) {
+	noreply := len(arguments) == 3 && arguments[2] == "noreply"
+	if (len(arguments) != 2 && !noreply) || !validMemcachedKeys(arguments[:1]) {
+		m.reply("CLIENT_ERROR bad command line format")
+		return
+	}
+	if _, err := strconv.ParseUint(arguments[1], 10, 64); err != nil {
+		m.reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	incremented := m.command(command, arguments[0]+" "+arguments[1], nil)
+	switch {
+	case m.unavailable(incremented):
+	case noreply:
+	case incremented.category == categoryNotNumber:
+		m.reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+	case !incremented.ok():
+		m.reply("NOT_FOUND")
+	default:
+		m.reply(incremented.payload)
+	}
+}
+
+// command carries out a client command on behalf of the memcached clients.
+//
+// Returns the command's response.
+func (m *memcachedConnection) command(
+	command, argument string,
+	value []byte,
+) response {
+	return m.server.sessionlessCommand(m.current, command, argument, value)
+}
+
+// unavailable replies with a server error if a command failed because this
+// server cannot carry it out.
+//
+// Returns true if it replied.
+func (m *memcachedConnection) unavailable(outcome response) bool {
+	switch outcome.category {
+	case categoryReadOnly:
+		m.reply("SERVER_ERROR server is a read-only replica")
+	case categoryMoved:
+		m.reply("SERVER_ERROR key is owned by another cluster node")
+	case categoryNotLeader:
+		m.reply(strings.TrimSpace(
+			"SERVER_ERROR server is not the Raft leader " + outcome.payload))
+	case categoryUnavailable:
+		m.reply("SERVER_ERROR server is unavailable")
+	default:
+		return false
+	}
+	return true
+}
+
+// reply writes a line of the reply.
+func (m *memcachedConnection) reply(line string) {
+	if strings.HasPrefix(line, "CLIENT_ERROR") ||
+		strings.HasPrefix(line, "SERVER_ERROR") {
+		m.server.metrics.error("memcached")
+	}
+	m.writer.WriteString(line + "\r\n")
+}
+
+// validMemcachedKeys checks that keys are at most memcachedMaxKey bytes long
+// and hold no whitespace or control characters.
+func validMemcachedKeys(keys []string) bool {
+	for _, key := range keys {
+		if key == "" || len(key) > memcachedMaxKey {
+			return false
+		}
+		for i := 0; i < len(key); i++ {
+			if key[i] <= ' ' || key[i] == 0x7f {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// memcachedDeadline converts a memcached expiry time into a Unix time in
+// milliseconds. An expiry of zero never expires, an expiry of up to thirty
+// days counts seconds from now, a longer one is a Unix time in seconds, and a
+// negative one has already passed.
+//
+// Returns the Unix time in milliseconds, or zero if the value never expires.
+func memcachedDeadline(expiry int64) int64 {
+	switch {
+	case expiry == 0:
+		return 0
+	case expiry < 0:
+		return 1
+	case expiry <= memcachedRelativeLimit:
+		return time.Now().Add(time.Duration(expiry) * time.Second).UnixMilli()
+	}
+	return time.Unix(expiry, 0).UnixMilli()
+}
+
+// TestMemcached runs a server with a memcached listener on localhost ports,
+// then stores, reads, updates and deletes values as a memcached client would.
+func TestMemcached() {
+	configureLogging(LogConfig{Level: "warn"})
+	s, address := startTestServer(ServerConfig{KeyPoolSize: 2, KeyPoolWorkers: 1})
+	listener, ok := s.serveMemcached(serverHost + ":0")
+	if !ok {
+		return
+	}
+	defer listener.Close()
+	fmt.Println("Server listening on", address)
+	fmt.Println("memcached listener on", listener.Addr().String())
+
+	connection, err := net.Dial(serverType, listener.Addr().String())
+	if err != nil {
+		fmt.Println("Error connecting:", err.Error())
+		return
+	}
+	defer connection.Close()
+	reader := bufio.NewReader(connection)
+	// send writes a request and prints the reply's lines, up to the given
+	// number of lines or a line ending the reply.
+	send := func(request string, lines int) []string {
+		connection.Write([]byte(request))
+		replies := []string{}
+		for len(replies) < lines {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				fmt.Println("Error reading reply:", err.Error())
+				return nil
+			}
+			replies = append(replies, strings.TrimSpace(line))
+			if replies[len(replies)-1] == "END" {
+				break
+			}
+		}
+		fmt.Printf("%q -> %s\n", request, strings.Join(replies, " | "))
+		return replies
+	}
+
+	send("set colour 7 0 4\r\nblue\r\n", 1)
+	send("get colour missing\r\n", 3)
+	send("add colour 0 0 3\r\nred\r\n", 1)
+	send("replace colour 3 0 5\r\ngreen\r\n", 1)
+	send("replace missing 0 0 1\r\nx\r\n", 1)
+	header := strings.Fields(send("gets colour\r\n", 3)[0])
+	version := header[len(header)-1]
+	send("cas colour 0 0 6 "+version+"\r\nyellow\r\n", 1)
+	send("cas colour 0 0 3 "+version+"\r\nred\r\n", 1)
+	send("set hits 0 0 2\r\n41\r\n", 1)
+	send("incr hits 1\r\n", 1)
+	send("decr hits 100\r\n", 1)
+	send("incr colour 1\r\n", 1)
+	send("set empty 0 0 0 noreply\r\n\r\n", 0)
+	send("set session 0 1 5\r\ntoken\r\n", 1)
+	send("get empty session\r\n", 5)
+	time.Sleep(1100 * time.Millisecond)
+	send("get session\r\n", 1)
+	send("delete colour\r\n", 1)
+	send("delete colour\r\n", 1)
+	send("version\r\n", 1)
+	send("flush_all\r\n", 1)
+}
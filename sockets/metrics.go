@@ -0,0 +1,291 @@
+package sockets
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms.
+var latencyBuckets = []float64{
+	0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5,
+}
+
+// metricInfo describes a metric family for the Prometheus text format.
+type metricInfo struct {
+	name       string
+	metricType string
+	help       string
+}
+
+var (
+	metricActiveSessions = metricInfo{"sockets_active_sessions", "gauge",
+		"Number of connected client sessions."}
+	metricCommands = metricInfo{"sockets_commands_total", "counter",
+		"Client commands processed, by command and result."}
+	metricHandshake = metricInfo{"sockets_handshake_duration_seconds",
+		"histogram", "Time taken to complete a CONNECT handshake."}
+	metricCrypto = metricInfo{"sockets_crypto_duration_seconds", "histogram",
+		"Time taken by message encryption and decryption, by operation."}
+	metricBytesIn = metricInfo{"sockets_received_bytes_total", "counter",
+		"Bytes read from client connections."}
+	metricBytesOut = metricInfo{"sockets_sent_bytes_total", "counter",
+		"Bytes written to client connections."}
+	metricErrors = metricInfo{"sockets_errors_total", "counter",
+		"Errors encountered while serving clients, by type."}
+	metricStoredKeys = metricInfo{"sockets_stored_keys", "gauge",
+		"Number of keys stored, by namespace."}
+	metricStoredBytes = metricInfo{"sockets_stored_bytes", "gauge",
+		"Size of the stored keys and values, by namespace."}
+	metricPoolDepth = metricInfo{"sockets_key_pool_depth", "gauge",
+		"Number of pre-generated RSA keypairs ready for new sessions."}
+	metricPoolCapacity = metricInfo{"sockets_key_pool_capacity", "gauge",
+		"Maximum number of pre-generated RSA keypairs."}
+	metricPoolTaken = metricInfo{"sockets_key_pool_taken_total", "counter",
+		"Session keys handed out, by whether the pool had one ready."}
+	metricReplicationSequence = metricInfo{"sockets_replication_sequence",
+		"gauge", "Sequence number of the latest change to the store."}
+)
+
+// histogram counts observations into cumulative latency buckets.
+type histogram struct {
+	counts []uint64 // Observations less than or equal to each bucket bound.
+	count  uint64
+	sum    float64
+}
+
+// metrics records the server's counters and histograms. Gauges describing the
+// store and key pool are read when the metrics are written instead.
+type metrics struct {
+	mutex          sync.Mutex
+	activeSessions int
+	counters       map[metricInfo]map[string]float64
+	histograms     map[metricInfo]map[string]*histogram
+}
+
+// newMetrics creates an empty set of metrics.
+//
+// Returns a pointer to the new metrics.
+func newMetrics() *metrics {
+	return &metrics{
+		counters:   map[metricInfo]map[string]float64{},
+		histograms: map[metricInfo]map[string]*histogram{},
+	}
+}
+
+// labels formats the given name and value pairs as a Prometheus label set.
+// e.g. labels("command", "GET") returns `command="GET"`
+//
+// Returns the formatted label set.
+func labels(pairs ...string) string {
+	formatted := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		formatted = append(formatted,
+			pairs[i]+"=\""+labelEscaper.Replace(pairs[i+1])+"\"")
+	}
+	return strings.Join(formatted, ",")
+}
+
+// labelEscaper escapes the characters the Prometheus text format does not
+// allow unescaped in label values. Other characters are written as they are.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// add increases the counter with the given label set by delta.
+func (m *metrics) add(info metricInfo, labelSet string, delta float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.counters[info] == nil {
+		m.counters[info] = map[string]float64{}
+	}
+	m.counters[info][labelSet] += delta
+}
+
+// observe records the time elapsed since start in the histogram with the
+// given label set.
+func (m *metrics) observe(info metricInfo, labelSet string, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.histograms[info] == nil {
+		m.histograms[info] = map[string]*histogram{}
+	}
+	h, exists := m.histograms[info][labelSet]
+	if !exists {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.histograms[info][labelSet] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// sessionStarted and sessionEnded track the number of active sessions.
+func (m *metrics) sessionStarted() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.activeSessions++
+}
+
+func (m *metrics) sessionEnded() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.activeSessions--
+}
+
+// command counts a processed client command and whether it succeeded.
+func (m *metrics) command(command string, ok bool) {
+	result := "ok"
+	if !ok {
+		result = "error"
+	}
+	m.add(metricCommands, labels("command", command, "result", result), 1)
+}
+
+// error counts an error of the given type.
+func (m *metrics) error(errorType string) {
+	m.add(metricErrors, labels("type", errorType), 1)
+}
+
+// write outputs every metric in the Prometheus text exposition format,
+// including gauges read from the given store and key pool.
+func (m *metrics) write(w io.Writer, s *store, pool *keyPool) {
+	namespaces := s.stats()
+	poolStats := pool.stats()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeHeader(w, metricActiveSessions)
+	fmt.Fprintf(w, "%s %d\n", metricActiveSessions.name, m.activeSessions)
+
+	keys := map[string]float64{}
+	bytes := map[string]float64{}
+	for id, namespace := range namespaces {
+		name := id
+		if !strings.HasPrefix(id, "@") {
+			name = fingerprint(id)
+		}
+		labelSet := labels("namespace", name)
+		keys[labelSet] = float64(namespace.keys)
+		bytes[labelSet] = float64(namespace.bytes)
+	}
+	writeSamples(w, metricStoredKeys, keys)
+	writeSamples(w, metricStoredBytes, bytes)
+
+	writeHeader(w, metricPoolDepth)
+	fmt.Fprintf(w, "%s %d\n", metricPoolDepth.name, poolStats.Depth)
+	writeHeader(w, metricPoolCapacity)
+	fmt.Fprintf(w, "%s %d\n", metricPoolCapacity.name, poolStats.Capacity)
+	writeSamples(w, metricPoolTaken, map[string]float64{
+		labels("source", "pool"):   float64(poolStats.Hits),
+		labels("source", "demand"): float64(poolStats.Misses),
+	})
+
+	writeHeader(w, metricReplicationSequence)
+	fmt.Fprintf(w, "%s %d\n", metricReplicationSequence.name, s.log.position())
+
+	for _, info := range []metricInfo{
+		metricCommands, metricBytesIn, metricBytesOut, metricErrors,
+	} {
+		writeSamples(w, info, m.counters[info])
+	}
+	for _, info := range []metricInfo{metricHandshake, metricCrypto} {
+		writeHistograms(w, info, m.histograms[info])
+	}
+}
+
+// writeHeader outputs the HELP and TYPE lines of a metric family.
+func writeHeader(w io.Writer, info metricInfo) {
+	fmt.Fprintf(w, "# HELP %s %s\n", info.name, info.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", info.name, info.metricType)
+}
+
+// writeSamples outputs a metric family with one sample per label set, sorted
+// so that successive scrapes are stable.
+func writeSamples(w io.Writer, info metricInfo, samples map[string]float64) {
+	writeHeader(w, info)
+	for _, labelSet := range sortedKeys(samples) {
+		fmt.Fprintf(w, "%s %s\n", sampleName(info.name, labelSet),
+			strconv.FormatFloat(samples[labelSet], 'g', -1, 64))
+	}
+}
+
+// writeHistograms outputs a histogram family with one histogram per label set.
+func writeHistograms(
+	w io.Writer,
+	info metricInfo,
+	histograms map[string]*histogram,
+) {
+	writeHeader(w, info)
+	for _, labelSet := range sortedKeys(histograms) {
+		h := histograms[labelSet]
+		for i, bound := range latencyBuckets {
+			le := labels("le", strconv.FormatFloat(bound, 'g', -1, 64))
+			fmt.Fprintf(w, "%s %d\n",
+				sampleName(info.name+"_bucket", joinLabels(labelSet, le)),
+				h.counts[i])
+		}
+		fmt.Fprintf(w, "%s %d\n", sampleName(info.name+"_bucket",
+			joinLabels(labelSet, labels("le", "+Inf"))), h.count)
+		fmt.Fprintf(w, "%s %s\n", sampleName(info.name+"_sum", labelSet),
+			strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s %d\n", sampleName(info.name+"_count", labelSet),
+			h.count)
+	}
+}
+
+// sampleName appends a label set, if any, to a metric name.
+//
+// Returns the sample name.
+func sampleName(name, labelSet string) string {
+	if labelSet == "" {
+		return name
+	}
+	return name + "{" + labelSet + "}"
+}
+
+// joinLabels combines two formatted label sets.
+//
+// Returns the combined label set.
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+// sortedKeys returns the keys of a map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serveMetrics starts an HTTP listener on the given address that serves the
+// server's metrics at /metrics. The listener runs until the program exits.
+func serveMetrics(address string, m *metrics, s *store, pool *keyPool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w, s, pool)
+	})
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		if err != nil {
+			defaultLogger.error("Error serving metrics", "error", err)
+		}
+	}()
+	defaultLogger.info("Serving metrics", "url", "http://"+address+"/metrics")
+}
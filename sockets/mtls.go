@@ -0,0 +1,442 @@
+package sockets
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A server running over TLS may require clients to present a certificate
+// issued by one of the CAs in a bundle, which then decides the client ID the
+// client connects as and so the data it reaches. A certificate names its
+// client either by being issued for the client's RSA key, or by giving the
+// fingerprint of that key as its subject's common name, which allows the
+// certificate's own key to differ. Other nodes need only present a valid
+// certificate. Certificates listed in a revocation list are refused, and the
+// sessions of clients whose certificates are revoked later are closed.
+
+// Ways a client certificate names its client.
+const (
+	identityKey     = "key"     // The certificate was issued for the client's key.
+	identitySubject = "subject" // The subject's common name is the key's fingerprint.
+)
+
+// File written by GenerateCertificates and RevokeCertificate.
+const revocationListFile = "ca.crl"
+
+// revocationCheckInterval is how often the revocation list is checked for
+// changes, so that the sessions of revoked clients are closed.
+const revocationCheckInterval = 10 * time.Second
+
+// Lifetime of the revocation lists issued by RevokeCertificate.
+const revocationListLifetime = 30 * 24 * time.Hour
+
+var errCertificateRevoked = errors.New("certificate revoked")
+
+// revocationList holds the serial numbers of revoked certificates read from a
+// file of PEM encoded CRLs, each signed by one of the CAs clients are checked
+// against. The file is read again whenever it changes.
+type revocationList struct {
+	path    string
+	issuers []*x509.Certificate // The CAs allowed to sign the lists.
+
+	mutex    sync.Mutex
+	modified time.Time       // When the file read last was modified.
+	revoked  map[string]bool // Issuer and serial number of each certificate.
+}
+
+// refresh reads the revocation list again if its file changed since it was
+// last read. A file that cannot be read or holds an invalid list is logged
+// and the previous list is kept, so that no certificate is reinstated.
+//
+// Returns true if the list changed, and false if it was kept.
+func (l *revocationList) refresh() bool {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		defaultLogger.error("Error reading revocation list", "path", l.path,
+			"error", err)
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if info.ModTime().Equal(l.modified) {
+		return false
+	}
+	revoked, ok := readRevocationList(l.path, l.issuers)
+	if !ok {
+		return false
+	}
+	l.modified, l.revoked = info.ModTime(), revoked
+	defaultLogger.info("Loaded revocation list", "path", l.path,
+		"revoked", len(revoked))
+	return true
+}
+
+// isRevoked checks whether a certificate is listed as revoked by its issuer.
+func (l *revocationList) isRevoked(certificate *x509.Certificate) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.revoked[revocationEntry(certificate.RawIssuer,
+		certificate.SerialNumber)]
+}
+
+// revocationEntry identifies a certificate by its issuer and serial number.
+//
+// Returns the entry's key.
+func revocationEntry(rawIssuer []byte, serial *big.Int) string {
+	return string(rawIssuer) + "/" + serial.String()
+}
+
+// readRevocationList reads the PEM encoded CRLs in the file at path, each of
+// which must be signed by one of the given issuers.
+//
+// Returns the revoked certificates and true if every list is valid.
+func readRevocationList(
+	path string,
+	issuers []*x509.Certificate,
+) (map[string]bool, bool) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		defaultLogger.error("Error reading revocation list", "path", path,
+			"error", err)
+		return nil, false
+	}
+	revoked := map[string]bool{}
+	for {
+		block, rest := pem.Decode(encoded)
+		if block == nil {
+			break
+		}
+		encoded = rest
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		list, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			defaultLogger.error("Error parsing revocation list", "path", path,
+				"error", err)
+			return nil, false
+		}
+		signed := false
+		for _, issuer := range issuers {
+			if list.CheckSignatureFrom(issuer) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			defaultLogger.error("Revocation list is not signed by a client CA",
+				"path", path, "issuer", list.Issuer.String())
+			return nil, false
+		}
+		if !list.NextUpdate.IsZero() && time.Now().After(list.NextUpdate) {
+			defaultLogger.warn("Revocation list is out of date", "path", path,
+				"next_update", list.NextUpdate.Format(time.RFC3339))
+		}
+		for _, entry := range list.RevokedCertificates {
+			revoked[revocationEntry(list.RawIssuer, entry.SerialNumber)] = true
+		}
+	}
+	return revoked, true
+}
+
+// loadCertificates reads every PEM encoded certificate in the file at path.
+//
+// Returns the certificates and true if at least one was read.
+func loadCertificates(path string) ([]*x509.Certificate, bool) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		defaultLogger.error("Error reading certificates", "path", path,
+			"error", err)
+		return nil, false
+	}
+	certificates := []*x509.Certificate{}
+	for {
+		block, rest := pem.Decode(encoded)
+		if block == nil {
+			break
+		}
+		encoded = rest
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			defaultLogger.error("Error parsing certificate", "path", path,
+				"error", err)
+			return nil, false
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		defaultLogger.error("File does not contain a certificate", "path", path)
+		return nil, false
+	}
+	return certificates, true
+}
+
+// requireClientCertificates makes the server's TLS listener require clients to
+// present a certificate issued by one of the CAs in the configured bundle,
+// which is not listed in the configured revocation list, if any.
+//
+// Returns true if the bundle and revocation list are valid.
+func (s *server) requireClientCertificates() bool {
+	switch s.config.TLSIdentity {
+	case "", identityKey, identitySubject:
+	default:
+		s.log.error("Unknown client certificate identity",
+			"identity", s.config.TLSIdentity)
+		return false
+	}
+	cas, ok := loadCertificates(s.config.TLSClientCA)
+	if !ok {
+		return false
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	s.listenerTLS.ClientAuth = tls.RequireAndVerifyClientCert
+	s.listenerTLS.ClientCAs = pool
+	if s.config.TLSCRL == "" {
+		return true
+	}
+
+	s.revocations = &revocationList{path: s.config.TLSCRL, issuers: cas}
+	if !s.revocations.refresh() {
+		return false
+	}
+	s.listenerTLS.VerifyConnection = func(state tls.ConnectionState) error {
+		if s.revocations.refresh() {
+			go s.closeRevokedSessions()
+		}
+		if s.revocations.isRevoked(state.PeerCertificates[0]) {
+			s.log.warn("Refused revoked client certificate",
+				"serial", state.PeerCertificates[0].SerialNumber.String())
+			s.metrics.error("revoked")
+			return errCertificateRevoked
+		}
+		return nil
+	}
+	return true
+}
+
+// watchRevocations checks the revocation list for changes until the server
+// stops, closing the sessions of clients whose certificates were revoked.
+func (s *server) watchRevocations() {
+	for range time.Tick(revocationCheckInterval) {
+		if s.revocations.refresh() {
+			s.closeRevokedSessions()
+		}
+	}
+}
+
+// closeRevokedSessions closes every session whose client presented a revoked
+// certificate. The sessions clean up their data as if the client had
+// disconnected.
+func (s *server) closeRevokedSessions() {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	for _, current := range s.sessions {
+		if current.certificate != nil &&
+			s.revocations.isRevoked(current.certificate) {
+			current.log.warn("Session closed as its certificate was revoked")
+			current.connection.Close()
+		}
+	}
+}
+
+// certifiedClient checks that the certificate presented by a session's client,
+// if the server requires one, names the client ID the client connects as,
+// comparing the keys themselves so that the form of the ID does not matter.
+// Other nodes are only required to present a valid certificate.
+//
+// Returns true if the client may connect with the ID.
+func (s *server) certifiedClient(current *session, id string) bool {
+	if s.listenerTLS == nil ||
+		s.listenerTLS.ClientAuth != tls.RequireAndVerifyClientCert {
+		return true
+	}
+	connection, ok := current.connection.(*tls.Conn)
+	if !ok || len(connection.ConnectionState().PeerCertificates) == 0 {
+		return false
+	}
+	certificate := connection.ConnectionState().PeerCertificates[0]
+	s.sessionsMutex.Lock()
+	current.certificate = certificate
+	s.sessionsMutex.Unlock()
+	if s.isPeer(id) || s.isRaftPeer(id) || s.replicaAllowed(id) {
+		return true
+	}
+	if s.config.TLSIdentity == identitySubject {
+		return strings.ToLower(certificate.Subject.CommonName) == fingerprint(id)
+	}
+	clientKey, ok := StringToPublicKey(id)
+	certificateKey, isKey := certificate.PublicKey.(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	return ok && isKey && certificateKey.Equal(clientKey)
+}
+
+// RevokeCertificate adds the certificate in the given file to the revocation
+// list in the config's directory, which is signed by the CA whose key the
+// config names. Servers reading the list refuse the certificate, and close the
+// sessions of clients that presented it.
+//
+// Returns true if the revocation list was written.
+func RevokeCertificate(config CertConfig, certFile string) bool {
+	configureLogging(LogConfig{Level: "info"})
+	caKey, _, ok := LoadRSAKeys(config.CAKey)
+	if !ok {
+		return false
+	}
+	ca, ok := loadCACertificate(filepath.Join(config.Directory, caCertFile),
+		caKey)
+	if !ok {
+		return false
+	}
+	certificates, ok := loadCertificates(certFile)
+	if !ok {
+		return false
+	}
+	return issueRevocationList(filepath.Join(config.Directory,
+		revocationListFile), certificates, ca, caKey)
+}
+
+// issueRevocationList adds the given certificates to the revocation list in
+// the file at path, signed by the CA, creating the list if missing.
+//
+// Returns true if the revocation list was written.
+func issueRevocationList(
+	path string,
+	certificates []*x509.Certificate,
+	ca *x509.Certificate,
+	caKey *rsa.PrivateKey,
+) bool {
+	template := &x509.RevocationList{Number: big.NewInt(1)}
+	if encoded, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(encoded)
+		if block == nil || block.Type != "X509 CRL" {
+			defaultLogger.error("File does not contain a revocation list",
+				"path", path)
+			return false
+		}
+		previous, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil || previous.CheckSignatureFrom(ca) != nil {
+			defaultLogger.error("Revocation list is not signed by the CA",
+				"path", path)
+			return false
+		}
+		template.RevokedCertificates = previous.RevokedCertificates
+		template.Number = new(big.Int).Add(previous.Number, big.NewInt(1))
+	}
+	for _, certificate := range certificates {
+		template.RevokedCertificates = append(template.RevokedCertificates,
+			pkix.RevokedCertificate{
+				SerialNumber:   certificate.SerialNumber,
+				RevocationTime: time.Now(),
+			})
+	}
+	template.ThisUpdate = time.Now()
+	template.NextUpdate = time.Now().Add(revocationListLifetime)
+	encoded, err := x509.CreateRevocationList(rand.Reader, template, ca, caKey)
+	if err != nil {
+		defaultLogger.error("Error issuing revocation list", "path", path,
+			"error", err)
+		return false
+	}
+	block := &pem.Block{Type: "X509 CRL", Bytes: encoded}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0644); err != nil {
+		defaultLogger.error("Error saving revocation list", "path", path,
+			"error", err)
+		return false
+	}
+	defaultLogger.info("Issued revocation list", "path", path,
+		"revoked", len(template.RevokedCertificates))
+	return true
+}
+
+// TestMutualTLS issues certificates in a temporary directory and runs a server
+// requiring client certificates on a localhost port. A client whose
+// certificate was issued for its key stores a value, while a client
+// connecting with another key and a client without a certificate are
+// refused. The certificate is then revoked, which closes the client's session
+// and refuses it from then on.
+func TestMutualTLS() {
+	directory, err := os.MkdirTemp("", "certs")
+	if err != nil {
+		fmt.Println("Error creating directory:", err.Error())
+		return
+	}
+	defer os.RemoveAll(directory)
+	config := CertConfig{
+		Directory: directory,
+		CAKey:     filepath.Join(directory, "ca.pem"),
+		ServerKey: filepath.Join(directory, "server.pem"),
+		ClientKey: filepath.Join(directory, "client.pem"),
+		Hosts:     []string{serverHost, "127.0.0.1"},
+	}
+	if !GenerateCertificates(config) {
+		return
+	}
+	caPath := filepath.Join(directory, caCertFile)
+	configureLogging(LogConfig{Level: "error"})
+
+	s, address := startTestServer(ServerConfig{
+		KeyPoolSize:    2,
+		KeyPoolWorkers: 1,
+		TLSCert:        filepath.Join(directory, serverCertFile),
+		TLSKey:         filepath.Join(directory, "server.pem"),
+		TLSClientCA:    caPath,
+		TLSCRL:         filepath.Join(directory, revocationListFile),
+	})
+	fmt.Println("Server requiring client certificates on", address)
+
+	clientConfig, ok := clientTLSConfig(caPath,
+		filepath.Join(directory, clientCertFile),
+		filepath.Join(directory, "client.pem"))
+	if !ok {
+		return
+	}
+	privateKey, publicKey, _ := LoadRSAKeys(config.ClientKey)
+	connection, sessionKey, ok := dialServer(address, publicKey, clientConfig)
+	if !ok {
+		fmt.Println("Error connecting with the client certificate")
+		return
+	}
+	defer connection.Close()
+	fmt.Println("Client with its certificate connects: true")
+	fmt.Println("CREATE team ->",
+		testRequest(connection, sessionKey, privateKey, "CREATE team"))
+
+	_, otherKey := GenerateRSAKeys()
+	_, _, ok = dialServer(address, otherKey, clientConfig)
+	fmt.Println("Client with another key connects:", ok)
+	anonymous, _ := clientTLSConfig(caPath, "", "")
+	_, _, ok = dialServer(address, publicKey, anonymous)
+	fmt.Println("Client without a certificate connects:", ok)
+
+	if !RevokeCertificate(config, filepath.Join(directory, clientCertFile)) {
+		return
+	}
+	configureLogging(LogConfig{Level: "error"})
+	if s.revocations.refresh() {
+		s.closeRevokedSessions()
+	}
+	fmt.Println("ACCESS team after revocation ->",
+		testRequest(connection, sessionKey, privateKey, "ACCESS team"))
+	_, _, ok = dialServer(address, publicKey, clientConfig)
+	fmt.Println("Client with the revoked certificate connects:", ok)
+}
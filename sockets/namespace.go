@@ -0,0 +1,253 @@
+package sockets
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// permission is the level of access a client has to a shared namespace.
+type permission int
+
+const (
+	permissionNone permission = iota
+	permissionRead
+	permissionReadWrite
+	permissionOwner
+)
+
+var permissionNames = map[permission]string{
+	permissionRead:      "read",
+	permissionReadWrite: "readwrite",
+	permissionOwner:     "owner",
+}
+
+// sharedNamespace is a set of keys that may be used by several clients. Unlike
+// a client's own data, a shared namespace outlives the sessions using it.
+type sharedNamespace struct {
+	owner  string                 // Fingerprint of the client that created it.
+	grants map[string]permission  // Permissions by client fingerprint.
+	data   map[string]storedValue // A mapping of key strings to values.
+
+	// Group keys wrapped for each member by member fingerprint, one map per
+	// epoch. Empty unless the namespace was created as a group.
+	groupKeys []map[string][]byte
+}
+
+// splitSharedKey separates a key of the form "@namespace/key" into the name of
+// the namespace and the key within it.
+//
+// Returns the namespace, the key and true if the key addresses a shared
+// namespace. Otherwise returns empty strings and false.
+func splitSharedKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, "@") {
+		return "", "", false
+	}
+	name, key, found := strings.Cut(key[1:], "/")
+	if !found || !validNamespaceName(name) || key == "" {
+		return "", "", false
+	}
+	return name, key, true
+}
+
+// validNamespaceName checks that a namespace name is short and contains no
+// spaces or slashes.
+func validNamespaceName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.ContainsAny(name, " /@\n")
+}
+
+// validFingerprint checks that a string is a full hexadecimal SHA256 key
+// fingerprint, as produced by fingerprint.
+func validFingerprint(keyFingerprint string) bool {
+	decoded, err := hex.DecodeString(keyFingerprint)
+	return err == nil && len(decoded) == 32
+}
+
+// parsePermission converts "read" or "readwrite" into a permission.
+//
+// Returns the permission and true if it can be granted, otherwise false.
+func parsePermission(name string) (permission, bool) {
+	switch strings.ToLower(name) {
+	case "read":
+		return permissionRead, true
+	case "readwrite":
+		return permissionReadWrite, true
+	}
+	return permissionNone, false
+}
+
+// permissionOf finds the access the client with the given ID has to a
+// namespace. The caller must hold the store's mutex.
+//
+// Returns the client's permission.
+func (namespace *sharedNamespace) permissionOf(id string) permission {
+	keyFingerprint := fingerprint(id)
+	if keyFingerprint == namespace.owner {
+		return permissionOwner
+	}
+	return namespace.grants[keyFingerprint]
+}
+
+// createNamespace creates an empty shared namespace owned by the client with
+// the given ID.
+//
+// Returns false if there is no client ID, or the name is invalid or already
+// taken.
+func (s *store) createNamespace(id, name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id == "" || !validNamespaceName(name) || s.namespaces[name] != nil {
+		return false
+	}
+	s.namespaces[name] = &sharedNamespace{
+		owner:  fingerprint(id),
+		grants: map[string]permission{},
+		data:   map[string]storedValue{},
+	}
+	s.recordNamespace(name)
+	return true
+}
+
+// grant gives the client with the given fingerprint access to a namespace.
+// Only the owner of a namespace may change its grants. Members of a group are
+// managed with addGroupMember instead.
+//
+// Returns false if the namespace does not exist or the client is not its owner.
+func (s *store) grant(id, name, grantee string, access permission) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	namespace := s.namespaces[name]
+	if namespace == nil || namespace.permissionOf(id) != permissionOwner ||
+		len(namespace.groupKeys) > 0 {
+		return false
+	}
+	grantee = s.canonicalFingerprint(grantee)
+	if !validFingerprint(grantee) || grantee == namespace.owner {
+		return false
+	}
+	namespace.grants[grantee] = access
+	s.recordNamespace(name)
+	return true
+}
+
+// revoke removes any access the client with the given fingerprint has to a
+// namespace. Only the owner of a namespace may change its grants. Members of a
+// group are removed with removeGroupMember instead, so that the group is
+// rekeyed.
+//
+// Returns false if the namespace does not exist, the client is not its owner
+// or the grantee had no access.
+func (s *store) revoke(id, name, grantee string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	namespace := s.namespaces[name]
+	if namespace == nil || namespace.permissionOf(id) != permissionOwner ||
+		len(namespace.groupKeys) > 0 {
+		return false
+	}
+	grantee = s.canonicalFingerprint(grantee)
+	if _, exists := namespace.grants[grantee]; !exists {
+		return false
+	}
+	delete(namespace.grants, grantee)
+	s.recordNamespace(name)
+	return true
+}
+
+// access lists the clients that may use a namespace. Only clients with access
+// to the namespace may list it.
+//
+// Returns one "[fingerprint] [permission]" line per client, starting with the
+// owner, and true if successful.
+func (s *store) access(id, name string) ([]string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	namespace := s.namespaces[name]
+	if namespace == nil || namespace.permissionOf(id) == permissionNone {
+		return []string{}, false
+	}
+	lines := []string{namespace.owner + " " + permissionNames[permissionOwner]}
+	grantees := sortedKeys(namespace.grants)
+	for _, grantee := range grantees {
+		lines = append(lines,
+			grantee+" "+permissionNames[namespace.grants[grantee]])
+	}
+	return lines, true
+}
+
+// resolve finds the data map holding key on behalf of the client with the
+// given ID. Keys of the form "@namespace/key" refer to shared namespaces and
+// require read access, or read/write access if write is true. Any other key
+// refers to the client's own data. The caller must hold the store's mutex.
+//
+// Returns the data map, the key within it and true if access is allowed.
+func (s *store) resolve(
+	id, key string,
+	write bool,
+) (map[string]storedValue, string, bool) {
+	name, sharedKey, shared := splitSharedKey(key)
+	if !shared {
+		client, exists := s.clients[id]
+		return client.clientData, key, exists
+	}
+
+	namespace := s.namespaces[name]
+	if namespace == nil {
+		return nil, "", false
+	}
+	required := permissionRead
+	if write {
+		required = permissionReadWrite
+	}
+	if namespace.permissionOf(id) < required {
+		return nil, "", false
+	}
+	return namespace.data, sharedKey, true
+}
+
+// namespaceCommands are the client commands handled by namespaceCommand.
+var namespaceCommands = map[string]bool{
+	"CREATE": true,
+	"GRANT":  true,
+	"REVOKE": true,
+	"ACCESS": true,
+}
+
+// namespaceCommand carries out a command managing shared namespaces:
+//   - "CREATE [namespace]" creates a namespace owned by the client.
+//   - "GRANT [namespace] [fingerprint] [read|readwrite]" gives another client
+//     access to a namespace the client owns.
+//   - "REVOKE [namespace] [fingerprint]" removes another client's access.
+//   - "ACCESS [namespace]" lists the clients with access to a namespace.
+//
+// Returns the response to send to the client.
+func (s *server) namespaceCommand(
+	current *session,
+	command, argument string,
+) string {
+	arguments := strings.Fields(argument)
+	ok := false
+	payload := ""
+	switch {
+	case command == "CREATE" && len(arguments) == 1:
+		ok = s.store.createNamespace(current.id, arguments[0])
+	case command == "GRANT" && len(arguments) == 3:
+		access, valid := parsePermission(arguments[2])
+		ok = valid &&
+			s.store.grant(current.id, arguments[0], arguments[1], access)
+	case command == "REVOKE" && len(arguments) == 2:
+		ok = s.store.revoke(current.id, arguments[0], arguments[1])
+	case command == "ACCESS" && len(arguments) == 1:
+		lines := []string{}
+		lines, ok = s.store.access(current.id, arguments[0])
+		payload = strings.Join(lines, "\n")
+	}
+	s.metrics.command(command, ok)
+
+	if !ok {
+		current.log.info("Namespace command refused", "command", command)
+		return replyError(command, categoryDenied, "namespace command refused")
+	}
+	current.log.info("Namespace command", "command", command,
+		"argument", argument)
+	return reply(command, payload)
+}
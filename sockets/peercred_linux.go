@@ -0,0 +1,32 @@
+//go:build linux
+
+package sockets
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials asks the kernel which process is at the other end of a Unix
+// domain socket, using SO_PEERCRED.
+//
+// Returns the process's credentials and true if successful.
+func peerCredentials(connection *net.UnixConn) (credentials, bool) {
+	raw, err := connection.SyscallConn()
+	if err != nil {
+		return credentials{}, false
+	}
+	var ucred *syscall.Ucred
+	controlErr := raw.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if controlErr != nil || err != nil {
+		return credentials{}, false
+	}
+	return credentials{
+		uid: int(ucred.Uid),
+		gid: int(ucred.Gid),
+		pid: int(ucred.Pid),
+	}, true
+}
@@ -0,0 +1,443 @@
+package sockets
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CONNECT lets a client and server agree on a protocol version and a set of
+// optional capabilities:
+//   - A version 1 client sends "CONNECT [key]" and the server replies
+//     "CONNECT: [session key]", as in the original text protocol. No
+//     capabilities are used.
+//   - A later client sends "CONNECT [key] VERSIONS [versions] CAPABILITIES
+//     [capabilities]" and the server replies "CONNECT: [session key] VERSION
+//     [version] CAPABILITIES [capabilities]".
+//
+// Lists are comma separated. The server chooses the highest version both
+// sides support and every capability both sides support, ignoring names it
+// does not know, so clients may offer capabilities that only later servers
+// support, such as "batching", "streaming" or "subscriptions". If no version
+// is shared, the server replies "CONNECT: ERROR VERSION [versions]" with the
+// versions it supports and closes the connection.
+//
+// A version 1 server takes the whole offer as the client's key and replies
+// without a version, so a client that receives such a reply reconnects with a
+// bare CONNECT.
+//
+// Once pipelining is agreed, every message after CONNECT is sent as a frame
+// holding its length as a 4-byte big endian integer, followed by the message.
+// Each request starts with "#[id] ", where the ID is chosen by the client, and
+// its response starts with the same "#[id] ". Requests are carried out in the
+// order they arrive, and a PUT is still followed directly by its value, which
+// carries no ID.
+//
+// From version 4, keys are sent in the self-describing form produced by
+// PublicKeyToString. Servers before version 4 only read the RSA form produced
+// before it, so a client that is refused or agrees an older version
+// reconnects with that form, and a server agreeing an older version replies
+// with it.
+
+// Protocol versions.
+const (
+	protocolV1 = 1 // The original text protocol.
+	protocolV2 = 2 // The text protocol with negotiated capabilities.
+	protocolV3 = 3 // Responses are envelopes with status codes.
+	protocolV4 = 4 // Keys are self-describing.
+)
+
+// Capabilities a client may offer.
+const (
+	// capabilityCompression compresses every message encrypted with RSA
+	// with DEFLATE before encryption, so that longer responses fit in fewer
+	// RSA blocks.
+	capabilityCompression = "compression"
+
+	// capabilityPipelining frames every message and tags requests with IDs
+	// that their responses echo, so that a client may send requests without
+	// waiting for earlier responses. It needs version 3.
+	capabilityPipelining = "pipelining"
+)
+
+// maxPipelinedMessage is the largest framed message read, which leaves room
+// for the RSA encryption of a message decoding to four times
+// messageBufferSize bytes.
+const maxPipelinedMessage = 8 * messageBufferSize
+
+// supportedVersions are the protocol versions this program speaks, best
+// first.
+var supportedVersions = []int{protocolV4, protocolV3, protocolV2, protocolV1}
+
+// supportedCapabilities are the capabilities this program supports.
+var supportedCapabilities = map[string]bool{
+	capabilityCompression: true,
+	capabilityPipelining:  true,
+	capabilityKeyExchange: true,
+	capabilitySequencing:  true,
+}
+
+// protocol is the version and capabilities agreed for a connection. The zero
+// value is version 1 with no capabilities.
+type protocol struct {
+	version      int
+	capabilities []string // Sorted capability names.
+}
+
+// has checks whether a capability was agreed.
+func (p protocol) has(capability string) bool {
+	for _, agreed := range p.capabilities {
+		if agreed == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the protocol as shown to admins, e.g. "v2+compression".
+func (p protocol) String() string {
+	version := p.version
+	if version == 0 {
+		version = protocolV1
+	}
+	return strings.Join(append([]string{"v" + strconv.Itoa(version)},
+		p.capabilities...), "+")
+}
+
+// keyString converts a public key to the string form the agreed version
+// reads, which is the form produced before version 4 for RSA keys sent to
+// older clients.
+//
+// Returns the string.
+func (p protocol) keyString(publicKey crypto.PublicKey) string {
+	legacy := legacyRSAKeyString(publicKey)
+	if p.version < protocolV4 && legacy != "" {
+		return legacy
+	}
+	return PublicKeyToString(publicKey)
+}
+
+// encode prepares a message for RSA encryption, compressing it if agreed.
+//
+// Returns the encoded message.
+func (p protocol) encode(message string) string {
+	if !p.has(capabilityCompression) {
+		return message
+	}
+	compressed := bytes.Buffer{}
+	writer, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	writer.Write([]byte(message))
+	writer.Close()
+	return compressed.String()
+}
+
+// decode reverses encode on a message once it has been decrypted. The decoded
+// message may be up to four times messageBufferSize bytes long.
+//
+// Returns the decoded message and true if successful.
+func (p protocol) decode(message []byte) ([]byte, bool) {
+	if !p.has(capabilityCompression) {
+		return message, true
+	}
+	reader := flate.NewReader(bytes.NewReader(message))
+	defer reader.Close()
+	decoded, err := io.ReadAll(io.LimitReader(reader, 4*messageBufferSize+1))
+	if err != nil || len(decoded) > 4*messageBufferSize {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// writeMessage sends a message after CONNECT, framed if pipelining was agreed.
+//
+// Returns the number of bytes written, or an error.
+func (p protocol) writeMessage(connection net.Conn, message []byte) (int, error) {
+	if p.has(capabilityPipelining) {
+		message = append(binary.BigEndian.AppendUint32(nil,
+			uint32(len(message))), message...)
+	}
+	return connection.Write(message)
+}
+
+// readMessage reads a single message after CONNECT. Without pipelining, a
+// message is whatever a single read returns, up to messageBufferSize bytes.
+//
+// Returns the message, or an error.
+func (p protocol) readMessage(connection net.Conn) ([]byte, error) {
+	if !p.has(capabilityPipelining) {
+		buffer := make([]byte, messageBufferSize)
+		mLen, err := connection.Read(buffer)
+		return buffer[:mLen], err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(connection, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxPipelinedMessage {
+		return nil, errors.New("message too large")
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(connection, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// cutRequestID removes the "#[id] " a request or response starts with once
+// pipelining is agreed.
+//
+// Returns the ID, the rest of the message and true if it has an ID.
+func cutRequestID(message []byte) (string, []byte, bool) {
+	if len(message) == 0 || message[0] != '#' {
+		return "", message, false
+	}
+	id, rest, found := bytes.Cut(message[1:], []byte(" "))
+	if !found || len(id) == 0 || len(id) > 20 {
+		return "", message, false
+	}
+	for _, digit := range id {
+		if digit < '0' || digit > '9' {
+			return "", message, false
+		}
+	}
+	return string(id), rest, true
+}
+
+// connectOffer is a client's CONNECT message, after the command itself.
+type connectOffer struct {
+	id           string   // The client's public key.
+	versions     []int    // Versions the client speaks, or none for version 1.
+	capabilities []string // Capabilities the client supports.
+	keyShare     []byte   // The client's X25519 public key, if offered.
+}
+
+// parseConnect reads the argument of a CONNECT message.
+//
+// Returns the offer and true if it names a key and any versions are valid.
+func parseConnect(argument string) (connectOffer, bool) {
+	fields := strings.Fields(argument)
+	if len(fields) == 0 {
+		return connectOffer{}, false
+	}
+	offer := connectOffer{id: fields[0]}
+	for i := 1; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "VERSIONS":
+			for _, field := range strings.Split(fields[i+1], ",") {
+				version, err := strconv.Atoi(field)
+				if err != nil || version < 1 {
+					return connectOffer{}, false
+				}
+				offer.versions = append(offer.versions, version)
+			}
+		case "CAPABILITIES":
+			offer.capabilities = strings.Split(fields[i+1], ",")
+		case "KEYSHARE":
+			keyShare, err := hex.DecodeString(fields[i+1])
+			if err != nil {
+				return connectOffer{}, false
+			}
+			offer.keyShare = keyShare
+		}
+	}
+	return offer, true
+}
+
+// String builds the argument of a CONNECT message making the offer.
+func (offer connectOffer) String() string {
+	if len(offer.versions) == 0 {
+		return offer.id
+	}
+	versions := make([]string, len(offer.versions))
+	for i, version := range offer.versions {
+		versions[i] = strconv.Itoa(version)
+	}
+	message := offer.id + " VERSIONS " + strings.Join(versions, ",")
+	if len(offer.capabilities) > 0 {
+		message += " CAPABILITIES " + strings.Join(offer.capabilities, ",")
+	}
+	if len(offer.keyShare) > 0 {
+		message += " KEYSHARE " + hex.EncodeToString(offer.keyShare)
+	}
+	return message
+}
+
+// negotiate chooses the protocol for a client's offer.
+//
+// Returns the protocol and true if the client and server share a version.
+func negotiate(offer connectOffer) (protocol, bool) {
+	if len(offer.versions) == 0 {
+		return protocol{version: protocolV1}, true
+	}
+	agreed := protocol{}
+	for _, supported := range supportedVersions {
+		for _, offered := range offer.versions {
+			if offered == supported && agreed.version == 0 {
+				agreed.version = supported
+			}
+		}
+	}
+	if agreed.version == 0 {
+		return protocol{}, false
+	}
+	if agreed.version >= protocolV2 {
+		for _, capability := range offer.capabilities {
+			if capability == capabilityPipelining &&
+				agreed.version < protocolV3 {
+				continue
+			}
+			if capability == capabilityKeyExchange && len(offer.keyShare) == 0 {
+				continue
+			}
+			if supportedCapabilities[capability] && !agreed.has(capability) {
+				agreed.capabilities = append(agreed.capabilities, capability)
+			}
+		}
+		sort.Strings(agreed.capabilities)
+	}
+	return agreed, true
+}
+
+// connectReply builds the server's reply to CONNECT, in the form the client's
+// offer expects.
+//
+// Returns the reply.
+func connectReply(offer connectOffer, sessionKey string, agreed protocol) string {
+	if len(offer.versions) == 0 {
+		return "CONNECT: " + sessionKey
+	}
+	reply := "CONNECT: " + sessionKey + " VERSION " + strconv.Itoa(agreed.version)
+	if len(agreed.capabilities) > 0 {
+		reply += " CAPABILITIES " + strings.Join(agreed.capabilities, ",")
+	}
+	return reply
+}
+
+// versionError builds the reply to a CONNECT offering no supported version.
+//
+// Returns the reply.
+func versionError() string {
+	versions := make([]string, len(supportedVersions))
+	for i, version := range supportedVersions {
+		versions[i] = strconv.Itoa(version)
+	}
+	return "CONNECT: ERROR VERSION " + strings.Join(versions, ",")
+}
+
+// parseConnectReply reads a server's successful reply to CONNECT. A reply
+// without a version comes from a version 1 server.
+//
+// Returns the session key, the agreed protocol and true if the reply is valid.
+func parseConnectReply(reply string) (string, protocol, bool) {
+	fields := strings.Fields(reply)
+	if len(fields) < 2 || fields[0] != "CONNECT:" || fields[1] == "ERROR" {
+		return "", protocol{}, false
+	}
+	agreed := protocol{}
+	for i := 2; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "VERSION":
+			version, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return "", protocol{}, false
+			}
+			agreed.version = version
+		case "CAPABILITIES":
+			agreed.capabilities = strings.Split(fields[i+1], ",")
+			sort.Strings(agreed.capabilities)
+		}
+	}
+	return fields[1], agreed, true
+}
+
+// connectServer connects to the server at address, over TLS if the client was
+// configured to, and sends CONNECT with the client's identity key as its ID,
+// offering every supported version and capability and a key exchange signed
+// with the client's key. If the server is older than version 4, the client
+// reconnects with its key in the form that server reads, and if the server
+// only speaks version 1, with a bare CONNECT.
+//
+// Returns the connection, the server's reply, the session keys if a key
+// exchange was agreed and true if a valid reply was read.
+func connectServer(address string) (net.Conn, string, *sessionKeys, bool) {
+	offer := connectOffer{id: PublicKeyToString(clientPublicKey),
+		versions: supportedVersions}
+	legacyID := legacyRSAKeyString(clientPublicKey)
+	for capability := range supportedCapabilities {
+		offer.capabilities = append(offer.capabilities, capability)
+	}
+	sort.Strings(offer.capabilities)
+	offer, ephemeral, ok := offerKeyShare(offer)
+	if !ok {
+		return nil, "", nil, false
+	}
+
+	for {
+		connection, err := dialTransport(address, clientTLS)
+		if err != nil {
+			clientLog.error("Error connecting", "error", err)
+			return nil, "", nil, false
+		}
+		message := "CONNECT " + offer.String()
+		if len(offer.keyShare) > 0 {
+			message = signMessage(clientPrivateKey, message, message)
+		}
+		_, err = connection.Write([]byte(message))
+		buffer := make([]byte, messageBufferSize)
+		mLen := 0
+		if err == nil {
+			mLen, err = connection.Read(buffer)
+		}
+		if err != nil {
+			clientLog.error("Error during CONNECT", "error", err)
+			connection.Close()
+			return nil, "", nil, false
+		}
+		reply := string(buffer[:mLen])
+		_, agreed, ok := parseConnectReply(reply)
+		// A server before version 4 cannot read the ID, so it either refuses
+		// the signature or agrees an older version.
+		if offer.id != legacyID && (reply == "CONNECT: ERROR SIGNATURE" ||
+			ok && agreed.version < protocolV4) {
+			connection.Close()
+			if legacyID == "" {
+				clientLog.error("Server cannot read this type of key",
+					"type", keyType(clientPublicKey))
+				return nil, "", nil, false
+			}
+			clientLog.info("Server is older than protocol version 4, reconnecting")
+			offer.id = legacyID
+			offer.versions = supportedVersions[1:]
+			continue
+		}
+		if ok && agreed.has(capabilityKeyExchange) {
+			keys, ok := completeKeyExchange(ephemeral, message, reply,
+				address)
+			if !ok {
+				connection.Close()
+				return nil, "", nil, false
+			}
+			return connection, reply, keys, true
+		}
+		if ok && (agreed.version != 0 || len(offer.versions) == 0) &&
+			!allowUnauthenticatedServer(address) {
+			connection.Close()
+			return nil, "", nil, false
+		}
+		if !ok || agreed.version != 0 || len(offer.versions) == 0 {
+			return connection, reply, nil, true
+		}
+		clientLog.info("Server only speaks protocol version 1, reconnecting")
+		connection.Close()
+		offer = connectOffer{id: offer.id}
+	}
+}
@@ -0,0 +1,1052 @@
+package sockets
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Servers in a Raft group order every command that reads or changes the store
+// through a replicated log, following the Raft consensus algorithm. The group
+// elects a leader, which appends each client command to its log and sends it
+// to the other nodes. A command is carried out once a majority of the nodes
+// hold it, so an acknowledged write survives the loss of any minority of the
+// nodes and every read sees the writes acknowledged before it. Nodes that are
+// not the leader refuse commands as NOT_LEADER, naming the leader if known.
+//
+// Nodes compact their logs into snapshots of the store, which are sent to
+// nodes that fall too far behind. Nodes are added to and removed from the
+// group one at a time, with the new membership taking effect as soon as it is
+// appended to a node's log.
+
+// raftRole is the part a node currently plays in its group.
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+// raftRoleNames are the names of the roles shown in logs and to admins.
+var raftRoleNames = []string{"follower", "candidate", "leader"}
+
+const (
+	// raftHeartbeatInterval is how often a leader sends entries, or empty
+	// appends when it has none, to each node.
+	raftHeartbeatInterval = 200 * time.Millisecond
+
+	// raftElectionTimeout is the shortest time a follower waits to hear from a
+	// leader before starting an election. Each wait is chosen at random
+	// between one and two timeouts, so that nodes rarely stand at once.
+	raftElectionTimeout = time.Second
+
+	// raftProposalTimeout is how long a command waits to be committed.
+	raftProposalTimeout = 5 * time.Second
+
+	// raftSnapshotThreshold is the number of applied entries after which a
+	// node replaces its log with a snapshot.
+	raftSnapshotThreshold = 1024
+
+	// raftBatchSize is the largest number of bytes of entries, or of a
+	// snapshot, sent to a node in one message.
+	raftBatchSize = 64 << 10
+)
+
+// Kinds of log entry.
+const (
+	raftEntryCommand = "command" // A client command to carry out.
+	raftEntryNoop    = "noop"    // Appended by a new leader to commit older entries.
+	raftEntryConfig  = "config"  // A change to the group's membership.
+)
+
+// Types of message sent between nodes. A reply has the type of its request.
+const (
+	raftVote     = "vote"     // A candidate asks for a node's vote.
+	raftAppend   = "append"   // The leader sends entries, or a heartbeat.
+	raftSnapshot = "snapshot" // The leader sends part of a snapshot.
+)
+
+// raftEntry is a single entry in a node's log.
+type raftEntry struct {
+	Index    uint64   `json:"index"`
+	Term     uint64   `json:"term"`
+	Kind     string   `json:"kind"`
+	Client   string   `json:"client,omitempty"`   // ID of the client sending a command.
+	Command  string   `json:"command,omitempty"`  // The command, such as "PUT".
+	Argument string   `json:"argument,omitempty"` // The rest of the command.
+	Value    []byte   `json:"value,omitempty"`    // The value of a PUT.
+	Nodes    []string `json:"nodes,omitempty"`    // The group's members after a config change.
+}
+
+// raftMessage is a request sent from one node to another, or its reply.
+type raftMessage struct {
+	Type    string `json:"type"`
+	Term    uint64 `json:"term"`
+	From    string `json:"from,omitempty"` // Address of the sending node.
+	Success bool   `json:"success,omitempty"`
+
+	// LastIndex and LastTerm describe the end of a candidate's log. In the
+	// reply to an append, LastIndex is the index the leader should send
+	// entries after next.
+	LastIndex uint64 `json:"last_index,omitempty"`
+	LastTerm  uint64 `json:"last_term,omitempty"`
+
+	// PrevIndex and PrevTerm identify the entry preceding the entries of an
+	// append, or the last entry included in a snapshot.
+	PrevIndex uint64      `json:"prev_index,omitempty"`
+	PrevTerm  uint64      `json:"prev_term,omitempty"`
+	Entries   []raftEntry `json:"entries,omitempty"`
+	Commit    uint64      `json:"commit,omitempty"` // The leader's commit index.
+
+	// Offset, Data and Done carry part of a snapshot, along with the group's
+	// members as of the snapshot.
+	Offset uint64   `json:"offset,omitempty"`
+	Data   []byte   `json:"data,omitempty"`
+	Done   bool     `json:"done,omitempty"`
+	Nodes  []string `json:"nodes,omitempty"`
+}
+
+// raftTransport sends messages from one node to the other nodes of its group.
+type raftTransport interface {
+	// send delivers a request to the node at address.
+	//
+	// Returns the node's reply and true if successful.
+	send(address string, message raftMessage) (raftMessage, bool)
+}
+
+// raftMachine is the state that a Raft group keeps consistent by applying the
+// same commands in the same order on every node.
+type raftMachine interface {
+	// apply carries out a committed command.
+	//
+	// Returns the response to send to the client.
+	apply(entry raftEntry) string
+
+	// snapshot encodes the whole state.
+	snapshot() []byte
+
+	// restore replaces the state with one encoded by snapshot.
+	restore(data []byte)
+}
+
+// raftStatus describes a node to admins.
+type raftStatus struct {
+	Role     string
+	Term     uint64
+	Leader   string
+	Commit   uint64
+	Applied  uint64
+	Snapshot uint64 // Index of the last entry included in the snapshot.
+	Nodes    []string
+}
+
+// raftWaiter is a command waiting to be committed.
+type raftWaiter struct {
+	term   uint64      // The term the command was appended in.
+	result chan string // Receives the response once the command is applied.
+}
+
+// raftNode is a single member of a Raft group.
+type raftNode struct {
+	mutex     sync.Mutex
+	address   string // Identifies the node to the rest of its group.
+	transport raftTransport
+	machine   raftMachine
+	storage   *raftStorage // Keeps the node's state on disk, if set.
+	log       *logger
+
+	role raftRole
+
+	// State kept in storage.
+	term     uint64
+	votedFor string
+	entries  []raftEntry // The log after the snapshot.
+
+	// The latest snapshot, replacing every entry up to snapshotIndex.
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshotNodes []string
+	snapshotData  []byte
+	receiving     []byte // A snapshot being received from the leader.
+
+	initialNodes []string // The members before any config change.
+	nodes        []string // The members according to the latest config.
+	configIndex  uint64   // Index of the latest config entry.
+
+	leader      string    // Address of the current leader, if known.
+	lastContact time.Time // When the leader was last heard from.
+	deadline    time.Time // When to start an election.
+	commitIndex uint64
+	lastApplied uint64
+
+	// Leader state.
+	nextIndex      map[string]uint64        // Next entry to send to each node.
+	matchIndex     map[string]uint64        // Latest entry known to be held by each node.
+	snapshotOffset map[string]uint64        // Bytes of the snapshot sent to each node.
+	notify         map[string]chan struct{} // Wakes the goroutine sending to each node.
+
+	waiting map[uint64]raftWaiter // Commands waiting to be committed, by index.
+	applied chan struct{}         // Wakes the goroutine applying entries.
+	stopped chan struct{}         // Closed when the node stops.
+
+	heartbeat       time.Duration
+	electionTimeout time.Duration
+}
+
+// newRaftNode creates a node with the given address in a group initially made
+// up of the given nodes. A node that is not one of them waits to be added to
+// the group. If storage is set, the node's state is read from it and every
+// change is written to it.
+//
+// Returns a pointer to the running node and true if its state could be read.
+func newRaftNode(
+	address string,
+	nodes []string,
+	transport raftTransport,
+	machine raftMachine,
+	storage *raftStorage,
+	log *logger,
+) (*raftNode, bool) {
+	n := &raftNode{
+		address:         address,
+		transport:       transport,
+		machine:         machine,
+		storage:         storage,
+		log:             log.with("raft", address),
+		initialNodes:    nodes,
+		waiting:         map[uint64]raftWaiter{},
+		applied:         make(chan struct{}, 1),
+		stopped:         make(chan struct{}),
+		heartbeat:       raftHeartbeatInterval,
+		electionTimeout: raftElectionTimeout,
+	}
+	if storage != nil {
+		state, ok := storage.load()
+		if !ok {
+			return nil, false
+		}
+		n.term, n.votedFor, n.entries = state.Term, state.VotedFor, state.Entries
+		n.snapshotIndex, n.snapshotTerm = state.SnapshotIndex, state.SnapshotTerm
+		n.snapshotNodes, n.snapshotData = state.SnapshotNodes, state.SnapshotData
+		if n.snapshotIndex > 0 {
+			machine.restore(n.snapshotData)
+			n.commitIndex, n.lastApplied = n.snapshotIndex, n.snapshotIndex
+		}
+	}
+	n.updateNodes()
+	n.resetDeadline()
+	go n.run()
+	go n.applyEntries()
+	n.log.info("Raft node started", "term", n.term,
+		"last_index", n.lastIndex(), "nodes", n.nodes)
+	return n, true
+}
+
+// stop halts the node's goroutines. The node stops sending messages, though
+// it still answers those it receives.
+func (n *raftNode) stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	select {
+	case <-n.stopped:
+	default:
+		close(n.stopped)
+	}
+}
+
+// status describes the node's role and progress.
+//
+// Returns the node's status.
+func (n *raftNode) status() raftStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return raftStatus{
+		Role:     raftRoleNames[n.role],
+		Term:     n.term,
+		Leader:   n.leader,
+		Commit:   n.commitIndex,
+		Applied:  n.lastApplied,
+		Snapshot: n.snapshotIndex,
+		Nodes:    append([]string{}, n.nodes...),
+	}
+}
+
+// lastIndex returns the index of the node's latest entry. The caller must hold
+// the node's mutex.
+func (n *raftNode) lastIndex() uint64 {
+	return n.snapshotIndex + uint64(len(n.entries))
+}
+
+// lastTerm returns the term of the node's latest entry. The caller must hold
+// the node's mutex.
+func (n *raftNode) lastTerm() uint64 {
+	if len(n.entries) == 0 {
+		return n.snapshotTerm
+	}
+	return n.entries[len(n.entries)-1].Term
+}
+
+// entry returns the entry at index, which must come after the snapshot and be
+// no later than the latest entry. The caller must hold the node's mutex.
+func (n *raftNode) entry(index uint64) raftEntry {
+	return n.entries[index-n.snapshotIndex-1]
+}
+
+// termAt looks up the term of the entry at index. The caller must hold the
+// node's mutex.
+//
+// Returns the term and false if the entry is not in the log or the snapshot.
+func (n *raftNode) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == n.snapshotIndex:
+		return n.snapshotTerm, true
+	case index < n.snapshotIndex || index > n.lastIndex():
+		return 0, false
+	}
+	return n.entry(index).Term, true
+}
+
+// isMember checks whether the node at address belongs to the group. The caller
+// must hold the node's mutex.
+func (n *raftNode) isMember(address string) bool {
+	for _, node := range n.nodes {
+		if node == address {
+			return true
+		}
+	}
+	return false
+}
+
+// peers returns the addresses of the other members of the group. The caller
+// must hold the node's mutex.
+func (n *raftNode) peers() []string {
+	peers := []string{}
+	for _, node := range n.nodes {
+		if node != n.address {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+// quorum returns the number of members forming a majority of the group. The
+// caller must hold the node's mutex.
+func (n *raftNode) quorum() int {
+	return len(n.nodes)/2 + 1
+}
+
+// configAt finds the members of the group as of the entry at index, which must
+// be no earlier than the snapshot. The caller must hold the node's mutex.
+//
+// Returns the members and the index of the config entry naming them.
+func (n *raftNode) configAt(index uint64) ([]string, uint64) {
+	for i := index; i > n.snapshotIndex; i-- {
+		if entry := n.entry(i); entry.Kind == raftEntryConfig {
+			return entry.Nodes, i
+		}
+	}
+	if n.snapshotIndex > 0 && n.snapshotNodes != nil {
+		return n.snapshotNodes, n.snapshotIndex
+	}
+	return n.initialNodes, 0
+}
+
+// updateNodes takes the group's members from the latest config entry. A leader
+// starts sending entries to any new members. The caller must hold the node's
+// mutex.
+func (n *raftNode) updateNodes() {
+	n.nodes, n.configIndex = n.configAt(n.lastIndex())
+	if n.role == raftLeader {
+		n.startReplication()
+	}
+}
+
+// resetDeadline chooses when to start the next election. The caller must hold
+// the node's mutex.
+func (n *raftNode) resetDeadline() {
+	wait := n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout)))
+	n.deadline = time.Now().Add(wait)
+}
+
+// run starts an election whenever the node has not heard from a leader before
+// its deadline, until the node stops.
+func (n *raftNode) run() {
+	ticker := time.NewTicker(n.heartbeat / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-ticker.C:
+		}
+		n.mutex.Lock()
+		if n.role != raftLeader && time.Now().After(n.deadline) &&
+			n.isMember(n.address) {
+			n.startElection()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// startElection makes the node a candidate in a new term and asks the other
+// members for their votes. The caller must hold the node's mutex.
+func (n *raftNode) startElection() {
+	n.role = raftCandidate
+	n.term++
+	n.votedFor = n.address
+	n.leader = ""
+	n.persistState()
+	n.resetDeadline()
+	n.log.info("Starting election", "term", n.term)
+
+	term := n.term
+	request := raftMessage{
+		Type:      raftVote,
+		Term:      term,
+		From:      n.address,
+		LastIndex: n.lastIndex(),
+		LastTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers() {
+		go func(peer string) {
+			reply, ok := n.transport.send(peer, request)
+			if !ok {
+				return
+			}
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if reply.Term > n.term {
+				n.stepDown(reply.Term)
+				return
+			}
+			if n.role != raftCandidate || n.term != term || !reply.Success {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader makes a candidate that won its election the leader and appends
+// an empty entry, which commits any entries left by earlier leaders. The
+// caller must hold the node's mutex.
+func (n *raftNode) becomeLeader() {
+	n.role = raftLeader
+	n.leader = n.address
+	n.nextIndex = map[string]uint64{}
+	n.matchIndex = map[string]uint64{}
+	n.snapshotOffset = map[string]uint64{}
+	n.notify = map[string]chan struct{}{}
+	n.log.info("Elected leader", "term", n.term)
+	n.startReplication()
+	n.appendEntry(raftEntry{Kind: raftEntryNoop})
+	n.advanceCommit()
+}
+
+// stepDown makes the node a follower, moving it to the given term if that is
+// later than its own. The caller must hold the node's mutex.
+func (n *raftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		n.persistState()
+	}
+	if n.role == raftLeader {
+		n.log.info("Stepped down as leader", "term", n.term)
+	}
+	n.role = raftFollower
+	n.resetDeadline()
+}
+
+// appendEntry adds an entry to a leader's log in the current term. The caller
+// must hold the node's mutex.
+//
+// Returns the entry's index.
+func (n *raftNode) appendEntry(entry raftEntry) uint64 {
+	entry.Index = n.lastIndex() + 1
+	entry.Term = n.term
+	n.entries = append(n.entries, entry)
+	n.persistEntries([]raftEntry{entry})
+	if entry.Kind == raftEntryConfig {
+		n.updateNodes()
+	}
+	n.wakeReplication()
+	return entry.Index
+}
+
+// propose appends a client command to the leader's log and waits for it to be
+// committed and applied.
+//
+// Returns the response from applying the command and true if successful.
+// Otherwise returns "NOTLEADER" followed by the leader's address, if known,
+// when this node is not the leader, or an empty string when the command could
+// not be committed in time.
+func (n *raftNode) propose(entry raftEntry) (string, bool) {
+	entry.Kind = raftEntryCommand
+	return n.proposeEntry(entry)
+}
+
+// changeMembers proposes adding a node to the group, or removing one from it.
+// Only one change may be in progress at a time.
+//
+// Returns the new members and true once the change is committed, otherwise
+// the same reasons as propose.
+func (n *raftNode) changeMembers(address string, add bool) (string, bool) {
+	n.mutex.Lock()
+	if n.role == raftLeader && n.configIndex > n.commitIndex {
+		n.mutex.Unlock()
+		return "", false
+	}
+	nodes := []string{}
+	for _, node := range n.nodes {
+		if node != address {
+			nodes = append(nodes, node)
+		}
+	}
+	if add {
+		nodes = append(nodes, address)
+	}
+	n.mutex.Unlock()
+
+	response, ok := n.proposeEntry(raftEntry{Kind: raftEntryConfig, Nodes: nodes})
+	if !ok {
+		return response, false
+	}
+	return strings.Join(nodes, " "), true
+}
+
+// proposeEntry carries out propose for any kind of entry.
+func (n *raftNode) proposeEntry(entry raftEntry) (string, bool) {
+	n.mutex.Lock()
+	if n.role != raftLeader {
+		reason := "NOTLEADER"
+		if n.leader != "" {
+			reason += " " + n.leader
+		}
+		n.mutex.Unlock()
+		return reason, false
+	}
+	index := n.appendEntry(entry)
+	waiter := raftWaiter{term: n.term, result: make(chan string, 1)}
+	n.waiting[index] = waiter
+	n.advanceCommit()
+	n.mutex.Unlock()
+
+	select {
+	case response, ok := <-waiter.result:
+		return response, ok
+	case <-time.After(raftProposalTimeout):
+		n.mutex.Lock()
+		delete(n.waiting, index)
+		n.mutex.Unlock()
+		return "", false
+	}
+}
+
+// startReplication starts a goroutine sending entries to each member that a
+// leader is not yet sending to. The caller must hold the node's mutex.
+func (n *raftNode) startReplication() {
+	for _, peer := range n.peers() {
+		if _, started := n.notify[peer]; started {
+			continue
+		}
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.notify[peer] = make(chan struct{}, 1)
+		go n.replicate(peer, n.term, n.notify[peer])
+	}
+}
+
+// wakeReplication tells every goroutine sending entries that there are new
+// ones. The caller must hold the node's mutex.
+func (n *raftNode) wakeReplication() {
+	for _, notify := range n.notify {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends entries to the member at address for as long as this node
+// leads the group in the given term, waking whenever there are new entries or
+// a heartbeat is due.
+func (n *raftNode) replicate(peer string, term uint64, notify chan struct{}) {
+	for {
+		n.mutex.Lock()
+		if n.role != raftLeader || n.term != term || !n.isMember(peer) {
+			if n.notify[peer] == notify {
+				delete(n.notify, peer)
+			}
+			n.mutex.Unlock()
+			return
+		}
+		request := n.appendRequest(peer)
+		n.mutex.Unlock()
+
+		reply, ok := n.transport.send(peer, request)
+		if ok && n.handleReply(peer, term, request, reply) {
+			continue
+		}
+		select {
+		case <-notify:
+		case <-time.After(n.heartbeat):
+		case <-n.stopped:
+			return
+		}
+	}
+}
+
+// appendRequest builds the next message for a leader to send to a member:
+// part of the snapshot if the member needs entries that have been compacted,
+// otherwise the entries it does not yet hold. The caller must hold the node's
+// mutex.
+//
+// Returns the message.
+func (n *raftNode) appendRequest(peer string) raftMessage {
+	next := n.nextIndex[peer]
+	if next <= n.snapshotIndex {
+		offset := n.snapshotOffset[peer]
+		if offset > uint64(len(n.snapshotData)) {
+			offset = 0
+		}
+		end := offset + raftBatchSize
+		if end > uint64(len(n.snapshotData)) {
+			end = uint64(len(n.snapshotData))
+		}
+		return raftMessage{
+			Type:      raftSnapshot,
+			Term:      n.term,
+			From:      n.address,
+			PrevIndex: n.snapshotIndex,
+			PrevTerm:  n.snapshotTerm,
+			Offset:    offset,
+			Data:      n.snapshotData[offset:end],
+			Done:      end == uint64(len(n.snapshotData)),
+			Nodes:     n.snapshotNodes,
+		}
+	}
+
+	prevTerm, _ := n.termAt(next - 1)
+	request := raftMessage{
+		Type:      raftAppend,
+		Term:      n.term,
+		From:      n.address,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Commit:    n.commitIndex,
+	}
+	size := 0
+	for index := next; index <= n.lastIndex() && size < raftBatchSize; index++ {
+		entry := n.entry(index)
+		request.Entries = append(request.Entries, entry)
+		size += len(entry.Argument) + len(entry.Value) + len(entry.Client)
+	}
+	return request
+}
+
+// handleReply updates a leader's progress for a member from the member's reply
+// to a request.
+//
+// Returns true if there is more to send to the member straight away.
+func (n *raftNode) handleReply(
+	peer string,
+	term uint64,
+	request, reply raftMessage,
+) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return false
+	}
+	if n.role != raftLeader || n.term != term {
+		return false
+	}
+
+	if request.Type == raftSnapshot {
+		if !reply.Success || request.PrevIndex != n.snapshotIndex {
+			n.snapshotOffset[peer] = 0
+			return false
+		}
+		n.snapshotOffset[peer] = request.Offset + uint64(len(request.Data))
+		if request.Done {
+			n.snapshotOffset[peer] = 0
+			n.nextIndex[peer] = request.PrevIndex + 1
+			n.matchIndex[peer] = request.PrevIndex
+			n.log.info("Sent snapshot", "node", peer,
+				"index", request.PrevIndex)
+			n.advanceCommit()
+		}
+		return true
+	}
+
+	if !reply.Success {
+		next := reply.LastIndex + 1
+		if next > request.PrevIndex {
+			next = request.PrevIndex
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[peer] = next
+		return true
+	}
+	match := request.PrevIndex + uint64(len(request.Entries))
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+	}
+	n.nextIndex[peer] = match + 1
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// advanceCommit commits the latest entry of the leader's term that a majority
+// of the members hold, along with every entry before it. A leader that has
+// committed its own removal from the group steps down. The caller must hold
+// the node's mutex.
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+		held := 0
+		for _, node := range n.nodes {
+			if node == n.address || n.matchIndex[node] >= index {
+				held++
+			}
+		}
+		if held >= n.quorum() {
+			n.commitIndex = index
+			n.wakeApplier()
+			n.wakeReplication()
+			break
+		}
+	}
+	if n.role == raftLeader && !n.isMember(n.address) &&
+		n.configIndex <= n.commitIndex {
+		n.log.info("Removed from the group")
+		n.stepDown(n.term)
+		n.leader = ""
+	}
+}
+
+// wakeApplier tells the goroutine applying entries that more are committed.
+// The caller must hold the node's mutex.
+func (n *raftNode) wakeApplier() {
+	select {
+	case n.applied <- struct{}{}:
+	default:
+	}
+}
+
+// applyEntries applies committed entries to the node's state in order, and
+// restores received snapshots, until the node stops. The response from
+// applying a command is handed to the proposal waiting for it, if any.
+func (n *raftNode) applyEntries() {
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-n.applied:
+		}
+		for n.applyNext() {
+		}
+	}
+}
+
+// applyNext applies the next committed entry, or the latest snapshot if it is
+// ahead of the state, and compacts the log once enough entries are applied.
+//
+// Returns false if there is nothing to apply.
+func (n *raftNode) applyNext() bool {
+	n.mutex.Lock()
+	if n.lastApplied < n.snapshotIndex {
+		index, data := n.snapshotIndex, n.snapshotData
+		n.mutex.Unlock()
+		n.machine.restore(data)
+		n.mutex.Lock()
+		if index > n.lastApplied {
+			n.lastApplied = index
+		}
+		n.mutex.Unlock()
+		n.log.info("Restored snapshot", "index", index)
+		return true
+	}
+	if n.lastApplied >= n.commitIndex {
+		n.mutex.Unlock()
+		return false
+	}
+	entry := n.entry(n.lastApplied + 1)
+	n.mutex.Unlock()
+
+	response := ""
+	if entry.Kind == raftEntryCommand {
+		response = n.machine.apply(entry)
+	}
+
+	n.mutex.Lock()
+	if entry.Index > n.lastApplied {
+		n.lastApplied = entry.Index
+	}
+	if waiter, exists := n.waiting[entry.Index]; exists {
+		delete(n.waiting, entry.Index)
+		if waiter.term == entry.Term {
+			waiter.result <- response
+		} else {
+			close(waiter.result)
+		}
+	}
+	compact := n.lastApplied-n.snapshotIndex >= raftSnapshotThreshold
+	n.mutex.Unlock()
+
+	if compact {
+		n.compact()
+	}
+	return true
+}
+
+// compact replaces the applied entries of the log with a snapshot of the
+// node's state. It must only be called by the goroutine applying entries, so
+// that the state matches the last applied entry.
+func (n *raftNode) compact() {
+	data := n.machine.snapshot()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	index := n.lastApplied
+	if index <= n.snapshotIndex {
+		return
+	}
+	n.snapshotTerm, _ = n.termAt(index)
+	n.snapshotNodes, _ = n.configAt(index)
+	n.entries = append([]raftEntry{}, n.entries[index-n.snapshotIndex:]...)
+	n.snapshotIndex = index
+	n.snapshotData = data
+	n.persistSnapshot()
+	n.log.debug("Compacted log", "index", index, "bytes", len(data))
+}
+
+// handle answers a message from another node.
+//
+// Returns the reply.
+func (n *raftNode) handle(message raftMessage) raftMessage {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// A leader, and a node that has heard from its leader recently, ignore
+	// candidates, so that nodes removed from the group cannot disrupt it.
+	leading := n.role == raftLeader ||
+		(n.leader != "" && time.Since(n.lastContact) < n.electionTimeout)
+	if message.Type == raftVote && leading {
+		return raftMessage{Type: raftVote, Term: n.term}
+	}
+	if message.Term > n.term {
+		n.stepDown(message.Term)
+	}
+	switch message.Type {
+	case raftVote:
+		return n.handleVote(message)
+	case raftAppend:
+		return n.handleAppend(message)
+	case raftSnapshot:
+		return n.handleSnapshot(message)
+	}
+	return raftMessage{Type: message.Type, Term: n.term}
+}
+
+// handleVote grants a candidate this node's vote if the node has not voted for
+// another candidate in the term and the candidate's log is at least as recent
+// as its own. The caller must hold the node's mutex.
+//
+// Returns the reply.
+func (n *raftNode) handleVote(message raftMessage) raftMessage {
+	reply := raftMessage{Type: raftVote, Term: n.term}
+	if message.Term < n.term {
+		return reply
+	}
+	upToDate := message.LastTerm > n.lastTerm() ||
+		(message.LastTerm == n.lastTerm() && message.LastIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == message.From) && upToDate {
+		n.votedFor = message.From
+		n.persistState()
+		n.resetDeadline()
+		reply.Success = true
+	}
+	return reply
+}
+
+// followLeader records that the sender of a message from the current term is
+// the leader. The caller must hold the node's mutex.
+func (n *raftNode) followLeader(message raftMessage) {
+	if n.role != raftFollower {
+		n.stepDown(message.Term)
+	}
+	if n.leader != message.From {
+		n.log.info("Following leader", "leader", message.From,
+			"term", message.Term)
+	}
+	n.leader = message.From
+	n.lastContact = time.Now()
+	n.resetDeadline()
+}
+
+// handleAppend stores the entries sent by the leader if the node's log holds
+// the entry preceding them, replacing any conflicting entries. The caller
+// must hold the node's mutex.
+//
+// Returns the reply, which names the index to continue from on failure.
+func (n *raftNode) handleAppend(message raftMessage) raftMessage {
+	reply := raftMessage{Type: raftAppend, Term: n.term}
+	if message.Term < n.term {
+		return reply
+	}
+	n.followLeader(message)
+
+	lastNew := message.PrevIndex + uint64(len(message.Entries))
+	prevIndex, prevTerm, entries := message.PrevIndex, message.PrevTerm, message.Entries
+	if prevIndex < n.snapshotIndex {
+		// Entries up to the snapshot are already committed.
+		skip := n.snapshotIndex - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+		prevIndex, prevTerm = n.snapshotIndex, n.snapshotTerm
+	}
+	if prevIndex > n.lastIndex() {
+		reply.LastIndex = n.lastIndex()
+		return reply
+	}
+	if term, _ := n.termAt(prevIndex); term != prevTerm {
+		// Skip back over the conflicting term in one step.
+		first := prevIndex
+		for first-1 > n.snapshotIndex {
+			if earlier, _ := n.termAt(first - 1); earlier != term {
+				break
+			}
+			first--
+		}
+		reply.LastIndex = first - 1
+		return reply
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() {
+			if term, _ := n.termAt(entry.Index); term == entry.Term {
+				continue
+			}
+			n.entries = n.entries[:entry.Index-n.snapshotIndex-1]
+			n.persistLog()
+		}
+		n.entries = append(n.entries, entries[i:]...)
+		n.persistEntries(entries[i:])
+		n.updateNodes()
+		break
+	}
+
+	if message.Commit > n.commitIndex {
+		n.commitIndex = message.Commit
+		if lastNew < n.commitIndex {
+			n.commitIndex = lastNew
+		}
+		n.wakeApplier()
+	}
+	reply.Success = true
+	reply.LastIndex = n.lastIndex()
+	return reply
+}
+
+// handleSnapshot collects the parts of a snapshot sent by the leader. Once the
+// last part arrives the snapshot replaces the log up to the entry it includes,
+// and is restored if the node's state is behind it. The caller must hold the
+// node's mutex.
+//
+// Returns the reply.
+func (n *raftNode) handleSnapshot(message raftMessage) raftMessage {
+	reply := raftMessage{Type: raftSnapshot, Term: n.term}
+	if message.Term < n.term {
+		return reply
+	}
+	n.followLeader(message)
+
+	if message.Offset == 0 {
+		n.receiving = nil
+	}
+	if message.Offset != uint64(len(n.receiving)) {
+		return reply
+	}
+	n.receiving = append(n.receiving, message.Data...)
+	reply.Success = true
+	if !message.Done {
+		return reply
+	}
+	data := n.receiving
+	n.receiving = nil
+	if message.PrevIndex <= n.snapshotIndex {
+		return reply
+	}
+
+	// Entries following the snapshot are kept if the log agrees with it.
+	if term, ok := n.termAt(message.PrevIndex); ok && term == message.PrevTerm {
+		n.entries = append([]raftEntry{},
+			n.entries[message.PrevIndex-n.snapshotIndex:]...)
+	} else {
+		n.entries = nil
+	}
+	n.snapshotIndex, n.snapshotTerm = message.PrevIndex, message.PrevTerm
+	n.snapshotNodes, n.snapshotData = message.Nodes, data
+	n.persistSnapshot()
+	n.updateNodes()
+	if n.commitIndex < n.snapshotIndex {
+		n.commitIndex = n.snapshotIndex
+	}
+	n.wakeApplier()
+	n.log.info("Received snapshot", "index", n.snapshotIndex,
+		"bytes", len(data))
+	return reply
+}
+
+// persistState writes the node's term and vote to its storage, if any. The
+// caller must hold the node's mutex.
+func (n *raftNode) persistState() {
+	if n.storage != nil {
+		n.storage.saveState(n.term, n.votedFor)
+	}
+}
+
+// persistEntries adds new entries to the end of the node's stored log, if
+// any. The caller must hold the node's mutex.
+func (n *raftNode) persistEntries(entries []raftEntry) {
+	if n.storage != nil {
+		n.storage.appendEntries(entries)
+	}
+}
+
+// persistLog replaces the node's stored log, if any, after entries have been
+// removed from it. The caller must hold the node's mutex.
+func (n *raftNode) persistLog() {
+	if n.storage != nil {
+		n.storage.saveEntries(n.entries)
+	}
+}
+
+// persistSnapshot writes the node's snapshot and the entries following it to
+// its storage, if any. The caller must hold the node's mutex.
+func (n *raftNode) persistSnapshot() {
+	if n.storage != nil {
+		n.storage.saveSnapshot(n.snapshotIndex, n.snapshotTerm,
+			n.snapshotNodes, n.snapshotData)
+		n.storage.saveEntries(n.entries)
+	}
+}
@@ -0,0 +1,645 @@
+package sockets
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nodes of a Raft group talk to each other over the same authenticated channel
+// as clients, using their own RSA identities. A node sends "RAFT" and, once
+// the other node answers "RAFT: READY", exchanges one frame per message and
+// reply over the connection for as long as it stays open.
+
+// raftCommands are the client commands a Raft group orders through its log.
+// Reads are ordered too, so that they see every write committed before them.
+var raftCommands = map[string]bool{
+	"GET":     true,
+	"PUT":     true,
+	"DELETE":  true,
+	"SHARE":   true,
+	"UNSHARE": true,
+	"PUBKEY":  true,
+	"GROUP":   true,
+	"CREATE":  true,
+	"GRANT":   true,
+	"REVOKE":  true,
+	"ACCESS":  true,
+}
+
+// raftMessageTimeout is how long a node waits for another node to answer a
+// message.
+const raftMessageTimeout = 2 * time.Second
+
+// storeMachine applies the commands committed by a Raft group to a server's
+// store.
+type storeMachine struct {
+	server *server
+}
+
+// apply carries out a committed client command. CONNECT and DISCONNECT
+// register and remove clients, while other commands are carried out as if
+// the client had sent them to a server of its own.
+//
+// Returns the response to send to the client.
+func (m storeMachine) apply(entry raftEntry) string {
+	s := m.server
+	switch entry.Command {
+	case "CONNECT":
+		s.store.connect(entry.Client, nil)
+		return reply("CONNECT", "")
+	case "DISCONNECT":
+		s.store.disconnect(entry.Client)
+		return reply("DISCONNECT", "")
+	}
+	current := &session{
+		id:  entry.Client,
+		log: s.log.with("raft_index", entry.Index),
+	}
+	return s.executeCommand(current, entry.Command, entry.Argument, entry.Value)
+}
+
+// snapshot encodes the whole store as the changes that rebuild it.
+//
+// Returns the encoded store.
+func (m storeMachine) snapshot() []byte {
+	encoded, err := json.Marshal(m.server.store.fullSync())
+	if err != nil {
+		m.server.log.error("Error encoding snapshot", "error", err)
+	}
+	return encoded
+}
+
+// restore replaces the store with one encoded by snapshot.
+func (m storeMachine) restore(data []byte) {
+	changes := []mutation{}
+	if err := json.Unmarshal(data, &changes); err != nil {
+		m.server.log.error("Error decoding snapshot", "error", err)
+		return
+	}
+	for _, change := range changes {
+		m.server.store.apply(change, false)
+	}
+}
+
+// executeCommand carries out a client command that reads or changes the store.
+//
+// Returns the response to send to the client.
+func (s *server) executeCommand(
+	current *session,
+	command, argument string,
+	value []byte,
+) string {
+	switch {
+	case command == "GET":
+		return s.getCommand(current, argument)
+	case command == "PUT":
+		return s.putCommand(current, argument, value)
+	case command == "DELETE":
+		return s.deleteCommand(current, argument)
+	case command == "SHARE":
+		return s.shareCommand(current, argument)
+	case command == "UNSHARE":
+		return s.unshareCommand(current, argument)
+	case command == "PUBKEY":
+		return s.publicKeyCommand(current, argument)
+	case command == "GROUP":
+		return s.groupCommand(current, argument)
+	case namespaceCommands[command]:
+		return s.namespaceCommand(current, command, argument)
+	case command == "KEYS":
+		return s.keysCommand(current, argument)
+	case command == "EXPIRE":
+		return s.expireCommand(current, argument)
+	case command == "ITEM":
+		return s.itemCommand(current, argument)
+	case command == "SETITEM":
+		return s.setItemCommand(current, argument, value)
+	case command == "INCR" || command == "DECR":
+		return s.incrementCommand(current, command, argument)
+	}
+	return replyError(command, categoryUnknown, "unknown command")
+}
+
+// joinRaftGroup loads the node identity named in the server's config and makes
+// the server a member of its Raft group, talking to the other nodes over their
+// client ports.
+//
+// Returns true if successful.
+func (s *server) joinRaftGroup() bool {
+	privateKey, publicKey, ok := LoadRSAKeys(s.config.RaftIdentity)
+	if !ok {
+		s.log.error("Error loading Raft identity", "path", s.config.RaftIdentity)
+		return false
+	}
+	s.log.info("Raft node identity", "address", s.config.RaftAddress,
+		"fingerprint", RSAKeyFingerprint(publicKey))
+	return s.startRaft(newRaftConnections(privateKey, s.peerTLS))
+}
+
+// startRaft starts the server's Raft node, which sends messages to the rest of
+// its group with the given transport.
+//
+// Returns true if successful.
+func (s *server) startRaft(transport raftTransport) bool {
+	var storage *raftStorage
+	if s.config.RaftDirectory != "" {
+		var ok bool
+		storage, ok = newRaftStorage(s.config.RaftDirectory, s.log)
+		if !ok {
+			return false
+		}
+	}
+	node, ok := newRaftNode(s.config.RaftAddress, s.config.RaftNodes,
+		transport, storeMachine{server: s}, storage, s.log)
+	if !ok {
+		s.log.error("Error loading Raft state", "path", s.config.RaftDirectory)
+		return false
+	}
+	s.raft = node
+	return true
+}
+
+// isRaftPeer checks whether the client with the given ID is another node of
+// the Raft group.
+func (s *server) isRaftPeer(id string) bool {
+	return keyListed(s.config.RaftKeys, id)
+}
+
+// proposeCommand orders a client command through the Raft group's log and
+// waits for it to be carried out.
+//
+// Returns the response to send to the client, which is NOT_LEADER with the
+// leader's address as its payload, if known, when this node is not the leader.
+func (s *server) proposeCommand(
+	current *session,
+	command, argument string,
+	value []byte,
+) string {
+	result, ok := s.raft.propose(raftEntry{
+		Client:   current.id,
+		Command:  command,
+		Argument: argument,
+		Value:    value,
+	})
+	if ok {
+		return result
+	}
+	current.log.info("Command not committed", "command", command,
+		"reason", result)
+	s.metrics.command(command, false)
+	if result == "" {
+		return replyError(command, categoryUnavailable,
+			"command was not committed in time")
+	}
+	return response{command: command, status: statusUnavailable,
+		category: categoryNotLeader, message: "not the Raft leader",
+		payload: strings.TrimSpace(strings.TrimPrefix(result, "NOTLEADER")),
+	}.encode()
+}
+
+// raftCommand carries out "RAFT" for another node of the group by answering
+// each message it sends until the connection fails.
+func (s *server) raftCommand(current *session) {
+	if s.raft == nil || !s.isRaftPeer(current.id) {
+		s.metrics.command("RAFT", false)
+		s.sendServerMessage(current, "RAFT: ERROR")
+		return
+	}
+	if !s.sendServerMessage(current, "RAFT: READY") {
+		return
+	}
+	s.metrics.command("RAFT", true)
+	for {
+		frame, ok := readFrame(current.connection)
+		if !ok {
+			current.log.debug("Lost connection to Raft node")
+			return
+		}
+		plaintext, ok := DecryptRSA(current.privateKey, frame)
+		message := raftMessage{}
+		if !ok || json.Unmarshal(plaintext, &message) != nil {
+			current.log.warn("Received invalid message from Raft node")
+			return
+		}
+		encoded, err := json.Marshal(s.raft.handle(message))
+		if err != nil || !s.sendFrame(current, encoded) {
+			return
+		}
+	}
+}
+
+// raftConnections sends messages to the other nodes of a Raft group, keeping a
+// connection open to each.
+type raftConnections struct {
+	privateKey *rsa.PrivateKey // This node's identity.
+	transport  *tls.Config     // Used to connect to nodes, if they speak TLS.
+	mutex      sync.Mutex
+	peers      map[string]*raftPeer // Connections by node address.
+}
+
+// raftPeer is a connection to another node of a Raft group. Messages to the
+// node are sent one at a time.
+type raftPeer struct {
+	mutex      sync.Mutex
+	connection net.Conn // Nil until connected, and after an error.
+	sessionKey rsa.PublicKey
+}
+
+// newRaftConnections creates a transport connecting to other nodes with the
+// given identity, over TLS if a config is given.
+//
+// Returns a pointer to the new transport.
+func newRaftConnections(
+	privateKey *rsa.PrivateKey,
+	transport *tls.Config,
+) *raftConnections {
+	return &raftConnections{
+		privateKey: privateKey,
+		transport:  transport,
+		peers:      map[string]*raftPeer{},
+	}
+}
+
+// send delivers a message to the node at address, connecting to it first if
+// there is no open connection.
+//
+// Returns the node's reply and true if successful.
+func (t *raftConnections) send(
+	address string,
+	message raftMessage,
+) (raftMessage, bool) {
+	t.mutex.Lock()
+	peer := t.peers[address]
+	if peer == nil {
+		peer = &raftPeer{}
+		t.peers[address] = peer
+	}
+	t.mutex.Unlock()
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	if peer.connection == nil && !peer.connect(address, t.privateKey, t.transport) {
+		return raftMessage{}, false
+	}
+	reply, ok := peer.exchange(t.privateKey, message)
+	if !ok {
+		peer.connection.Close()
+		peer.connection = nil
+	}
+	return reply, ok
+}
+
+// connect opens a connection to the node at address and sends "RAFT". The
+// caller must hold the peer's mutex.
+//
+// Returns true if the node is ready for messages.
+func (peer *raftPeer) connect(
+	address string,
+	privateKey *rsa.PrivateKey,
+	transport *tls.Config,
+) bool {
+	connection, sessionKey, ok := dialServer(address, privateKey.PublicKey,
+		transport)
+	if !ok {
+		return false
+	}
+	connection.SetDeadline(time.Now().Add(raftMessageTimeout))
+	response, ok := serverRequest(connection, sessionKey, privateKey, "RAFT")
+	if !ok || response != "RAFT: READY" {
+		connection.Close()
+		return false
+	}
+	peer.connection, peer.sessionKey = connection, sessionKey
+	return true
+}
+
+// exchange sends a message to the node as a frame and reads its reply. The
+// caller must hold the peer's mutex.
+//
+// Returns the reply and true if successful.
+func (peer *raftPeer) exchange(
+	privateKey *rsa.PrivateKey,
+	message raftMessage,
+) (raftMessage, bool) {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return raftMessage{}, false
+	}
+	peer.connection.SetDeadline(time.Now().Add(raftMessageTimeout))
+	if _, ok := writeFrame(peer.connection, peer.sessionKey, encoded); !ok {
+		return raftMessage{}, false
+	}
+	frame, ok := readFrame(peer.connection)
+	if !ok {
+		return raftMessage{}, false
+	}
+	plaintext, ok := DecryptRSA(privateKey, frame)
+	reply := raftMessage{}
+	if !ok || json.Unmarshal(plaintext, &reply) != nil {
+		return raftMessage{}, false
+	}
+	return reply, true
+}
+
+// simulatedNetwork delivers messages between Raft nodes running in the same
+// process, and can cut nodes off from each other to show how a group copes
+// with failures. Messages are encoded as JSON on the way, as on a real
+// network, so that nodes never share memory.
+type simulatedNetwork struct {
+	mutex      sync.Mutex
+	nodes      map[string]*raftNode // Nodes by address.
+	partitions map[string]int       // Nodes only reach others in the same partition.
+	down       map[string]bool      // Nodes that neither send nor receive.
+	latency    time.Duration        // Delay added to each message and reply.
+}
+
+// simulatedTransport sends messages from one node over a simulated network.
+type simulatedTransport struct {
+	network *simulatedNetwork
+	address string // The sending node's address.
+}
+
+// newSimulatedNetwork creates a network on which every node reaches every
+// other.
+//
+// Returns a pointer to the new network.
+func newSimulatedNetwork(latency time.Duration) *simulatedNetwork {
+	return &simulatedNetwork{
+		nodes:      map[string]*raftNode{},
+		partitions: map[string]int{},
+		down:       map[string]bool{},
+		latency:    latency,
+	}
+}
+
+// attach connects a node to the network at address, replacing any node that
+// was there before, and brings it up.
+func (network *simulatedNetwork) attach(address string, node *raftNode) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.nodes[address] = node
+	network.down[address] = false
+}
+
+// setDown cuts the node at address off from every other node, or brings it
+// back up.
+func (network *simulatedNetwork) setDown(address string, down bool) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.down[address] = down
+}
+
+// partition splits the network so that nodes only reach nodes in the same
+// group. Nodes in no group form a group of their own.
+func (network *simulatedNetwork) partition(groups ...[]string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.partitions = map[string]int{}
+	for i, group := range groups {
+		for _, address := range group {
+			network.partitions[address] = i + 1
+		}
+	}
+}
+
+// reachable checks whether a message from one node can reach another.
+func (network *simulatedNetwork) reachable(from, to string) bool {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.nodes[to] != nil && !network.down[from] &&
+		!network.down[to] && network.partitions[from] == network.partitions[to]
+}
+
+// transport creates a transport sending messages from the node at address.
+//
+// Returns the transport.
+func (network *simulatedNetwork) transport(address string) raftTransport {
+	return simulatedTransport{network: network, address: address}
+}
+
+// send delivers a message to the node at address if the network allows it.
+//
+// Returns the node's reply and true if successful.
+func (t simulatedTransport) send(
+	address string,
+	message raftMessage,
+) (raftMessage, bool) {
+	time.Sleep(t.network.latency)
+	if !t.network.reachable(t.address, address) {
+		return raftMessage{}, false
+	}
+	t.network.mutex.Lock()
+	node := t.network.nodes[address]
+	t.network.mutex.Unlock()
+
+	request, ok := copyRaftMessage(message)
+	if !ok {
+		return raftMessage{}, false
+	}
+	reply := node.handle(request)
+	time.Sleep(t.network.latency)
+	if !t.network.reachable(address, t.address) {
+		return raftMessage{}, false
+	}
+	return copyRaftMessage(reply)
+}
+
+// copyRaftMessage copies a message by encoding and decoding it as JSON.
+//
+// Returns the copy and true if successful.
+func copyRaftMessage(message raftMessage) (raftMessage, bool) {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return raftMessage{}, false
+	}
+	copied := raftMessage{}
+	return copied, json.Unmarshal(encoded, &copied) == nil
+}
+
+// TestRaft runs a group of five Raft nodes on a simulated network. It writes
+// through the leader, splits the group so that the leader is in a minority,
+// stops two nodes while enough writes are made to compact the log, restarts
+// them from their stored state and finally changes the group's members.
+func TestRaft() {
+	configureLogging(LogConfig{Level: "warn"})
+	directory, err := os.MkdirTemp("", "raft")
+	if err != nil {
+		fmt.Println("Error creating directory:", err.Error())
+		return
+	}
+	defer os.RemoveAll(directory)
+
+	network := newSimulatedNetwork(time.Millisecond)
+	addresses := []string{"node1", "node2", "node3", "node4", "node5"}
+	nodes := map[string]*server{}
+	defer func() {
+		for _, node := range nodes {
+			node.raft.stop()
+		}
+	}()
+	startNode := func(address string, members []string) *server {
+		node := newServer(ServerConfig{
+			KeyPoolSize: 1, KeyPoolWorkers: 1,
+			RaftAddress: address, RaftNodes: members,
+			RaftDirectory: filepath.Join(directory, address)})
+		if !node.startRaft(network.transport(address)) {
+			os.Exit(1)
+		}
+		network.attach(address, node.raft)
+		nodes[address] = node
+		return node
+	}
+	for _, address := range addresses {
+		startNode(address, addresses)
+	}
+
+	_, publicKey := GenerateRSAKeys()
+	client := &session{id: RSAKeyToString(publicKey), log: defaultLogger}
+	request := func(address, command, argument, value string) {
+		outcome, _ := parseResponse(nodes[address].proposeCommand(
+			client, command, argument, []byte(value)))
+		if command == "PUT" {
+			command += " " + argument + " " + value
+		} else if argument != "" {
+			command += " " + argument
+		}
+		fmt.Printf("  %s: %s -> %s\n", address, command, outcome)
+	}
+
+	leader := waitForLeader(nodes, addresses)
+	fmt.Printf("%s was elected leader of %d nodes\n", leader, len(addresses))
+	request(leader, "CONNECT", "", "")
+	request(leader, "PUT", "greeting", "hello")
+	follower := otherNode(addresses, leader)
+	request(follower, "GET", "greeting", "")
+
+	minority := []string{leader, follower}
+	majority := []string{}
+	for _, address := range addresses {
+		if address != leader && address != follower {
+			majority = append(majority, address)
+		}
+	}
+	network.partition(minority, majority)
+	fmt.Printf("Split %v from %v\n", minority, majority)
+	newLeader := waitForLeader(nodes, majority)
+	fmt.Printf("%s was elected leader of the majority\n", newLeader)
+	request(newLeader, "PUT", "greeting", "hello again")
+	request(leader, "PUT", "greeting", "lost")
+	network.partition()
+	fmt.Println("Healed the split")
+	waitForApplied(nodes, addresses, nodes[newLeader].raft.status().Commit)
+	request(newLeader, "GET", "greeting", "")
+	printRaftValues(nodes, addresses, client.id, "greeting")
+
+	stopped := []string{}
+	for _, address := range addresses {
+		if address != newLeader && len(stopped) < 2 {
+			stopped = append(stopped, address)
+			network.setDown(address, true)
+			nodes[address].raft.stop()
+		}
+	}
+	fmt.Printf("Stopped %v\n", stopped)
+	for i := 0; i < raftSnapshotThreshold+100; i++ {
+		outcome, _ := parseResponse(nodes[newLeader].proposeCommand(client,
+			"PUT", fmt.Sprintf("key%d", i), []byte(fmt.Sprint(i))))
+		if !outcome.ok() {
+			fmt.Println("  write failed:", outcome)
+			return
+		}
+	}
+	status := nodes[newLeader].raft.status()
+	fmt.Printf("%s committed %d writes and compacted its log up to index %d\n",
+		newLeader, raftSnapshotThreshold+100, status.Snapshot)
+	for _, address := range stopped {
+		startNode(address, addresses)
+	}
+	fmt.Printf("Restarted %v from their stored state\n", stopped)
+	waitForApplied(nodes, addresses, status.Commit)
+	printRaftValues(nodes, addresses, client.id, "key1000")
+
+	startNode("node6", nil)
+	members, _ := nodes[newLeader].raft.changeMembers("node6", true)
+	fmt.Printf("Added node6, members are now %s\n", members)
+	removed := otherNode(addresses, newLeader)
+	members, _ = nodes[newLeader].raft.changeMembers(removed, false)
+	fmt.Printf("Removed %s, members are now %s\n", removed, members)
+	request(newLeader, "PUT", "greeting", "goodbye")
+	remaining := []string{}
+	for _, address := range append(addresses, "node6") {
+		if address != removed {
+			remaining = append(remaining, address)
+		}
+	}
+	waitForApplied(nodes, remaining, nodes[newLeader].raft.status().Commit)
+	printRaftValues(nodes, remaining, client.id, "greeting")
+}
+
+// waitForLeader waits up to ten seconds for one of the given nodes to lead
+// the group.
+//
+// Returns the leader's address.
+func waitForLeader(nodes map[string]*server, addresses []string) string {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, address := range addresses {
+			if nodes[address].raft.status().Role == raftRoleNames[raftLeader] {
+				return address
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	fmt.Println("No leader was elected")
+	os.Exit(1)
+	return ""
+}
+
+// waitForApplied waits up to ten seconds for the given nodes to apply every
+// entry up to index.
+func waitForApplied(nodes map[string]*server, addresses []string, index uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		applied := true
+		for _, address := range addresses {
+			if nodes[address].raft.status().Applied < index {
+				applied = false
+			}
+		}
+		if applied {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	fmt.Println("Nodes did not catch up")
+}
+
+// otherNode returns the first of the given addresses other than address.
+func otherNode(addresses []string, address string) string {
+	for _, other := range addresses {
+		if other != address {
+			return other
+		}
+	}
+	return ""
+}
+
+// printRaftValues prints the value each node holds under key for a client.
+func printRaftValues(
+	nodes map[string]*server,
+	addresses []string,
+	id, key string,
+) {
+	for _, address := range addresses {
+		value, _ := nodes[address].store.get(id, key)
+		fmt.Printf("  %s holds %s = %q\n", address, key, value.data)
+	}
+}
@@ -0,0 +1,189 @@
+package sockets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Names of the files a raftStorage keeps in its directory.
+const (
+	raftStateFile    = "raft-state.json"    // The term and vote.
+	raftLogFile      = "raft-log.jsonl"     // The log after the snapshot, one entry per line.
+	raftSnapshotFile = "raft-snapshot.json" // The latest snapshot.
+)
+
+// raftStorage keeps a Raft node's term, vote, log and snapshot in a directory,
+// so that the node remembers them after a restart. Every write is synced to
+// disk before it returns, since a node must not forget a vote or an entry it
+// has acknowledged.
+type raftStorage struct {
+	directory string
+	log       *logger
+}
+
+// raftStoredState is everything a raftStorage holds, as read by load.
+type raftStoredState struct {
+	Term          uint64      `json:"term"`
+	VotedFor      string      `json:"voted_for,omitempty"`
+	SnapshotIndex uint64      `json:"snapshot_index,omitempty"`
+	SnapshotTerm  uint64      `json:"snapshot_term,omitempty"`
+	SnapshotNodes []string    `json:"snapshot_nodes,omitempty"`
+	SnapshotData  []byte      `json:"snapshot_data,omitempty"`
+	Entries       []raftEntry `json:"-"`
+}
+
+// newRaftStorage creates the given directory if it does not exist.
+//
+// Returns a pointer to the storage and true if successful.
+func newRaftStorage(directory string, log *logger) (*raftStorage, bool) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		log.error("Error creating Raft directory", "path", directory,
+			"error", err)
+		return nil, false
+	}
+	return &raftStorage{directory: directory, log: log}, true
+}
+
+// load reads the stored state. Missing files are treated as empty, as for a
+// node that has never run.
+//
+// Returns the state and true if every file could be read.
+func (r *raftStorage) load() (raftStoredState, bool) {
+	state := raftStoredState{}
+	snapshot := raftStoredState{}
+	if !r.readJSON(raftStateFile, &state) ||
+		!r.readJSON(raftSnapshotFile, &snapshot) {
+		return raftStoredState{}, false
+	}
+	state.SnapshotIndex, state.SnapshotTerm = snapshot.SnapshotIndex, snapshot.SnapshotTerm
+	state.SnapshotNodes, state.SnapshotData = snapshot.SnapshotNodes, snapshot.SnapshotData
+
+	contents, err := os.ReadFile(filepath.Join(r.directory, raftLogFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		r.log.error("Error reading Raft log", "error", err)
+		return raftStoredState{}, false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Buffer(nil, maxFrameSize)
+	for scanner.Scan() {
+		entry := raftEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line cut short by a crash was never acknowledged.
+			r.log.warn("Ignoring incomplete Raft log entry")
+			break
+		}
+		if entry.Index != state.SnapshotIndex+uint64(len(state.Entries))+1 {
+			continue
+		}
+		state.Entries = append(state.Entries, entry)
+	}
+	return state, true
+}
+
+// saveState replaces the stored term and vote.
+func (r *raftStorage) saveState(term uint64, votedFor string) {
+	r.writeJSON(raftStateFile, raftStoredState{Term: term, VotedFor: votedFor})
+}
+
+// saveSnapshot replaces the stored snapshot.
+func (r *raftStorage) saveSnapshot(index, term uint64, nodes []string, data []byte) {
+	r.writeJSON(raftSnapshotFile, raftStoredState{
+		SnapshotIndex: index,
+		SnapshotTerm:  term,
+		SnapshotNodes: nodes,
+		SnapshotData:  data,
+	})
+}
+
+// appendEntries adds entries to the end of the stored log.
+func (r *raftStorage) appendEntries(entries []raftEntry) {
+	file, err := os.OpenFile(filepath.Join(r.directory, raftLogFile),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		r.log.error("Error opening Raft log", "error", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(encodeEntries(entries)); err != nil {
+		r.log.error("Error writing Raft log", "error", err)
+		return
+	}
+	if err := file.Sync(); err != nil {
+		r.log.error("Error syncing Raft log", "error", err)
+	}
+}
+
+// saveEntries replaces the stored log.
+func (r *raftStorage) saveEntries(entries []raftEntry) {
+	r.writeFile(raftLogFile, encodeEntries(entries))
+}
+
+// encodeEntries encodes entries as JSON, one per line.
+//
+// Returns the encoded entries.
+func encodeEntries(entries []raftEntry) []byte {
+	encoded := []byte{}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		encoded = append(append(encoded, line...), '\n')
+	}
+	return encoded
+}
+
+// readJSON decodes the named file into value, leaving value alone if the file
+// does not exist.
+//
+// Returns true unless the file could not be read or decoded.
+func (r *raftStorage) readJSON(name string, value any) bool {
+	contents, err := os.ReadFile(filepath.Join(r.directory, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	if err == nil {
+		err = json.Unmarshal(contents, value)
+	}
+	if err != nil {
+		r.log.error("Error reading Raft state", "file", name, "error", err)
+		return false
+	}
+	return true
+}
+
+// writeJSON encodes value as JSON and writes it to the named file.
+func (r *raftStorage) writeJSON(name string, value any) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		r.log.error("Error encoding Raft state", "file", name, "error", err)
+		return
+	}
+	r.writeFile(name, encoded)
+}
+
+// writeFile replaces the named file. Like a snapshot, the file is written to a
+// temporary path and synced before it is renamed into place, so a crash never
+// leaves a partly written file.
+func (r *raftStorage) writeFile(name string, contents []byte) {
+	path := filepath.Join(r.directory, name)
+	file, err := os.OpenFile(path+".tmp",
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err == nil {
+		_, err = file.Write(contents)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		r.log.error("Error writing Raft state", "file", name, "error", err)
+	}
+}
@@ -0,0 +1,377 @@
+package sockets
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A client whose connection to a server fails connects again, waiting a random
+// delay below a limit that doubles with each failed attempt, and carries out
+// the handshake again with its persistent identity. Requests that were awaiting
+// their responses are sent again if carrying them out twice does no harm, and
+// fail with UNAVAILABLE otherwise, as the client cannot tell whether the server
+// carried them out.
+
+// Delays between attempts to reconnect.
+const (
+	reconnectBaseDelay = 250 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+// idempotentCommands are the commands sent again after reconnecting, as
+// carrying them out twice has the same effect as carrying them out once.
+var idempotentCommands = map[string]bool{
+	"GET":    true,
+	"PUT":    true,
+	"PUBKEY": true,
+	"ACCESS": true,
+	"NODES":  true,
+	"RING":   true,
+}
+
+// ConnectionState describes a client's connection to a server.
+type ConnectionState int
+
+const (
+	Connected    ConnectionState = iota // The handshake succeeded.
+	Reconnecting                        // The connection failed.
+)
+
+// String names the state.
+func (state ConnectionState) String() string {
+	if state == Reconnecting {
+		return "reconnecting"
+	}
+	return "connected"
+}
+
+// connectionStateChanged is told of each change to the state of a connection,
+// which the REPL prints unless the config names another function.
+var connectionStateChanged = printConnectionState
+
+// printConnectionState prints a change to the state of a connection.
+func printConnectionState(address string, state ConnectionState) {
+	if state == Reconnecting {
+		fmt.Printf("\u001b[0K[connection to %s lost, reconnecting]\n> ", address)
+		return
+	}
+	fmt.Printf("\u001b[0K[connected to %s]\n> ", address)
+}
+
+// serverConnection is a client's connection to a server, which is replaced
+// with a new one whenever it fails. The serverConnection stays the same, so
+// the requests recorded for it are kept, while each handshake records the
+// keys and protocol of the new connection.
+type serverConnection struct {
+	address   string
+	handshake func(*serverConnection) (net.Conn, bool) // Connects anew.
+	requests  *requestQueue                            // Awaiting responses.
+
+	mutex      sync.Mutex
+	current    net.Conn
+	generation uint64        // Counts the connections replaced.
+	closed     bool          // Whether the client closed the connection.
+	serverKey  rsa.PublicKey // The server's session key.
+	protocol   protocol      // The protocol agreed with the server.
+	keys       *sessionKeys  // The keys exchanged, if any.
+	sequence   *sequence     // Numbers messages, if sequencing was agreed.
+}
+
+// dialConnection connects to the server at address, carrying out the given
+// handshake, which records the server's key and protocol for the connection.
+//
+// Returns the connection and true if successful.
+func dialConnection(
+	address string,
+	handshake func(*serverConnection) (net.Conn, bool),
+) (*serverConnection, bool) {
+	connection := &serverConnection{
+		address:   address,
+		handshake: handshake,
+		requests:  newRequestQueue(),
+	}
+	current, ok := handshake(connection)
+	if !ok {
+		return nil, false
+	}
+	connection.current = current
+	startSequence(connection)
+	connectionStateChanged(address, Connected)
+	return connection, true
+}
+
+// clientHandshake connects to the server as this client and sends CONNECT,
+// offering every supported version and capability and a key exchange.
+//
+// Returns the new connection and true if successful.
+func clientHandshake(connection *serverConnection) (net.Conn, bool) {
+	current, reply, keys, ok := connectServer(connection.address)
+	if !ok {
+		return nil, false
+	}
+	if reply == "CONNECT: ERROR" {
+		clientLog.error("Session ID is already taken")
+		current.Close()
+		return nil, false
+	}
+	if reply == "CONNECT: ERROR SIGNATURE" {
+		clientLog.error("Server refused the signature on the key exchange")
+		current.Close()
+		return nil, false
+	}
+	if reply == "CONNECT: ERROR KEY" {
+		clientLog.error("Server cannot use this client's key",
+			"type", keyType(clientPublicKey))
+		current.Close()
+		return nil, false
+	}
+	if strings.HasPrefix(reply, "CONNECT: ERROR VERSION") {
+		clientLog.error("Server speaks no protocol version of this client",
+			"versions", strings.TrimPrefix(reply, "CONNECT: ERROR VERSION "))
+		current.Close()
+		return nil, false
+	}
+	if strings.HasPrefix(reply, "CONNECT") {
+		sessionKey, agreed, ok := parseConnectReply(reply)
+		serverKey, keyOK := StringToRSAKey(sessionKey)
+		if !ok || !keyOK {
+			clientLog.error("Received invalid public RSA key")
+			current.Close()
+			return nil, false
+		}
+		setServerKey(connection, serverKey)
+		setServerProtocol(connection, agreed)
+		setSessionKeys(connection, keys)
+		clientLog.debug("Received server key",
+			"key", fingerprint(RSAKeyToString(serverKey))[:16],
+			"protocol", agreed.String())
+	}
+	return current, true
+}
+
+// nodeHandshake connects to a node of the cluster as this client and sends
+// CONNECT as clientHandshake does, so that keys RSA cannot encrypt to are
+// still used through a key exchange.
+//
+// Returns the new connection and true if successful.
+func nodeHandshake(connection *serverConnection) (net.Conn, bool) {
+	current, ok := clientHandshake(connection)
+	if !ok {
+		clientLog.warn("Error connecting to node", "node", connection.address)
+		return nil, false
+	}
+	return current, true
+}
+
+// reconnect replaces a failed connection, retrying the handshake until it
+// succeeds, then sends the requests awaiting responses again or fails them.
+func (c *serverConnection) reconnect() {
+	c.connection().Close()
+	connectionStateChanged(c.address, Reconnecting)
+	var replacement net.Conn
+	for attempt := 1; replacement == nil; attempt++ {
+		delay := reconnectDelay(attempt)
+		clientLog.info("Reconnecting",
+			"node", c.address, "attempt", attempt, "delay", delay)
+		time.Sleep(delay)
+		replacement, _ = c.handshake(c)
+	}
+
+	queue := c.requests
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	c.mutex.Lock()
+	c.current = replacement
+	c.generation++
+	c.mutex.Unlock()
+	startSequence(c)
+	replayed, failed := queue.replay(c)
+	clientLog.info("Reconnected",
+		"node", c.address, "replayed", replayed, "failed", failed)
+	connectionStateChanged(c.address, Connected)
+}
+
+// reconnectDelay chooses how long to wait before an attempt to reconnect.
+//
+// Returns a random delay below a limit that doubles with each attempt.
+func reconnectDelay(attempt int) time.Duration {
+	limit := reconnectMaxDelay
+	if attempt <= 16 && reconnectBaseDelay<<(attempt-1) < limit {
+		limit = reconnectBaseDelay << (attempt - 1)
+	}
+	return time.Duration(rand.Int63n(int64(limit))) + time.Millisecond
+}
+
+// replay sends the requests awaiting responses on a connection that was
+// replaced, if they are idempotent. Other requests receive an UNAVAILABLE
+// response instead. Without pipelining a server could read a PUT together
+// with its value, so PUT is not sent again either. A request whose value is
+// not yet written is sent whole by endRequest. q.mutex must be held.
+//
+// Returns the numbers of requests sent again and failed.
+func (q *requestQueue) replay(connection *serverConnection) (int, int) {
+	pipelining := serverProtocolFor(connection).has(capabilityPipelining)
+	replayed, failed := 0, 0
+	kept := []*pendingRequest{}
+	for _, pending := range q.pending {
+		if !idempotentCommands[pending.command] ||
+			(pending.command == "PUT" && !pipelining) {
+			pending.abandoned = true
+			pending.result <- response{command: pending.command,
+				status: statusUnavailable, category: categoryUnavailable,
+				message: "connection lost"}
+			failed++
+			continue
+		}
+		if pending.complete {
+			pending.send(connection)
+			replayed++
+		}
+		kept = append(kept, pending)
+	}
+	q.pending = kept
+
+	// The turn is held by the request awaited without pipelining, if any.
+	if pipelining || len(kept) == 0 {
+		select {
+		case <-q.turn:
+		default:
+		}
+	}
+	return replayed, failed
+}
+
+// connectionGeneration counts the times a connection was replaced.
+//
+// Returns the count, which is 0 for connections that are never replaced.
+func connectionGeneration(connection net.Conn) uint64 {
+	c, ok := connection.(*serverConnection)
+	if !ok {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+// connection finds the connection currently in use.
+//
+// Returns the connection.
+func (c *serverConnection) connection() net.Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current
+}
+
+func (c *serverConnection) Read(b []byte) (int, error) {
+	return c.connection().Read(b)
+}
+
+// Write sends bytes along the connection currently in use. A connection that
+// fails to send is closed, so that reading from it fails and it is replaced.
+func (c *serverConnection) Write(b []byte) (int, error) {
+	current := c.connection()
+	n, err := current.Write(b)
+	if err != nil {
+		current.Close()
+	}
+	return n, err
+}
+
+// Close closes the connection currently in use, which is not replaced, as the
+// client no longer needs it.
+func (c *serverConnection) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+	return c.connection().Close()
+}
+
+// isClosed checks whether the client closed the connection.
+func (c *serverConnection) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *serverConnection) LocalAddr() net.Addr {
+	return c.connection().LocalAddr()
+}
+
+func (c *serverConnection) RemoteAddr() net.Addr {
+	return c.connection().RemoteAddr()
+}
+
+func (c *serverConnection) SetDeadline(t time.Time) error {
+	return c.connection().SetDeadline(t)
+}
+
+func (c *serverConnection) SetReadDeadline(t time.Time) error {
+	return c.connection().SetReadDeadline(t)
+}
+
+func (c *serverConnection) SetWriteDeadline(t time.Time) error {
+	return c.connection().SetWriteDeadline(t)
+}
+
+// TestReconnect demonstrates a client carrying on after its connection to a
+// server fails: a value stored before the connection is closed can be read
+// once the client has reconnected, while DISCONNECT removes the client's data.
+func TestReconnect() {
+	configureLogging(LogConfig{Level: "error"})
+	clientLog = defaultLogger
+	states := make(chan ConnectionState, 4)
+	connectionStateChanged = func(_ string, state ConnectionState) {
+		states <- state
+	}
+	s, address := startTestServer(ServerConfig{KeyPoolSize: 2, KeyPoolWorkers: 1})
+	clientPrivateKey, _ = GenerateIdentityKey(keyEd25519)
+	clientPublicKey = clientPrivateKey.Public()
+	aesKey = GenerateAESKey()
+	connection, ok := dialConnection(address, clientHandshake)
+	if !ok {
+		fmt.Println("Error connecting")
+		return
+	}
+	fmt.Println("Connection", <-states)
+	go readServerMessages(connection)
+
+	value, _ := EncryptValue("", aesKey, "hello")
+	pending := beginRequest(connection, "PUT greeting")
+	endRequest(connection, pending, value)
+	fmt.Println("PUT greeting:", (<-pending.result).category)
+	get := func() string {
+		stored := requestResponse(connection, "GET greeting")
+		if !stored.ok() {
+			return stored.category
+		}
+		plaintext, _ := decryptDataValue([]byte(stored.payload))
+		return fmt.Sprintf("%q", plaintext)
+	}
+
+	// The server closes the connection, as if it had failed.
+	id := fingerprint(PublicKeyToString(clientPublicKey))
+	s.adminKick(io.Discard, id[:minKickPrefix])
+	fmt.Println("Connection", <-states)
+	fmt.Println("Connection", <-states)
+	fmt.Println("GET greeting after reconnecting:", get())
+
+	requestResponse(connection, "DISCONNECT")
+	connection.Close()
+	connection, ok = dialConnection(address, clientHandshake)
+	if !ok {
+		fmt.Println("Error connecting")
+		return
+	}
+	<-states
+	go readServerMessages(connection)
+	fmt.Println("GET greeting after DISCONNECT:", get())
+	requestResponse(connection, "DISCONNECT")
+	connection.Close()
+}
@@ -0,0 +1,649 @@
+package sockets
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The RESP listener lets Redis clients such as redis-cli read and write
+// non-secret data, such as configuration, in the RESP2 protocol. It supports
+// PING, AUTH, QUIT, GET, SET (with EX or PX), DEL, EXISTS, KEYS and EXPIRE.
+//
+// Every RESP client shares a single namespace, owned by a client with the ID
+// redisClientID, whose values are stored exactly as sent. The server cannot
+// tell which RESP client sent a command, so the namespace should only hold
+// data that any caller who can reach the listener may read. If the config
+// sets RedisPassword, clients must send it with AUTH before any other command.
+
+const (
+	// redisClientID is the client ID owning the values stored over RESP.
+	redisClientID = "redis"
+
+	// redisMaxArguments is the largest number of arguments in a command.
+	redisMaxArguments = 1024
+
+	// redisMaxBulk is the largest argument read, which matches the largest
+	// value a TCP client can store.
+	redisMaxBulk = messageBufferSize
+)
+
+// redisProtocolError is a command that does not follow RESP. The connection
+// is closed after the error is sent, as Redis does.
+type redisProtocolError string
+
+func (e redisProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// redisConnection holds the state of a single RESP connection.
+type redisConnection struct {
+	server        *server
+	current       *session
+	reader        *bufio.Reader
+	writer        *bufio.Writer
+	authenticated bool // Whether AUTH succeeded, or no password is set.
+}
+
+// serveRedis listens for RESP clients on the given address.
+//
+// Returns the listener and true if successful.
+func (s *server) serveRedis(address string) (net.Listener, bool) {
+	listener, err := net.Listen(serverType, address)
+	if err != nil {
+		s.log.error("Error listening for RESP clients", "error", err)
+		return nil, false
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.redisSession(connection)
+		}
+	}()
+	s.log.info("Serving RESP clients", "address", listener.Addr().String())
+	return listener, true
+}
+
+// redisSession reads commands from a RESP connection and replies to each,
+// until the client quits or the connection fails. Replies to pipelined
+// commands are sent together once every buffered command has been read.
+func (s *server) redisSession(connection net.Conn) {
+	defer connection.Close()
+	current := &session{
+		connection:  connection,
+		number:      s.connections.Add(1),
+		connectedAt: time.Now(),
+		id:          redisClientID,
+	}
+	current.log = s.log.with(
+		"conn", current.number,
+		"remote", connection.RemoteAddr().String(),
+		"protocol", "resp")
+	current.log.debug("RESP client connected")
+	r := &redisConnection{
+		server:        s,
+		current:       current,
+		reader:        bufio.NewReaderSize(connection, messageBufferSize),
+		writer:        bufio.NewWriter(connection),
+		authenticated: s.config.RedisPassword == "",
+	}
+
+	for {
+		arguments, err := readRedisCommand(r.reader)
+		var protocolError redisProtocolError
+		if errors.As(err, &protocolError) {
+			current.log.warn("Closing RESP connection", "error", err)
+			r.error("ERR " + err.Error())
+			r.writer.Flush()
+			return
+		}
+		if err != nil {
+			current.log.debug("RESP client disconnected")
+			return
+		}
+		if len(arguments) == 0 {
+			continue
+		}
+		s.metrics.add(metricBytesIn, "", float64(len(strings.Join(arguments, ""))))
+		quit := r.execute(arguments)
+		if quit || r.reader.Buffered() == 0 {
+			if err := r.writer.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// execute carries out a single command and writes its reply.
+//
+// Returns true if the client asked to close the connection.
+func (r *redisConnection) execute(arguments []string) bool {
+	name := strings.ToUpper(arguments[0])
+	arguments = arguments[1:]
+	if !r.authenticated && name != "AUTH" && name != "QUIT" {
+		r.error("NOAUTH Authentication required.")
+		return false
+	}
+
+	switch {
+	case name == "PING" && len(arguments) == 0:
+		r.simple("PONG")
+	case name == "PING" && len(arguments) == 1:
+		r.bulk(arguments[0])
+	case name == "AUTH" && (len(arguments) == 1 || len(arguments) == 2):
+		r.auth(arguments[len(arguments)-1])
+	case name == "QUIT":
+		r.simple("OK")
+		return true
+	case name == "GET" && len(arguments) == 1:
+		r.get(arguments[0])
+	case name == "SET" && len(arguments) >= 2:
+		r.set(arguments[0], arguments[1], arguments[2:])
+	case name == "DEL" && len(arguments) >= 1:
+		r.del(arguments)
+	case name == "EXISTS" && len(arguments) >= 1:
+		r.exists(arguments)
+	case name == "KEYS" && len(arguments) == 1:
+		r.keys(arguments[0])
+	case name == "EXPIRE" && len(arguments) == 2:
+		r.expire(arguments[0], arguments[1])
+	case redisCommandNames[name]:
+		r.error(fmt.Sprintf(
+			"ERR wrong number of arguments for '%s' command",
+			strings.ToLower(name)))
+	default:
+		r.error(fmt.Sprintf("ERR unknown command '%.128s'", name))
+	}
+	return false
+}
+
+// redisCommandNames are the commands the RESP listener supports.
+var redisCommandNames = map[string]bool{
+	"PING":   true,
+	"AUTH":   true,
+	"QUIT":   true,
+	"GET":    true,
+	"SET":    true,
+	"DEL":    true,
+	"EXISTS": true,
+	"KEYS":   true,
+	"EXPIRE": true,
+}
+
+// auth carries out "AUTH [password]". A username may precede the password,
+// but is ignored.
+func (r *redisConnection) auth(password string) {
+	expected := r.server.config.RedisPassword
+	switch {
+	case expected == "":
+		r.error("ERR AUTH called without any password configured")
+	case subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1:
+		r.authenticated = true
+		r.simple("OK")
+	default:
+		r.current.log.warn("RESP client sent a wrong password")
+		r.error("WRONGPASS invalid username-password pair")
+	}
+}
+
+// get carries out "GET [key]".
+func (r *redisConnection) get(key string) {
+	if !r.validKey(key) {
+		return
+	}
+	response, ok, failure := r.command("GET", key, nil)
+	switch {
+	case failure != "":
+		r.error(failure)
+	case !ok:
+		r.null()
+	default:
+		r.bulk(response)
+	}
+}
+
+// set carries out "SET [key] [value] [EX seconds|PX milliseconds]". Setting a
+// value removes any expiry it had, unless a new one is given.
+func (r *redisConnection) set(key, value string, options []string) {
+	if !r.validKey(key) {
+		return
+	}
+	expires := time.Time{}
+	if len(options) > 0 {
+		unit := time.Duration(0)
+		switch strings.ToUpper(options[0]) {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		}
+		if unit == 0 || len(options) != 2 {
+			r.error("ERR syntax error")
+			return
+		}
+		at, ok := redisDeadline(options[1], unit)
+		if !ok || !at.After(time.Now()) {
+			r.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		expires = at
+	}
+
+	_, ok, failure := r.command("PUT", key, []byte(value))
+	if ok && !expires.IsZero() {
+		_, ok, failure = r.command("EXPIRE",
+			key+" "+strconv.FormatInt(expires.UnixMilli(), 10), nil)
+	}
+	switch {
+	case failure != "":
+		r.error(failure)
+	case !ok:
+		r.error("ERR value could not be stored")
+	default:
+		r.simple("OK")
+	}
+}
+
+// del carries out "DEL [keys...]".
+func (r *redisConnection) del(keys []string) {
+	r.count("DELETE", keys)
+}
+
+// exists carries out "EXISTS [keys...]".
+func (r *redisConnection) exists(keys []string) {
+	r.count("GET", keys)
+}
+
+// count carries out a command for each of the given keys and replies with the
+// number of keys it succeeded for.
+func (r *redisConnection) count(command string, keys []string) {
+	for _, key := range keys {
+		if !r.validKey(key) {
+			return
+		}
+	}
+	succeeded := 0
+	for _, key := range keys {
+		_, ok, failure := r.command(command, key, nil)
+		if failure != "" {
+			r.error(failure)
+			return
+		}
+		if ok {
+			succeeded++
+		}
+	}
+	r.integer(succeeded)
+}
+
+// keys carries out "KEYS [pattern]", which lists the keys matching a glob
+// style pattern.
+func (r *redisConnection) keys(pattern string) {
+	response, ok, failure := r.command("KEYS", "", nil)
+	switch {
+	case failure != "":
+		r.error(failure)
+		return
+	case !ok:
+		r.array(nil)
+		return
+	}
+	matches := []string{}
+	for _, key := range strings.Split(response, "\n") {
+		if key != "" && redisMatch(pattern, key) {
+			matches = append(matches, key)
+		}
+	}
+	r.array(matches)
+}
+
+// expire carries out "EXPIRE [key] [seconds]". A time that is not positive
+// deletes the key, as in Redis.
+func (r *redisConnection) expire(key, seconds string) {
+	if !r.validKey(key) {
+		return
+	}
+	at, ok := redisDeadline(seconds, time.Second)
+	if !ok {
+		r.error("ERR invalid expire time in 'expire' command")
+		return
+	}
+	command, argument := "EXPIRE", key+" "+strconv.FormatInt(at.UnixMilli(), 10)
+	if !at.After(time.Now()) {
+		command, argument = "DELETE", key
+	}
+	_, ok, failure := r.command(command, argument, nil)
+	switch {
+	case failure != "":
+		r.error(failure)
+	case ok:
+		r.integer(1)
+	default:
+		r.integer(0)
+	}
+}
+
+// command carries out a client command on behalf of the RESP clients, and
+// translates failures other than a missing key into Redis errors.
+//
+// Returns the command's payload, whether it succeeded, and the error to send
+// if the server could not carry it out.
+func (r *redisConnection) command(
+	command, argument string,
+	value []byte,
+) (string, bool, string) {
+	outcome := r.server.sessionlessCommand(r.current, command, argument, value)
+	switch outcome.category {
+	case categoryOK:
+		return outcome.payload, true, ""
+	case categoryReadOnly:
+		return "", false, "READONLY You can't write against a read only replica."
+	case categoryMoved:
+		return "", false, "ERR key is owned by another cluster node"
+	case categoryNotLeader:
+		if outcome.payload == "" {
+			return "", false, "ERR server is not the Raft leader"
+		}
+		return "", false, "ERR server is not the Raft leader, try " +
+			outcome.payload
+	case categoryUnavailable:
+		return "", false, "ERR server is unavailable"
+	}
+	return "", false, ""
+}
+
+// validKey checks that a key can be passed to a client command, replying with
+// an error if not. Keys are separated from other arguments by spaces, so they
+// may not contain whitespace.
+func (r *redisConnection) validKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, " \t\r\n") {
+		r.error("ERR keys may not be empty or contain whitespace")
+		return false
+	}
+	return true
+}
+
+// simple, error, integer, bulk, null and array write a single reply of each
+// RESP2 type.
+func (r *redisConnection) simple(text string) {
+	r.writer.WriteString("+" + text + "\r\n")
+}
+
+func (r *redisConnection) error(text string) {
+	r.server.metrics.error("redis")
+	r.writer.WriteString("-" + text + "\r\n")
+}
+
+func (r *redisConnection) integer(n int) {
+	r.writer.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (r *redisConnection) bulk(value string) {
+	r.writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+func (r *redisConnection) null() {
+	r.writer.WriteString("$-1\r\n")
+}
+
+func (r *redisConnection) array(values []string) {
+	r.writer.WriteString("*" + strconv.Itoa(len(values)) + "\r\n")
+	for _, value := range values {
+		r.bulk(value)
+	}
+}
+
+// readRedisCommand reads a command sent as an array of bulk strings, or as an
+// inline command of space separated words as typed into telnet.
+//
+// Returns the command's arguments, or an error if the connection failed or
+// the command does not follow RESP.
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readRedisLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > redisMaxArguments {
+		return nil, redisProtocolError("invalid multibulk length")
+	}
+	arguments := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := readRedisLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, redisProtocolError("expected '$'")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > redisMaxBulk {
+			return nil, redisProtocolError("invalid bulk length")
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		if string(bulk[size:]) != "\r\n" {
+			return nil, redisProtocolError("bulk string not terminated")
+		}
+		arguments = append(arguments, string(bulk[:size]))
+	}
+	return arguments, nil
+}
+
+// readRedisLine reads a line ending in "\r\n", or in "\n" alone as sent by
+// some inline clients.
+//
+// Returns the line without its ending.
+func readRedisLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", redisProtocolError("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// redisDeadline converts a relative expiry time, counted in the given unit,
+// into an absolute time.
+//
+// Returns the time and true if the expiry is a valid integer that does not
+// overflow.
+func redisDeadline(text string, unit time.Duration) (time.Time, bool) {
+	amount, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || amount > math.MaxInt64/int64(unit)/2 ||
+		amount < math.MinInt64/int64(unit)/2 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(time.Duration(amount) * unit), true
+}
+
+// redisMatch checks whether a key matches a Redis glob style pattern, where
+// '*' matches any text, '?' matches any byte, "[...]" matches a class of bytes
+// such as "[abc]", "[^abc]" or "[a-z]", and '\' escapes the next byte.
+func redisMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if redisMatch(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if key == "" {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+			continue
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']') + 1
+			if end == 0 {
+				break
+			}
+			if key == "" || !redisMatchClass(pattern[1:end], key[0]) {
+				return false
+			}
+			pattern, key = pattern[end+1:], key[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+		if key == "" || pattern[0] != key[0] {
+			return false
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return key == ""
+}
+
+// redisMatchClass checks whether a byte is in a class of a glob pattern, given
+// without its brackets.
+func redisMatchClass(class string, b byte) bool {
+	negated := strings.HasPrefix(class, "^")
+	if negated {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			low, high := class[i], class[i+2]
+			if low > high {
+				low, high = high, low
+			}
+			matched = matched || (low <= b && b <= high)
+			i += 2
+			continue
+		}
+		matched = matched || class[i] == b
+	}
+	return matched != negated
+}
+
+// readRedisReply reads a single reply and formats it as redis-cli would.
+//
+// Returns the formatted reply, or an error if the connection failed.
+func readRedisReply(reader *bufio.Reader) (string, error) {
+	line, err := readRedisLine(reader)
+	if err != nil || line == "" {
+		return "", err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return "(error) " + line[1:], nil
+	case ':':
+		return "(integer) " + line[1:], nil
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return "(nil)", nil
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return "", err
+		}
+		return strconv.Quote(string(bulk[:size])), nil
+	case '*':
+		count, _ := strconv.Atoi(line[1:])
+		if count <= 0 {
+			return "(empty array)", nil
+		}
+		elements := make([]string, count)
+		for i := range elements {
+			element, err := readRedisReply(reader)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = fmt.Sprintf("%d) %s", i+1, element)
+		}
+		return strings.Join(elements, " "), nil
+	}
+	return line, nil
+}
+
+// TestRedis runs a server with a password protected RESP listener on localhost
+// ports, then stores, lists, expires and deletes keys as a Redis client would.
+func TestRedis() {
+	configureLogging(LogConfig{Level: "warn"})
+	s, address := startTestServer(ServerConfig{
+		KeyPoolSize:    2,
+		KeyPoolWorkers: 1,
+		RedisPassword:  "secret",
+	})
+	listener, ok := s.serveRedis(serverHost + ":0")
+	if !ok {
+		return
+	}
+	defer listener.Close()
+	fmt.Println("Server listening on", address)
+	fmt.Println("RESP listener on", listener.Addr().String())
+
+	connection, err := net.Dial(serverType, listener.Addr().String())
+	if err != nil {
+		fmt.Println("Error connecting:", err.Error())
+		return
+	}
+	defer connection.Close()
+	reader := bufio.NewReader(connection)
+	send := func(arguments ...string) {
+		request := "*" + strconv.Itoa(len(arguments)) + "\r\n"
+		for _, argument := range arguments {
+			request += "$" + strconv.Itoa(len(argument)) + "\r\n" + argument + "\r\n"
+		}
+		connection.Write([]byte(request))
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			fmt.Println("Error reading reply:", err.Error())
+			return
+		}
+		fmt.Printf("%s -> %s\n", strings.Join(arguments, " "), reply)
+	}
+
+	send("GET", "colour")
+	send("AUTH", "wrong")
+	send("AUTH", "secret")
+	send("PING")
+	send("SET", "colour", "blue")
+	send("GET", "colour")
+	send("SET", "blank", "")
+	send("GET", "blank")
+	send("DEL", "blank")
+	send("SET", "session", "token", "PX", "500")
+	send("SET", "config/timeout", "30")
+	send("EXISTS", "colour", "session", "missing")
+	send("KEYS", "*")
+	send("KEYS", "[cs]*o*")
+	send("EXPIRE", "colour", "100")
+	send("EXPIRE", "missing", "100")
+	time.Sleep(time.Second)
+	send("GET", "session")
+	send("DEL", "colour", "missing")
+	send("KEYS", "*")
+	send("FLUSHALL")
+	send("QUIT")
+}
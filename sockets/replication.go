@@ -0,0 +1,763 @@
+package sockets
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A primary server records every change to its store in an ordered log of
+// mutations. A replica connects to the primary like any other client, using
+// its own RSA identity, and sends "REPLICATE [sequence]" with the sequence
+// number of the last change it has applied. If the primary's log no longer
+// reaches back that far, it first sends its entire store. Afterwards the
+// primary streams each change as it is made. Replicas serve GETs but refuse
+// commands that would change their store until an admin promotes them.
+
+const (
+	opReset      = "reset"      // Clears the store before a full sync.
+	opSynced     = "synced"     // Marks the end of a full sync.
+	opHeartbeat  = "heartbeat"  // Sent while idle to show the primary is alive.
+	opIdentity   = "identity"   // A public key was seen.
+	opConnect    = "connect"    // A client connected.
+	opDisconnect = "disconnect" // A client disconnected and its data was removed.
+	opPut        = "put"        // A value was stored.
+	opDelete     = "delete"     // A value was removed.
+	opNamespace  = "namespace"  // A shared namespace's owner, grants or group keys changed.
+	opDrop       = "drop"       // A shared namespace was moved to another node.
+)
+
+const (
+	// heartbeatInterval is how long a primary waits for a change before
+	// sending a heartbeat. A replica gives up on a primary it has not heard
+	// from in three intervals.
+	heartbeatInterval = 5 * time.Second
+
+	// replicaRetryDelay is how long a replica waits before reconnecting to its
+	// primary.
+	replicaRetryDelay = 2 * time.Second
+
+	// maxFrameSize is the largest replication frame a replica accepts.
+	maxFrameSize = 1 << 20
+)
+
+// readOnlyCommands are the client commands a replica refuses because they
+// would change its store. A PUT is refused once its value has been read.
+var readOnlyCommands = map[string]bool{
+	"PUT":     true,
+	"DELETE":  true,
+	"SHARE":   true,
+	"UNSHARE": true,
+	"CREATE":  true,
+	"GRANT":   true,
+	"REVOKE":  true,
+	"GROUP":   true,
+	"EXPIRE":  true,
+	"SETITEM": true,
+	"INCR":    true,
+	"DECR":    true,
+}
+
+// mutation is a single change to a store, as sent from a primary to its
+// replicas.
+type mutation struct {
+	Sequence  uint64             `json:"seq"`
+	Op        string             `json:"op"`
+	Client    string             `json:"client,omitempty"`    // ID of the client whose data changed.
+	Namespace string             `json:"namespace,omitempty"` // Name of the shared namespace that changed.
+	Key       string             `json:"key,omitempty"`
+	Value     *snapshotValue     `json:"value,omitempty"`
+	Metadata  *snapshotNamespace `json:"metadata,omitempty"`
+}
+
+// replicationLog holds the most recent changes to a store, numbered in the
+// order they were made.
+type replicationLog struct {
+	mutex    sync.Mutex
+	entries  []mutation    // The most recent changes, oldest first.
+	capacity int           // The largest number of changes kept.
+	sequence uint64        // Sequence number of the latest change.
+	changed  chan struct{} // Closed and replaced whenever a change is added.
+}
+
+// newReplicationLog creates an empty log keeping up to capacity changes.
+//
+// Returns a pointer to the new log.
+func newReplicationLog(capacity int) *replicationLog {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &replicationLog{capacity: capacity, changed: make(chan struct{})}
+}
+
+// append adds a change to the log, dropping the oldest change if the log is
+// full. A change without a sequence number is given the next one, while a
+// change received from a primary keeps its own.
+func (l *replicationLog) append(change mutation) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if change.Sequence == 0 {
+		change.Sequence = l.sequence + 1
+	}
+	l.sequence = change.Sequence
+	if len(l.entries) == l.capacity {
+		l.entries = l.entries[1:]
+	}
+	l.entries = append(l.entries, change)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// reset empties the log and continues numbering changes after sequence.
+func (l *replicationLog) reset(sequence uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = nil
+	l.sequence = sequence
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since finds the changes made after the given sequence number.
+//
+// Returns the changes, a channel that is closed when another change is added
+// and true if the log still holds every change after sequence.
+func (l *replicationLog) since(sequence uint64) ([]mutation, <-chan struct{}, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	oldest := l.sequence - uint64(len(l.entries))
+	if sequence > l.sequence || sequence < oldest {
+		return nil, l.changed, false
+	}
+	changes := make([]mutation, l.sequence-sequence)
+	copy(changes, l.entries[len(l.entries)-len(changes):])
+	return changes, l.changed, true
+}
+
+// position returns the sequence number of the latest change.
+func (l *replicationLog) position() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.sequence
+}
+
+// record adds a change to the store's replication log. The caller must hold
+// the store's mutex for writing, so changes are logged in the order they are
+// made.
+func (s *store) record(change mutation) {
+	s.log.append(change)
+}
+
+// recordValue records the current state of the value stored under key on
+// behalf of the client with the given ID, which is a put if the value exists
+// and a delete otherwise. The caller must hold the store's mutex for writing.
+func (s *store) recordValue(id, key string) {
+	change := mutation{Op: opDelete, Client: id, Key: key}
+	data := s.clients[id].clientData
+	if name, sharedKey, shared := splitSharedKey(key); shared {
+		change = mutation{Op: opDelete, Namespace: name, Key: sharedKey}
+		data = s.namespaces[name].data
+	}
+	if value, exists := data[change.Key]; exists {
+		copied := value.snapshot()
+		change.Op, change.Value = opPut, &copied
+	}
+	s.record(change)
+}
+
+// recordNamespace records the owner, grants and group keys of the named shared
+// namespace. The caller must hold the store's mutex for writing.
+func (s *store) recordNamespace(name string) {
+	metadata := s.namespaces[name].metadata()
+	s.record(mutation{Op: opNamespace, Namespace: name, Metadata: &metadata})
+}
+
+// fullSync describes the whole store as changes that rebuild it on a replica,
+// all numbered with the sequence number of the latest change.
+//
+// Returns the changes, starting with a reset and ending with synced.
+func (s *store) fullSync() []mutation {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	changes := []mutation{{Op: opReset}}
+	for _, keyFingerprint := range sortedKeys(s.identities) {
+		// Legacy fingerprints are recorded again with their IDs.
+		id := s.identities[keyFingerprint]
+		if fingerprint(id) == keyFingerprint {
+			changes = append(changes, mutation{Op: opIdentity, Client: id})
+		}
+	}
+	for _, id := range sortedKeys(s.clients) {
+		changes = append(changes, s.clientChanges(id)...)
+	}
+	for _, name := range sortedKeys(s.namespaces) {
+		changes = append(changes, s.sharedChanges(name)...)
+	}
+	changes = append(changes, mutation{Op: opSynced})
+
+	sequence := s.log.position()
+	for i := range changes {
+		changes[i].Sequence = sequence
+	}
+	return changes
+}
+
+// clientChanges describes a client and its data as changes that recreate them
+// on another server. The caller must hold the store's mutex.
+//
+// Returns the changes.
+func (s *store) clientChanges(id string) []mutation {
+	changes := []mutation{{Op: opConnect, Client: id}}
+	data := s.clients[id].clientData
+	for _, key := range sortedKeys(data) {
+		value := data[key].snapshot()
+		changes = append(changes,
+			mutation{Op: opPut, Client: id, Key: key, Value: &value})
+	}
+	return changes
+}
+
+// sharedChanges describes the named shared namespace and its data as changes
+// that recreate them on another server. The caller must hold the store's
+// mutex.
+//
+// Returns the changes.
+func (s *store) sharedChanges(name string) []mutation {
+	namespace := s.namespaces[name]
+	metadata := namespace.metadata()
+	changes := []mutation{
+		{Op: opNamespace, Namespace: name, Metadata: &metadata},
+	}
+	for _, key := range sortedKeys(namespace.data) {
+		value := namespace.data[key].snapshot()
+		changes = append(changes,
+			mutation{Op: opPut, Namespace: name, Key: key, Value: &value})
+	}
+	return changes
+}
+
+// apply makes a change received from the primary. Changes streamed from the
+// primary's log, rather than sent as part of a full sync, are added to this
+// store's own log with the primary's sequence number, so that this server can
+// carry on from where the primary left off if it is promoted.
+func (s *store) apply(change mutation, logged bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch change.Op {
+	case opReset:
+		s.clients = map[string]ClientData{}
+		s.namespaces = map[string]*sharedNamespace{}
+		s.identities = map[string]string{}
+		s.log.reset(change.Sequence)
+	case opIdentity:
+		s.addIdentity(change.Client)
+	case opConnect:
+		s.addIdentity(change.Client)
+		if _, exists := s.clients[change.Client]; !exists {
+			s.clients[change.Client] = ClientData{
+				clientID:   change.Client,
+				clientData: map[string]storedValue{},
+			}
+		}
+	case opDisconnect:
+		delete(s.clients, change.Client)
+	case opPut, opDelete:
+		data := s.clients[change.Client].clientData
+		if change.Namespace != "" && s.namespaces[change.Namespace] != nil {
+			data = s.namespaces[change.Namespace].data
+		}
+		if data == nil {
+			break
+		}
+		if change.Op == opDelete || change.Value == nil {
+			delete(data, change.Key)
+			break
+		}
+		value := storedValue{
+			data:    string(change.Value.Data),
+			flags:   change.Value.Flags,
+			version: change.Value.Version,
+		}
+		if value.version > s.version {
+			s.version = value.version
+		}
+		if len(change.Value.WrappedKeys) > 0 {
+			value.wrappedKeys = change.Value.WrappedKeys
+		}
+		if change.Value.Expires != nil {
+			value.expires = *change.Value.Expires
+		}
+		data[change.Key] = value
+	case opNamespace:
+		if change.Metadata == nil {
+			break
+		}
+		namespace := s.namespaces[change.Namespace]
+		if namespace == nil {
+			namespace = &sharedNamespace{data: map[string]storedValue{}}
+			s.namespaces[change.Namespace] = namespace
+		}
+		namespace.owner = change.Metadata.Owner
+		namespace.grants = map[string]permission{}
+		for grantee, name := range change.Metadata.Grants {
+			if access, ok := parsePermission(name); ok {
+				namespace.grants[grantee] = access
+			}
+		}
+		namespace.groupKeys = change.Metadata.GroupKeys
+	case opDrop:
+		delete(s.namespaces, change.Namespace)
+	}
+	if logged && change.Op != opReset {
+		s.log.append(change)
+	}
+}
+
+// refusesWrite checks whether this server is a replica and the given command
+// would change its store. Fetching a group key is allowed.
+func (s *server) refusesWrite(command, argument string) bool {
+	if !s.replica.Load() || !readOnlyCommands[command] {
+		return false
+	}
+	return !(command == "GROUP" &&
+		strings.HasPrefix(strings.ToUpper(argument), "KEY "))
+}
+
+// replicaAllowed checks whether the client with the given ID is one of the
+// replicas named in the server's config.
+func (s *server) replicaAllowed(id string) bool {
+	return keyListed(s.config.ReplicaKeys, id)
+}
+
+// keyListed checks whether a fingerprint of the client with the given ID is
+// one of the given fingerprints, which may have been printed by a node before
+// protocol version 4.
+func keyListed(fingerprints []string, id string) bool {
+	for _, listed := range fingerprints {
+		for _, keyFingerprint := range idFingerprints(id) {
+			if strings.ToLower(listed) == keyFingerprint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replicateCommand carries out "REPLICATE [sequence]" by streaming every change
+// after the given sequence number to the replica, until the connection fails.
+// Each change is sent as a frame holding its JSON encoding, encrypted for the
+// replica with EncryptRSA.
+func (s *server) replicateCommand(current *session, argument string) {
+	sequence, err := strconv.ParseUint(strings.TrimSpace(argument), 10, 64)
+	if err != nil || !s.replicaAllowed(current.id) {
+		current.log.warn("Refused replication")
+		s.metrics.command("REPLICATE", false)
+		s.sendFrame(current, []byte("REPLICATE: ERROR"))
+		return
+	}
+	s.metrics.command("REPLICATE", true)
+	current.log.info("Replica attached", "sequence", sequence)
+	defer func() { current.log.info("Replica detached", "sequence", sequence) }()
+
+	for {
+		changes, changed, ok := s.store.log.since(sequence)
+		if !ok {
+			current.log.info("Sending full sync to replica", "sequence", sequence)
+			changes = s.store.fullSync()
+		}
+		for _, change := range changes {
+			if !s.sendChange(current, change) {
+				return
+			}
+			sequence = change.Sequence
+		}
+		if len(changes) > 0 {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-time.After(heartbeatInterval):
+			heartbeat := mutation{Sequence: sequence, Op: opHeartbeat}
+			if !s.sendChange(current, heartbeat) {
+				return
+			}
+		}
+	}
+}
+
+// sendChange sends a change to a replica.
+//
+// Returns false if an error occurs.
+func (s *server) sendChange(current *session, change mutation) bool {
+	encoded, err := json.Marshal(change)
+	if err != nil {
+		current.log.error("Error encoding change", "error", err)
+		return false
+	}
+	return s.sendFrame(current, encoded)
+}
+
+// sendFrame encrypts a message for the session's client and sends it as a
+// frame with writeFrame.
+//
+// Returns false if an error occurs.
+func (s *server) sendFrame(current *session, message []byte) bool {
+	publicKey, ok := StringToRSAKey(current.id)
+	if !ok {
+		current.log.error("Error converting string to key")
+		s.metrics.error("key")
+		return false
+	}
+	written, ok := writeFrame(current.connection, publicKey, message)
+	if !ok {
+		current.log.warn("Error sending frame")
+		s.metrics.error("write")
+		return false
+	}
+	s.metrics.add(metricBytesOut, "", float64(written))
+	return true
+}
+
+// writeFrame encrypts a message with EncryptRSA and sends it prefixed with its
+// length as a 4-byte big endian integer, so that messages larger than
+// messageBufferSize can be read whole.
+//
+// Returns the number of bytes written and true if successful.
+func writeFrame(
+	connection net.Conn,
+	publicKey rsa.PublicKey,
+	message []byte,
+) (int, bool) {
+	encryptedBytes, ok := EncryptRSA(publicKey, string(message))
+	if !ok {
+		return 0, false
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(encryptedBytes)))
+	written, err := connection.Write(append(frame, encryptedBytes...))
+	return written, err == nil
+}
+
+// readFrame reads a single length-prefixed frame written by writeFrame.
+//
+// Returns the frame's contents and true if successful.
+func readFrame(connection net.Conn) ([]byte, bool) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(connection, header); err != nil {
+		return []byte{}, false
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxFrameSize {
+		return []byte{}, false
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(connection, frame); err != nil {
+		return []byte{}, false
+	}
+	return frame, true
+}
+
+// replicate follows the primary named in the server's config until the server
+// is promoted, reconnecting whenever the connection to the primary fails.
+func (s *server) replicate() {
+	privateKey, publicKey, ok := LoadRSAKeys(s.config.ReplicaIdentity)
+	if !ok {
+		s.log.error("Error loading replica identity",
+			"path", s.config.ReplicaIdentity)
+		os.Exit(1)
+	}
+	s.log.info("Replicating from primary", "primary", s.config.ReplicaOf,
+		"fingerprint", RSAKeyFingerprint(publicKey))
+	for s.replica.Load() {
+		s.followPrimary(privateKey, publicKey)
+		if !s.replica.Load() {
+			return
+		}
+		time.Sleep(replicaRetryDelay)
+	}
+}
+
+// followPrimary connects to the primary as a client, asks for every change
+// after the latest one applied and applies the changes it receives.
+// Returns when the connection fails or the server is promoted.
+func (s *server) followPrimary(privateKey *rsa.PrivateKey, publicKey rsa.PublicKey) {
+	connection, sessionKey, ok := dialServer(s.config.ReplicaOf,
+		publicKey, s.peerTLS)
+	if !ok {
+		s.log.warn("Error connecting to primary", "primary", s.config.ReplicaOf)
+		return
+	}
+	defer connection.Close()
+	s.replicationMutex.Lock()
+	if !s.replica.Load() {
+		s.replicationMutex.Unlock()
+		return
+	}
+	s.primary = connection
+	s.replicationMutex.Unlock()
+
+	sequence := s.store.log.position()
+	request, ok := EncryptRSA(sessionKey, fmt.Sprintf("REPLICATE %d", sequence))
+	if !ok {
+		return
+	}
+	if _, err := connection.Write(request); err != nil {
+		s.log.warn("Error writing", "error", err)
+		return
+	}
+
+	syncing := false
+	for {
+		connection.SetReadDeadline(time.Now().Add(3 * heartbeatInterval))
+		frame, ok := readFrame(connection)
+		if !ok {
+			if s.replica.Load() {
+				s.log.warn("Lost connection to primary")
+			}
+			return
+		}
+		plaintext, ok := DecryptRSA(privateKey, frame)
+		if !ok {
+			s.log.warn("Failed to decrypt change from primary")
+			return
+		}
+		change := mutation{}
+		if err := json.Unmarshal(plaintext, &change); err != nil {
+			s.log.error("Primary refused replication",
+				"response", string(plaintext))
+			return
+		}
+		if !s.replica.Load() {
+			return
+		}
+
+		switch change.Op {
+		case opHeartbeat:
+			continue
+		case opReset:
+			syncing = true
+			s.log.info("Receiving full sync from primary",
+				"sequence", change.Sequence)
+		case opSynced:
+			syncing = false
+			s.log.info("Replica in sync with primary",
+				"sequence", change.Sequence)
+			continue
+		}
+		s.store.apply(change, !syncing)
+	}
+}
+
+// promote makes a replica stop following its primary and accept changes from
+// its own clients. Numbering of changes carries on from the primary's, so
+// other replicas can follow this server instead.
+//
+// Returns the sequence number of the latest change and false if the server is
+// not a replica.
+func (s *server) promote() (uint64, bool) {
+	s.replicationMutex.Lock()
+	defer s.replicationMutex.Unlock()
+	if !s.replica.Swap(false) {
+		return 0, false
+	}
+	if s.primary != nil {
+		s.primary.Close()
+	}
+	sequence := s.store.log.position()
+	s.log.warn("Promoted to primary", "sequence", sequence)
+	return sequence, true
+}
+
+// TestReplication runs a primary and two replicas on localhost ports, changes
+// the primary's store, reads the replicated values from a replica and then
+// promotes that replica so that it accepts changes.
+func TestReplication() {
+	configureLogging(LogConfig{Level: "warn"})
+	directory, err := os.MkdirTemp("", "replication")
+	if err != nil {
+		fmt.Println("Error creating directory:", err.Error())
+		return
+	}
+	defer os.RemoveAll(directory)
+
+	identities := []string{}
+	fingerprints := []string{}
+	for i := 1; i <= 2; i++ {
+		path := filepath.Join(directory, fmt.Sprintf("replica%d.pem", i))
+		_, publicKey, ok := LoadRSAKeys(path)
+		if !ok {
+			return
+		}
+		identities = append(identities, path)
+		fingerprints = append(fingerprints, RSAKeyFingerprint(publicKey))
+	}
+
+	primary, primaryAddress := startTestServer(ServerConfig{
+		KeyPoolSize: 4, KeyPoolWorkers: 1, ReplicaKeys: fingerprints})
+	replicas := []*server{}
+	replicaAddresses := []string{}
+	for _, identity := range identities {
+		replica, address := startTestServer(ServerConfig{
+			KeyPoolSize: 2, KeyPoolWorkers: 1,
+			ReplicaOf: primaryAddress, ReplicaIdentity: identity})
+		replicas = append(replicas, replica)
+		replicaAddresses = append(replicaAddresses, address)
+	}
+	fmt.Println("Primary listening on", primaryAddress)
+	fmt.Println("Replicas listening on", strings.Join(replicaAddresses, ", "))
+
+	privateKey, publicKey := GenerateRSAKeys()
+	id := RSAKeyToString(publicKey)
+	primary.store.connect(id, privateKey)
+	primary.store.put(id, "greeting", storedValue{data: "hello"})
+	primary.store.createNamespace(id, "team")
+	primary.store.put(id, "@team/plan", storedValue{data: "ship it"})
+	sequence := primary.store.log.position()
+	fmt.Printf("Primary made %d changes\n", sequence)
+
+	for i, replica := range replicas {
+		if !waitForSequence(replica, sequence) {
+			fmt.Printf("Replica %d did not catch up\n", i+1)
+			return
+		}
+		fmt.Printf("Replica %d reached sequence %d\n", i+1, sequence)
+	}
+
+	connection, sessionKey, ok := dialServer(replicaAddresses[0],
+		publicKey, nil)
+	if !ok {
+		fmt.Println("Error connecting to replica 1")
+		return
+	}
+	defer connection.Close()
+	for _, request := range []string{
+		"GET greeting", "GET @team/plan", "DELETE greeting",
+	} {
+		fmt.Printf("Replica 1: %s -> %s\n", request,
+			testRequest(connection, sessionKey, privateKey, request))
+	}
+
+	sequence, _ = replicas[0].promote()
+	fmt.Printf("Promoted replica 1 at sequence %d\n", sequence)
+	for _, request := range []string{"DELETE greeting", "GET greeting"} {
+		fmt.Printf("Replica 1: %s -> %s\n", request,
+			testRequest(connection, sessionKey, privateKey, request))
+	}
+	fmt.Printf("Replica 1 is now at sequence %d, the old primary at %d\n",
+		replicas[0].store.log.position(), primary.store.log.position())
+}
+
+// startTestServer starts a server on a free localhost port.
+//
+// Returns the server and the address it listens on.
+func startTestServer(config ServerConfig) (*server, string) {
+	listener, err := net.Listen(serverType, serverHost+":0")
+	if err != nil {
+		fmt.Println("Error listening:", err.Error())
+		os.Exit(1)
+	}
+	s := newServer(config)
+	if s.listenerTLS != nil {
+		listener = tls.NewListener(listener, s.listenerTLS)
+	}
+	go s.serve(listener)
+	return s, listener.Addr().String()
+}
+
+// waitForSequence waits up to ten seconds for a replica to apply every change
+// up to the given sequence number.
+//
+// Returns true if the replica caught up.
+func waitForSequence(replica *server, sequence uint64) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for replica.store.log.position() < sequence {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// dialServer connects to the server at address, over TLS if a config is given,
+// and registers with CONNECT as the client with the given public key.
+//
+// Returns the connection, the server's session key and true if successful.
+func dialServer(
+	address string,
+	publicKey rsa.PublicKey,
+	transport *tls.Config,
+) (net.Conn, rsa.PublicKey, bool) {
+	connection, err := dialTransport(address, transport)
+	if err != nil {
+		return nil, rsa.PublicKey{}, false
+	}
+	_, err = connection.Write([]byte("CONNECT " + RSAKeyToString(publicKey)))
+	if err != nil {
+		connection.Close()
+		return nil, rsa.PublicKey{}, false
+	}
+	buffer := make([]byte, messageBufferSize)
+	mLen, err := connection.Read(buffer)
+	if err != nil || !strings.HasPrefix(string(buffer[:mLen]), "CONNECT: ") {
+		connection.Close()
+		return nil, rsa.PublicKey{}, false
+	}
+	sessionKey, ok := StringToRSAKey(string(buffer[9:mLen]))
+	if !ok {
+		connection.Close()
+		return nil, rsa.PublicKey{}, false
+	}
+	return connection, sessionKey, true
+}
+
+// serverRequest sends a single command to a server connected with dialServer
+// and waits for the response.
+//
+// Returns the decrypted response and true if successful.
+func serverRequest(
+	connection net.Conn,
+	sessionKey rsa.PublicKey,
+	privateKey *rsa.PrivateKey,
+	request string,
+) (string, bool) {
+	encryptedBytes, ok := EncryptRSA(sessionKey, request)
+	if !ok {
+		return "", false
+	}
+	if _, err := connection.Write(encryptedBytes); err != nil {
+		return "", false
+	}
+	buffer := make([]byte, messageBufferSize)
+	mLen, err := connection.Read(buffer)
+	if err != nil {
+		return "", false
+	}
+	response, ok := DecryptRSA(privateKey, buffer[:mLen])
+	return string(response), ok
+}
+
+// testRequest sends a command to a server for a demonstration.
+//
+// Returns the response, or a description of the error.
+func testRequest(
+	connection net.Conn,
+	sessionKey rsa.PublicKey,
+	privateKey *rsa.PrivateKey,
+	request string,
+) string {
+	response, ok := serverRequest(connection, sessionKey, privateKey, request)
+	if !ok {
+		return "error"
+	}
+	return response
+}
@@ -0,0 +1,235 @@
+package sockets
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Clients speaking protocol version 3 or later receive every response to a
+// command as an envelope, which keeps the outcome apart from the payload:
+//
+//	[command] [status] [category] [message]
+//	[payload]
+//
+// The first line always ends with a newline, even if the payload is empty, so
+// an empty value can be told apart from a missing one. The status is a number
+// in the style of HTTP, and the category names the outcome more precisely,
+// e.g. "GET 404 NOT_FOUND no value is stored under the key". The message is
+// optional and meant for people. Successful responses have the status 200 and
+// the category OK.
+//
+// Clients speaking earlier versions receive the free-form text of the original
+// protocol instead, such as "PUT: OK" or "GET: ERROR", which legacy renders.
+
+// Response statuses.
+const (
+	statusOK          = 200
+	statusInvalid     = 400 // The command or its arguments are malformed.
+	statusDenied      = 403 // The client may not carry out the command.
+	statusNotFound    = 404 // The command's subject does not exist.
+	statusConflict    = 409 // The subject's state prevents the command.
+	statusMisdirected = 421 // Another node must carry out the command.
+	statusUnavailable = 503 // The server cannot carry out commands just now.
+)
+
+// Response categories.
+const (
+	categoryOK          = "OK"
+	categoryInvalid     = "INVALID"
+	categoryUnknown     = "UNKNOWN_COMMAND"
+	categoryDenied      = "DENIED"
+	categoryReadOnly    = "READONLY"
+	categoryNotFound    = "NOT_FOUND"
+	categoryExists      = "EXISTS"
+	categoryNotNumber   = "NOT_NUMBER"
+	categoryMoved       = "MOVED"
+	categoryNotLeader   = "NOT_LEADER"
+	categoryUnavailable = "UNAVAILABLE"
+)
+
+// categoryStatuses gives the status sent with each category.
+var categoryStatuses = map[string]int{
+	categoryOK:          statusOK,
+	categoryInvalid:     statusInvalid,
+	categoryUnknown:     statusInvalid,
+	categoryDenied:      statusDenied,
+	categoryReadOnly:    statusDenied,
+	categoryNotFound:    statusNotFound,
+	categoryExists:      statusConflict,
+	categoryNotNumber:   statusConflict,
+	categoryMoved:       statusMisdirected,
+	categoryNotLeader:   statusUnavailable,
+	categoryUnavailable: statusUnavailable,
+}
+
+// listCommands are the commands whose payload is a list with one entry per
+// line, which the original protocol sends after "[command]:" and a newline.
+var listCommands = map[string]bool{
+	"ACCESS": true,
+	"KEYS":   true,
+}
+
+// response is the outcome of a client command.
+type response struct {
+	command  string
+	status   int
+	category string
+	message  string // Describes a failure to people, if at all.
+	payload  string // The value or list returned, or the leader if NOT_LEADER.
+}
+
+// reply builds the envelope of a successful command.
+//
+// Returns the envelope.
+func reply(command, payload string) string {
+	return response{command: command, status: statusOK,
+		category: categoryOK, payload: payload}.encode()
+}
+
+// replyError builds the envelope of a failed command.
+//
+// Returns the envelope.
+func replyError(command, category, message string) string {
+	return response{command: command, status: categoryStatuses[category],
+		category: category, message: message}.encode()
+}
+
+// ok checks whether the command succeeded.
+func (r response) ok() bool {
+	return r.status == statusOK
+}
+
+// encode builds the response's envelope.
+//
+// Returns the envelope.
+func (r response) encode() string {
+	header := r.command + " " + strconv.Itoa(r.status) + " " + r.category
+	if r.message != "" {
+		header += " " + r.message
+	}
+	return header + "\n" + r.payload
+}
+
+// parseResponse reads a response envelope.
+//
+// Returns the response and true if the text is an envelope.
+func parseResponse(text string) (response, bool) {
+	header, payload, found := strings.Cut(text, "\n")
+	if !found {
+		return response{}, false
+	}
+	fields := strings.SplitN(header, " ", 4)
+	if len(fields) < 3 {
+		return response{}, false
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil || status < 100 || status > 599 {
+		return response{}, false
+	}
+	r := response{command: fields[0], status: status, category: fields[2],
+		payload: payload}
+	if len(fields) == 4 {
+		r.message = fields[3]
+	}
+	return r, true
+}
+
+// legacy renders the response in the original protocol. Failures lose their
+// message, and GET sends a value as is, so an empty value reads as missing.
+//
+// Returns the text to send to a client speaking an earlier version.
+func (r response) legacy() string {
+	switch {
+	case r.category == categoryUnknown:
+		return "DISCONNECT: UNKNOWN COMMAND"
+	case r.category == categoryNotFound &&
+		(r.command == "GROUP" || r.command == "NODES"):
+		return r.command + ": NONE"
+	case r.category == categoryReadOnly || r.category == categoryMoved:
+		return r.command + ": ERROR " + r.category
+	case r.category == categoryNotLeader:
+		return strings.TrimSpace(r.command + ": ERROR NOTLEADER " + r.payload)
+	case !r.ok():
+		return r.command + ": ERROR"
+	case r.command == "GET" && r.payload == "":
+		return "GET: ERROR"
+	case r.command == "GET":
+		return r.payload
+	case listCommands[r.command]:
+		return r.command + ":\n" + r.payload
+	case r.command == "GROUP" && strings.HasPrefix(r.payload, "EPOCH "):
+		return "GROUP: OK " + strings.TrimPrefix(r.payload, "EPOCH ")
+	case r.payload == "":
+		return r.command + ": OK"
+	}
+	return r.command + ": " + r.payload
+}
+
+// parseLegacyResponse reads a response in the original protocol, undoing
+// legacy. The command that was sent must be given, since a value returned by
+// GET carries no command of its own. If it is not given, it is taken from the
+// text.
+//
+// Returns the response.
+func parseLegacyResponse(command, text string) response {
+	if command == "" {
+		command, _, _ = strings.Cut(text, ":")
+	}
+	prefix := command + ": "
+	failure := func(category, payload string) response {
+		return response{command: command, status: categoryStatuses[category],
+			category: category, payload: payload}
+	}
+	success := func(payload string) response {
+		return response{command: command, status: statusOK,
+			category: categoryOK, payload: payload}
+	}
+
+	switch {
+	case text == "DISCONNECT: UNKNOWN COMMAND":
+		return failure(categoryUnknown, "")
+	case text == prefix+"NONE" && (command == "GROUP" || command == "NODES"):
+		return failure(categoryNotFound, "")
+	case text == prefix+"ERROR" || strings.HasPrefix(text, prefix+"ERROR "):
+		reason := strings.TrimSpace(strings.TrimPrefix(text, prefix+"ERROR"))
+		switch {
+		case reason == categoryReadOnly || reason == categoryMoved:
+			return failure(reason, "")
+		case strings.HasPrefix(reason, "NOTLEADER"):
+			return failure(categoryNotLeader,
+				strings.TrimSpace(strings.TrimPrefix(reason, "NOTLEADER")))
+		case command == "GET" || command == "DELETE":
+			return failure(categoryNotFound, "")
+		}
+		return failure(categoryDenied, "")
+	case command == "GET":
+		return success(text)
+	case listCommands[command]:
+		return success(strings.TrimPrefix(text, command+":\n"))
+	case text == prefix+"OK":
+		return success("")
+	case command == "GROUP" && strings.HasPrefix(text, "GROUP: OK "):
+		return success("EPOCH " + strings.TrimPrefix(text, "GROUP: OK "))
+	}
+	return success(strings.TrimPrefix(text, prefix))
+}
+
+// String describes the response to people, as the original protocol would
+// but with the status, category and message of a failure.
+func (r response) String() string {
+	if r.ok() && r.command == "GET" {
+		return r.payload
+	}
+	if r.ok() {
+		return r.legacy()
+	}
+	description := r.command + ": ERROR " + strconv.Itoa(r.status) + " " +
+		r.category
+	if r.message != "" {
+		description += " " + r.message
+	}
+	if r.category == categoryNotLeader && r.payload != "" {
+		description += " " + r.payload
+	}
+	return description
+}
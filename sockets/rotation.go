@@ -0,0 +1,428 @@
+package sockets
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// "ROTATE" replaces the client's data key with a new one from GenerateAESKey.
+// New values are encrypted with the new key, whose ID their envelopes carry,
+// while the old key is kept as a retired key so that values written with it
+// can still be read. In the background, the client then lists its keys with
+// "KEYS" and re-encrypts every value that is not yet encrypted with the new
+// key, writing it back with PUT. Once every value is re-encrypted, the retired
+// keys are forgotten.
+//
+// A data key file holds the current key on its first line, followed by the
+// retired keys while values are re-encrypted, so a client that stopped during
+// a rotation resumes it when it starts again. If re-encryption is interrupted
+// by an error, ROTATE resumes it rather than generating another key. Values
+// already encrypted with the new key are skipped, and values written or
+// deleted by the user during a rotation are left as the user left them.
+// Servers before protocol version 4 close the connection on KEYS, so
+// rotation needs a later server.
+//
+// Once re-encryption stops, its outcome is reported as "ROTATE: OK" or
+// "ROTATE: ERROR". A value that cannot be decrypted with any data key is left
+// as it is, and the retired keys are kept so that no value becomes unreadable
+// because of the rotation. Once such values are deleted or written again,
+// ROTATE resumes the rotation.
+
+var dataKeyFile string             // The file holding the data keys, if any.
+var retiredKeys [][]byte           // Earlier data keys still encrypting values.
+var rotationWrites map[string]bool // Keys written during re-encryption, if running.
+var rotationMutex sync.Mutex       // Guards aesKey and the rotation state.
+var rotationOrder sync.Mutex       // Orders the user's writes and re-encryption's.
+
+// rotationFinished is told the outcome of each re-encryption of the client's
+// values, which the REPL prints.
+var rotationFinished = printRotationResult
+
+// errUndecryptable is returned for a value no data key decrypts.
+var errUndecryptable = errors.New("value cannot be decrypted with any data key")
+
+// printRotationResult prints the outcome of re-encrypting the client's values.
+func printRotationResult(result string) {
+	fmt.Printf("\u001b[0K%s\n> ", result)
+}
+
+// LoadDataKeys reads the client's data keys from the file at path: the current
+// key on the first line, followed by any retired keys still encrypting
+// values. If the file does not exist, a new key is generated with LoadAESKey.
+//
+// Returns the current key, the retired keys and true if successful.
+func LoadDataKeys(path string) ([]byte, [][]byte, bool) {
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, ok := LoadAESKey(path)
+		return key, nil, ok
+	}
+	if err != nil {
+		defaultLogger.error("Error reading AES key", "path", path, "error", err)
+		return []byte{}, nil, false
+	}
+
+	keys := [][]byte{}
+	for _, line := range strings.Fields(string(encoded)) {
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			defaultLogger.error("File does not contain AES-256 keys", "path", path)
+			return []byte{}, nil, false
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		defaultLogger.error("File does not contain AES-256 keys", "path", path)
+		return []byte{}, nil, false
+	}
+	return keys[0], keys[1:], true
+}
+
+// saveDataKeys writes the client's data keys to the file at path in the form
+// read by LoadDataKeys. The file is written to a temporary path first and
+// renamed into place, so an interrupted save never loses a key.
+//
+// Returns true if successful.
+func saveDataKeys(path string, current []byte, retired [][]byte) bool {
+	lines := hex.EncodeToString(current) + "\n"
+	for _, key := range retired {
+		lines += hex.EncodeToString(key) + "\n"
+	}
+	err := os.WriteFile(path+".tmp", []byte(lines), 0600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		clientLog.error("Error saving AES keys", "path", path, "error", err)
+		return false
+	}
+	return true
+}
+
+// currentDataKey finds the key encrypting new values.
+//
+// Returns the key.
+func currentDataKey() []byte {
+	rotationMutex.Lock()
+	defer rotationMutex.Unlock()
+	return aesKey
+}
+
+// decryptDataValue decrypts a value encrypted with the client's current or a
+// retired data key, choosing the key its envelope names. A value without an
+// envelope is tried with each key.
+//
+// Returns the plaintext and true if successful.
+func decryptDataValue(encryptedBytes []byte) ([]byte, bool) {
+	rotationMutex.Lock()
+	keys := append([][]byte{aesKey}, retiredKeys...)
+	rotationMutex.Unlock()
+
+	sealed, isEnvelope := parseEnvelope(encryptedBytes)
+	for _, key := range keys {
+		if isEnvelope && !bytes.Equal(sealed.keyID, keyID(key)) {
+			continue
+		}
+		if plaintext, ok := DecryptValue(key, encryptedBytes); ok {
+			return plaintext, true
+		}
+		if isEnvelope {
+			break
+		}
+	}
+	return []byte{}, false
+}
+
+// noteRotationWrite records that the user is about to write or delete a
+// private key, so that re-encryption does not overwrite it with an older value.
+// It must be called before the request is begun.
+func noteRotationWrite(key string) {
+	rotationOrder.Lock()
+	defer rotationOrder.Unlock()
+	rotationMutex.Lock()
+	defer rotationMutex.Unlock()
+	if rotationWrites != nil {
+		rotationWrites[key] = true
+	}
+}
+
+// rotateInput carries out "ROTATE" by generating a new data key, or resuming
+// an interrupted rotation, and re-encrypting the client's values in the
+// background.
+func rotateInput(seed net.Conn) {
+	if !listsKeys(routeInput(seed, "KEYS")) {
+		fmt.Println("ROTATE: ERROR server cannot list this client's keys")
+		return
+	}
+	rotationMutex.Lock()
+	if rotationWrites != nil {
+		rotationMutex.Unlock()
+		fmt.Println("ROTATE: ERROR data key rotation is already running")
+		return
+	}
+	if len(retiredKeys) > 0 {
+		rotationMutex.Unlock()
+		fmt.Println("ROTATE: OK resuming re-encryption")
+		go reencryptValues(seed)
+		return
+	}
+	key := GenerateAESKey()
+	retired := [][]byte{aesKey}
+	if dataKeyFile != "" && !saveDataKeys(dataKeyFile, key, retired) {
+		rotationMutex.Unlock()
+		fmt.Println("ROTATE: ERROR failed to save the new data key")
+		return
+	}
+	aesKey, retiredKeys = key, retired
+	rotationMutex.Unlock()
+	fmt.Printf("ROTATE: OK new data key %x\n", keyID(key))
+	go reencryptValues(seed)
+}
+
+// reencryptValues re-encrypts every private value of the client that is not
+// encrypted with the current data key, then forgets the retired keys and
+// reports the outcome to rotationFinished. If a request fails or a value
+// cannot be decrypted, the retired keys are kept so that the rotation can be
+// resumed.
+func reencryptValues(seed net.Conn) {
+	rotationMutex.Lock()
+	if rotationWrites != nil || len(retiredKeys) == 0 {
+		rotationMutex.Unlock()
+		return
+	}
+	rotationWrites = map[string]bool{}
+	rotationMutex.Unlock()
+
+	result := reencryptListedValues(seed)
+	rotationMutex.Lock()
+	rotationWrites = nil
+	rotationMutex.Unlock()
+	rotationFinished(result)
+}
+
+// reencryptListedValues lists the client's keys and re-encrypts the value of
+// each, forgetting the retired keys if every value was re-encrypted.
+//
+// Returns the outcome, "ROTATE: OK" or "ROTATE: ERROR" followed by details.
+func reencryptListedValues(seed net.Conn) string {
+	interrupted := "ROTATE: ERROR re-encryption was interrupted, ROTATE resumes it"
+	connection := routeInput(seed, "KEYS")
+	if !listsKeys(connection) {
+		clientLog.warn("Server cannot list keys to re-encrypt")
+		return "ROTATE: ERROR server cannot list this client's keys"
+	}
+	listing := requestResponse(connection, "KEYS")
+	if !listing.ok() {
+		clientLog.warn("Data key rotation interrupted, ROTATE resumes it",
+			"response", listing.String())
+		return interrupted
+	}
+	rotated, skipped, failed := 0, 0, 0
+	for _, key := range strings.Split(listing.payload, "\n") {
+		if key == "" {
+			continue
+		}
+		changed, err := reencryptValue(connection, key)
+		if errors.Is(err, errUndecryptable) {
+			clientLog.warn("Value cannot be decrypted with any data key",
+				"key", key)
+			failed++
+			continue
+		}
+		if err != nil {
+			clientLog.warn("Data key rotation interrupted, ROTATE resumes it",
+				"key", key, "error", err, "rotated", rotated)
+			return interrupted
+		}
+		if changed {
+			rotated++
+		} else {
+			skipped++
+		}
+	}
+	if failed > 0 {
+		clientLog.warn("Data key rotation incomplete, retired keys kept",
+			"rotated", rotated, "failed", failed)
+		return fmt.Sprintf("ROTATE: ERROR %d values cannot be decrypted "+
+			"with any data key, so the retired keys are kept", failed)
+	}
+
+	rotationMutex.Lock()
+	defer rotationMutex.Unlock()
+	if dataKeyFile != "" && !saveDataKeys(dataKeyFile, aesKey, nil) {
+		return "ROTATE: ERROR failed to save the data keys"
+	}
+	retiredKeys = nil
+	clientLog.info("Data key rotation complete",
+		"rotated", rotated, "skipped", skipped)
+	return fmt.Sprintf("ROTATE: OK %d values re-encrypted", rotated)
+}
+
+// listsKeys checks whether the server at the other end of a connection answers
+// KEYS.
+func listsKeys(connection net.Conn) bool {
+	return serverProtocolFor(connection).version >= protocolV4
+}
+
+// reencryptValue re-encrypts the value stored under a private key with the
+// current data key, unless it already is or the user wrote it during the
+// rotation.
+//
+// Returns whether the value was re-encrypted, or errUndecryptable if no data
+// key decrypts the value, or another error if a request failed.
+func reencryptValue(connection net.Conn, key string) (bool, error) {
+	stored := requestResponse(connection, "GET "+key)
+	if stored.category == categoryNotFound {
+		return false, nil
+	}
+	if !stored.ok() {
+		return false, errors.New(stored.String())
+	}
+	value := []byte(stored.payload)
+	current := currentDataKey()
+	if sealed, ok := parseEnvelope(value); ok &&
+		bytes.Equal(sealed.keyID, keyID(current)) {
+		return false, nil
+	}
+	plaintext, ok := decryptDataValue(value)
+	if !ok {
+		return false, errUndecryptable
+	}
+	ciphertext, ok := EncryptValue(valueCipherSuite, current, string(plaintext))
+	if !ok {
+		return false, errors.New("error encrypting value")
+	}
+
+	// The request is begun while rotationOrder is held, so that a write by
+	// the user is either noted before it or sent after it.
+	rotationOrder.Lock()
+	rotationMutex.Lock()
+	written := rotationWrites[key]
+	rotationMutex.Unlock()
+	if written {
+		rotationOrder.Unlock()
+		return false, nil
+	}
+	pending := beginRequest(connection, "PUT "+key)
+	rotationOrder.Unlock()
+	endRequest(connection, pending, ciphertext)
+	if result := <-pending.result; !result.ok() {
+		return false, errors.New(result.String())
+	}
+	return true, nil
+}
+
+// TestRotation connects a client to a server, stores values encrypted with
+// its data key and rotates the key, showing each value re-encrypted with the
+// new key. It then saves a retired key as a client stopped during a rotation
+// would, and resumes the rotation as that client does when it starts again
+// and connects anew.
+// Finally, a value encrypted with an unknown key keeps a rotation from
+// completing until the value is deleted.
+func TestRotation() {
+	configureLogging(LogConfig{Level: "error"})
+	clientLog = defaultLogger
+	connectionStateChanged = func(string, ConnectionState) {}
+	results := make(chan string, 1)
+	rotationFinished = func(result string) { results <- result }
+	s, address := startTestServer(ServerConfig{KeyPoolSize: 2, KeyPoolWorkers: 1})
+	directory, err := os.MkdirTemp("", "rotation")
+	if err != nil {
+		fmt.Println("Error creating directory:", err.Error())
+		return
+	}
+	defer os.RemoveAll(directory)
+	clientPrivateKey, _ = GenerateIdentityKey(keyEd25519)
+	clientPublicKey = clientPrivateKey.Public()
+	dataKeyFile = directory + "/data.key"
+	aesKey, retiredKeys, _ = LoadDataKeys(dataKeyFile)
+	connection, ok := dialConnection(address, clientHandshake)
+	if !ok {
+		fmt.Println("Error connecting")
+		return
+	}
+	go readServerMessages(connection)
+
+	put := func(key string, value []byte) {
+		pending := beginRequest(connection, "PUT "+key)
+		endRequest(connection, pending, value)
+		<-pending.result
+	}
+	show := func() {
+		for _, key := range []string{"greeting", "colour", "legacy"} {
+			stored := requestResponse(connection, "GET "+key)
+			sealed, isEnvelope := parseEnvelope([]byte(stored.payload))
+			plaintext, _ := decryptDataValue([]byte(stored.payload))
+			fmt.Printf("  %s: envelope %t, key %x, value %q\n",
+				key, isEnvelope, sealed.keyID, plaintext)
+		}
+	}
+	retired := func() int {
+		rotationMutex.Lock()
+		defer rotationMutex.Unlock()
+		return len(retiredKeys)
+	}
+
+	greeting, _ := EncryptValue("", aesKey, "hello")
+	colour, _ := EncryptValue("aes-256-ctr-hmac-sha256", aesKey, "blue")
+	legacy, _ := EncryptAES(aesKey, "written before envelopes")
+	put("greeting", greeting)
+	put("colour", colour)
+	put("legacy", legacy)
+	fmt.Printf("Values stored with data key %x:\n", keyID(aesKey))
+	show()
+
+	rotateInput(connection)
+	fmt.Println(<-results)
+	fmt.Println("After ROTATE:")
+	show()
+
+	// A client stopped during a rotation saved a new key beside the old one.
+	// It connects again once the server has ended its session.
+	connection.Close()
+	for {
+		s.sessionsMutex.Lock()
+		active := len(s.sessions)
+		s.sessionsMutex.Unlock()
+		if active == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	oldKey := aesKey
+	saveDataKeys(dataKeyFile, GenerateAESKey(), [][]byte{oldKey})
+	aesKey, retiredKeys, _ = LoadDataKeys(dataKeyFile)
+	fmt.Printf("Restarted with data key %x and %d retired key\n",
+		keyID(aesKey), len(retiredKeys))
+	connection, ok = dialConnection(address, clientHandshake)
+	if !ok {
+		fmt.Println("Error connecting")
+		return
+	}
+	go readServerMessages(connection)
+	reencryptValues(connection)
+	fmt.Println(<-results)
+	_, saved, _ := LoadDataKeys(dataKeyFile)
+	fmt.Printf("After resuming, %d retired keys are saved:\n", len(saved))
+	show()
+
+	// A value no data key decrypts keeps the retired keys until it is gone.
+	foreign, _ := EncryptValue("", GenerateAESKey(), "unknown key")
+	put("foreign", foreign)
+	rotateInput(connection)
+	fmt.Println(<-results)
+	fmt.Printf("%d retired keys are kept\n", retired())
+	requestResponse(connection, "DELETE foreign")
+	rotateInput(connection)
+	fmt.Println(<-results)
+	fmt.Printf("After deleting the value, %d retired keys are kept\n", retired())
+	requestResponse(connection, "DISCONNECT")
+	connection.Close()
+}
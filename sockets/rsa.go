@@ -5,10 +5,13 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"math/big"
-	"strconv"
-	"strings"
+	"os"
 )
 
 // GenerateRSAKeys generates a 2048 bit RSA keypair using a cryptographically
@@ -24,43 +27,149 @@ func GenerateRSAKeys() (*rsa.PrivateKey, rsa.PublicKey) {
 	return privateKey, privateKey.PublicKey
 }
 
+// LoadRSAKeys reads a PEM encoded RSA private key from the file at path. If
+// the file does not exist, a new keypair is generated with GenerateRSAKeys and
+// saved there, so that a client keeps the same identity between runs.
+//
+// Returns a pointer to the private key, a copy of the public key and true if
+// successful. Otherwise returns nil, an empty public key and false.
+func LoadRSAKeys(path string) (*rsa.PrivateKey, rsa.PublicKey, bool) {
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		privateKey, publicKey := GenerateRSAKeys()
+		block := &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		}
+		err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			defaultLogger.error("Error saving RSA key", "path", path,
+				"error", err)
+			return nil, rsa.PublicKey{}, false
+		}
+		return privateKey, publicKey, true
+	}
+	if err != nil {
+		defaultLogger.error("Error reading RSA key", "path", path, "error", err)
+		return nil, rsa.PublicKey{}, false
+	}
+
+	block, _ := pem.Decode(encoded)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		defaultLogger.error("File does not contain an RSA key", "path", path)
+		return nil, rsa.PublicKey{}, false
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		defaultLogger.error("Error parsing RSA key", "path", path, "error", err)
+		return nil, rsa.PublicKey{}, false
+	}
+	return privateKey, privateKey.PublicKey, true
+}
+
 // EncryptRSA will use the given public key to encrypt the given plaintext using
 // RSA-OEAP (Optimal Asymmetric Encryption Padding) encryption. The plaintext is
 // hashed with SHA256 and salted with crypto/rand.Reader generated bits.
+// Plaintext longer than a single RSA-OAEP block allows is split into blocks
+// that are encrypted separately and concatenated.
 //
 // Returns a ciphertext byte array and true if successful. Otherwise returns an
 // empty array and a false value.
 func EncryptRSA(publicKey rsa.PublicKey, plainText string) ([]byte, bool) {
-	encryptedBytes, err := rsa.EncryptOAEP(
-		sha256.New(),
-		rand.Reader,
-		&publicKey,
-		[]byte(plainText),
-		nil)
-	if err != nil {
+	return encryptRSABlocks(publicKey, plainText, 0)
+}
+
+// encryptRSABlocks encrypts plaintext as EncryptRSA does. If bound is not 0,
+// every block after the first is labelled with the first bound bytes of the
+// plaintext and the block's index, so that blocks cannot be moved between
+// messages starting differently or within a message.
+//
+// Returns a ciphertext byte array and true if successful.
+func encryptRSABlocks(publicKey rsa.PublicKey, plainText string, bound int) ([]byte, bool) {
+	blockSize := publicKey.Size() - 2*sha256.Size - 2
+	if blockSize <= 0 || blockSize < bound || len(plainText) < bound {
 		return []byte{}, false
 	}
 
+	encryptedBytes := []byte{}
+	remaining := []byte(plainText)
+	for index := 0; index == 0 || len(remaining) > 0; index++ {
+		block := remaining
+		if len(block) > blockSize {
+			block = block[:blockSize]
+		}
+		remaining = remaining[len(block):]
+
+		encryptedBlock, err := rsa.EncryptOAEP(
+			sha256.New(),
+			rand.Reader,
+			&publicKey,
+			block,
+			blockLabel([]byte(plainText), bound, index))
+		if err != nil {
+			return []byte{}, false
+		}
+		encryptedBytes = append(encryptedBytes, encryptedBlock...)
+	}
+
 	return encryptedBytes, true
 }
 
 // DecryptRSA uses the given private key to decrypt the given bytes. It is assumed
-// the bytes were encrypted with RSA-OEAP and hashed with SHA256.
+// the bytes were encrypted with RSA-OEAP and hashed with SHA256, one or more
+// blocks at a time as produced by EncryptRSA.
 //
 // Returns a plaintext byte array and true if successful. Otherwise returns an
 // empty byte array and false
 func DecryptRSA(privateKey *rsa.PrivateKey, encryptedBytes []byte) ([]byte, bool) {
-	decryptedBytes, err := privateKey.Decrypt(
-		nil,
-		encryptedBytes,
-		&rsa.OAEPOptions{Hash: crypto.SHA256})
-	if err != nil {
+	return decryptRSABlocks(privateKey, encryptedBytes, 0)
+}
+
+// decryptRSABlocks decrypts bytes encrypted by encryptRSABlocks with the same
+// bound.
+//
+// Returns a plaintext byte array and true if successful.
+func decryptRSABlocks(
+	privateKey *rsa.PrivateKey,
+	encryptedBytes []byte,
+	bound int,
+) ([]byte, bool) {
+	keySize := privateKey.Size()
+	if len(encryptedBytes) == 0 || len(encryptedBytes)%keySize != 0 {
 		return []byte{}, false
 	}
 
+	decryptedBytes := []byte{}
+	for i := 0; i < len(encryptedBytes); i += keySize {
+		decryptedBlock, err := privateKey.Decrypt(
+			nil,
+			encryptedBytes[i:i+keySize],
+			&rsa.OAEPOptions{Hash: crypto.SHA256,
+				Label: blockLabel(decryptedBytes, bound, i/keySize)})
+		if err != nil {
+			return []byte{}, false
+		}
+		decryptedBytes = append(decryptedBytes, decryptedBlock...)
+		if len(decryptedBytes) < bound {
+			return []byte{}, false
+		}
+	}
+
 	return decryptedBytes, true
 }
 
+// blockLabel finds the label of a block encrypted by encryptRSABlocks, given
+// the plaintext, of which at least the first block is needed.
+//
+// Returns the label, or nil if the block is not labelled.
+func blockLabel(plainText []byte, bound, index int) []byte {
+	if bound == 0 || index == 0 {
+		return nil
+	}
+	return binary.BigEndian.AppendUint32(
+		append([]byte{}, plainText[:bound]...), uint32(index))
+}
+
 // SignRSA uses the given private key to sign a checksummed hash generated from the
 // given plaintext. The hash is generated with SHA256 and salted with
 // crypto/rand.Reader, and the signature is generated with RSASSA-PSS.
@@ -102,41 +211,55 @@ func VerifyRSA(
 		signature,
 		nil)
 	if err != nil {
-		fmt.Println(err)
+		defaultLogger.debug("Signature verification failed", "error", err)
 		return false
 	}
 	return true
 }
 
-// RSAKeyToString converts a given RSA public key to a string. The string
-// contains the modulus and the exponent separated by a '-' character.
-// e.g. "[modulus]-[exponent]"
+// RSAKeyToString converts a given RSA public key to a string, as
+// PublicKeyToString does.
+// e.g. "rsa:[PKIX encoding]"
 //
 // Returns the created string
 func RSAKeyToString(publicKey rsa.PublicKey) string {
-	return publicKey.N.String() + "-" + strconv.Itoa(publicKey.E)
+	return PublicKeyToString(&publicKey)
 }
 
 // StringToRSAKey converts a given string into an RSA public key. The string
-// must contain the modulus followed by the exponent separated by a '-'
-// character.
+// may be in the form produced by RSAKeyToString, or contain the modulus
+// followed by the exponent separated by a '-' character as written before
+// protocol version 4.
 // e.g. "[modulus]-[exponent]"
 //
 // Returns the created crypto/rsa.PublicKey
 func StringToRSAKey(publicKey string) (rsa.PublicKey, bool) {
-	strs := strings.Split(publicKey, "-")
-	bi := big.NewInt(0)
-	_, ok := bi.SetString(strs[0], 10)
+	parsed, ok := StringToPublicKey(publicKey)
 	if !ok {
-		fmt.Println("ERROR: Failed to convert public key to big int")
 		return rsa.PublicKey{}, false
 	}
-	exponent, err := strconv.Atoi(strs[1])
-	if err != nil {
-		fmt.Println("ERROR: Failed to convert exponent to int")
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		defaultLogger.warn("Public key is not an RSA key")
 		return rsa.PublicKey{}, false
 	}
-	return rsa.PublicKey{N: bi, E: exponent}, true
+	return *key, true
+}
+
+// RSAKeyFingerprint identifies a public key by the SHA256 hash of its string
+// form. Fingerprints are used to grant other clients access to shared data.
+//
+// Returns the hash as a hexadecimal string.
+func RSAKeyFingerprint(publicKey rsa.PublicKey) string {
+	return fingerprint(RSAKeyToString(publicKey))
+}
+
+// fingerprint identifies a public key by the SHA256 hash of its string form,
+// as produced by PublicKeyToString.
+//
+// Returns the hash as a hexadecimal string.
+func fingerprint(publicKey string) string {
+	return hex.EncodeToString(generateHashSumRSA(publicKey))
 }
 
 // TestRSA runs a demonstration of RSA encryption and signing.
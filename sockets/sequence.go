@@ -0,0 +1,162 @@
+package sockets
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Once the "sequencing" capability is agreed, every message after CONNECT in
+// either direction, including values following PUT, starts with a header
+// before it is encrypted:
+//   - 8 bytes identifying the session, taken from the hash of the server's
+//     session key, so that messages cannot be moved between sessions.
+//   - The message's number as an 8-byte big endian integer. Each side numbers
+//     the messages it sends from 1.
+//
+// A message is only accepted if its number follows the last one received, so
+// a message sent again, skipped or moved ends the session. When RSA encrypts
+// a message longer than a block, every later block is labelled with the
+// header, so that blocks cannot be moved between messages either.
+
+// capabilitySequencing is the capability numbering messages.
+const capabilitySequencing = "sequencing"
+
+// sequenceHeaderSize is the length of the header starting each message.
+const sequenceHeaderSize = 16
+
+// Reasons a message is refused.
+var (
+	errOtherSession   = errors.New("message belongs to another session")
+	errReplayed       = errors.New("message was already received")
+	errMessageSkipped = errors.New("messages are missing")
+)
+
+// sequence numbers the messages sent and received in a session. Each side
+// has its own.
+type sequence struct {
+	session  []byte // Identifies the session.
+	sent     uint64 // The number of the last message sent.
+	received uint64 // The number of the last message received.
+}
+
+// newSequence starts numbering the messages of the session using the given
+// session key, written in the form both sides read whatever version they
+// speak.
+//
+// Returns the sequence.
+func newSequence(sessionKey rsa.PublicKey) *sequence {
+	hash := sha256.Sum256([]byte(legacyRSAKeyString(&sessionKey)))
+	return &sequence{session: hash[:8]}
+}
+
+// seal adds the header of the next message sent to a message.
+//
+// Returns the message with its header.
+func (q *sequence) seal(message string) string {
+	q.sent++
+	header := binary.BigEndian.AppendUint64(
+		append([]byte{}, q.session...), q.sent)
+	return string(header) + message
+}
+
+// open checks the header of a message received and removes it.
+//
+// Returns the message without its header, or an error if it does not follow
+// the last message received.
+func (q *sequence) open(message []byte) ([]byte, error) {
+	if len(message) < sequenceHeaderSize {
+		return nil, errors.New("message has no sequence number")
+	}
+	if string(message[:8]) != string(q.session) {
+		return nil, errOtherSession
+	}
+	number := binary.BigEndian.Uint64(message[8:sequenceHeaderSize])
+	switch {
+	case number <= q.received:
+		return nil, fmt.Errorf("%w: number %d, expected %d",
+			errReplayed, number, q.received+1)
+	case number > q.received+1:
+		return nil, fmt.Errorf("%w: number %d, expected %d",
+			errMessageSkipped, number, q.received+1)
+	}
+	q.received = number
+	return message[sequenceHeaderSize:], nil
+}
+
+// headerSize is the length of the header starting the messages of a session,
+// if sequencing was agreed.
+//
+// Returns the length, or 0 if messages are not numbered.
+func (q *sequence) headerSize() int {
+	if q == nil {
+		return 0
+	}
+	return sequenceHeaderSize
+}
+
+// TestSequencing connects to a server agreeing sequencing without a key
+// exchange, so that messages are encrypted with RSA, and sends requests, one
+// longer than an RSA block. It then sends the first request again as an attacker
+// replaying it would, showing the server ending the session.
+func TestSequencing() {
+	configureLogging(LogConfig{Level: "error"})
+	_, address := startTestServer(ServerConfig{KeyPoolSize: 2, KeyPoolWorkers: 1})
+	privateKey, publicKey := GenerateRSAKeys()
+
+	connection, err := dialTransport(address, nil)
+	if err != nil {
+		fmt.Println("Error connecting:", err.Error())
+		return
+	}
+	defer connection.Close()
+	offer := connectOffer{id: RSAKeyToString(publicKey),
+		versions:     []int{protocolV3},
+		capabilities: []string{capabilityPipelining, capabilitySequencing}}
+	connection.Write([]byte("CONNECT " + offer.String()))
+	buffer := make([]byte, messageBufferSize)
+	mLen, err := connection.Read(buffer)
+	sessionKey, agreed, ok := parseConnectReply(string(buffer[:mLen]))
+	serverKey, keyOK := StringToRSAKey(sessionKey)
+	if err != nil || !ok || !keyOK {
+		fmt.Println("Error during CONNECT")
+		return
+	}
+	fmt.Println("Agreed protocol:", agreed.String())
+	outgoing, incoming := newSequence(serverKey), newSequence(serverKey)
+
+	encrypt := func(message string) []byte {
+		encryptedBytes, _ := encryptRSABlocks(serverKey,
+			outgoing.seal(message), sequenceHeaderSize)
+		return encryptedBytes
+	}
+	request := func(encryptedBytes []byte) string {
+		if _, err := agreed.writeMessage(connection, encryptedBytes); err != nil {
+			return "error"
+		}
+		buffer, err := agreed.readMessage(connection)
+		if err != nil {
+			return "connection closed"
+		}
+		decryptedBytes, ok := decryptRSABlocks(privateKey, buffer,
+			sequenceHeaderSize)
+		if !ok {
+			return "error"
+		}
+		response, err := incoming.open(decryptedBytes)
+		if err != nil {
+			return err.Error()
+		}
+		return strings.TrimSpace(string(response))
+	}
+
+	create := encrypt("CREATE team")
+	fmt.Println("CREATE team ->", request(create))
+	get := encrypt("GET " + strings.Repeat("k", 300))
+	fmt.Printf("GET kkk... (%d RSA blocks) -> %s\n",
+		len(get)/serverKey.Size(), request(get))
+	fmt.Println("CREATE team replayed ->", request(create))
+}
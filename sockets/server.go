@@ -2,75 +2,331 @@
 package sockets
 
 import (
+	"crypto"
 	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	clientsFname = "clients.txt"
 	serverType   = "tcp"
 	serverHost   = "localhost"
+
+	// messageBufferSize is the largest message read from a connection at once.
+	messageBufferSize = 4096
+
+	// expiryInterval is how often expired values are deleted from the store.
+	expiryInterval = time.Second
 )
 
+// ServerConfig holds the options used to run a Server.
+type ServerConfig struct {
+	KeyPoolSize    int       // Number of RSA keypairs kept ready for new sessions.
+	KeyPoolWorkers int       // Number of goroutines refilling the key pool.
+	MetricsAddr    string    // Address of the HTTP metrics listener, if any.
+	AdminSocket    string    // Path of the admin Unix socket, if any.
+	SnapshotFile   string    // Default file written by the SNAPSHOT command.
+	GatewayAddr    string    // Address of the HTTP gateway, if any.
+	RedisAddr      string    // Address of the RESP listener, if any.
+	RedisPassword  string    // Password RESP clients must send with AUTH, if any.
+	MemcachedAddr  string    // Address of the memcached listener, if any.
+	IdentityFile   string    // File holding the key signing key exchanges, if any.
+	KeyAlgorithm   string    // Algorithm of a new identity key, e.g. "ed25519".
+	Log            LogConfig // Logging level, format and debug mode.
+
+	TLSCert string // File holding the TLS certificate, if clients use TLS.
+	TLSKey  string // File holding the RSA key the certificate was issued for.
+	TLSCA   string // File holding the CA certificate other nodes are checked against.
+
+	TLSClientCA string // File holding the CAs client certificates are checked against, if required.
+	TLSCRL      string // File holding the CAs' revocation lists, if any.
+	TLSIdentity string // How a client certificate names its client: "key" or "subject".
+
+	SocketMode os.FileMode // Permissions of the Unix domain socket, if listening on one.
+	SocketUIDs []int       // Users allowed to connect over the socket, if restricted.
+	SocketGIDs []int       // Groups allowed to connect over the socket, if restricted.
+
+	ReplicaOf          string   // Address of the primary to follow, if a replica.
+	ReplicaIdentity    string   // File holding the RSA key a replica connects with.
+	ReplicaKeys        []string // Fingerprints of the replicas allowed to follow.
+	ReplicationLogSize int      // Number of recent changes kept for replicas.
+
+	ClusterNodes    []string // Addresses of the cluster's nodes, if clustered.
+	ClusterAddress  string   // This node's address as other nodes reach it.
+	ClusterIdentity string   // File holding the RSA key this node connects with.
+	ClusterKeys     []string // Fingerprints of the cluster's nodes.
+
+	RaftNodes     []string // Addresses of the Raft group's initial nodes.
+	RaftAddress   string   // This node's address as other nodes reach it.
+	RaftIdentity  string   // File holding the RSA key this node connects with.
+	RaftKeys      []string // Fingerprints of the Raft group's nodes.
+	RaftDirectory string   // Directory keeping the node's Raft state, if any.
+}
+
 type ClientData struct {
-	clientID         string            // The client's given ID.
-	clientData       map[string]string // A mapping of key strings to value strings.
-	serverPrivateKey *rsa.PrivateKey   // The keys used for conversation with this client.
+	clientID         string                 // The client's given ID.
+	clientData       map[string]storedValue // A mapping of key strings to values.
+	serverPrivateKey *rsa.PrivateKey        // The keys used for conversation with this client.
+}
+
+// server holds the state shared by every client session.
+type server struct {
+	store       *store        // The data of every connected client.
+	pool        *keyPool      // Pre-generated session keys.
+	metrics     *metrics      // Counters and histograms describing the sessions.
+	log         *logger       // The server-wide logger.
+	connections atomic.Uint64 // Number of connections accepted so far.
+	config      ServerConfig
+
+	sessionsMutex sync.Mutex
+	sessions      map[uint64]*session // Open sessions by connection number.
+
+	replica          atomic.Bool // Whether the server follows a primary.
+	replicationMutex sync.Mutex
+	primary          net.Conn // The connection to the primary, if a replica.
+
+	ringMutex      sync.RWMutex
+	ring           *hashRing       // The cluster's nodes, or nil if not clustered.
+	rebalanceMutex sync.Mutex      // Held while namespaces move to other nodes.
+	nodeKey        *rsa.PrivateKey // This node's identity, if clustered.
+
+	raft *raftNode // This node's part in a Raft group, if any.
+
+	identity crypto.Signer // Signs the server's part of key exchanges.
+
+	listenerTLS *tls.Config     // The TLS config clients connect with, if any.
+	peerTLS     *tls.Config     // The TLS config used to connect to other nodes.
+	revocations *revocationList // Revoked client certificates, if read.
+}
+
+// session holds the state of a single client connection.
+type session struct {
+	connection  net.Conn
+	number      uint64    // Identifies the connection in logs and to admins.
+	connectedAt time.Time // When the connection was accepted.
+	id          string    // The client's public key, set by CONNECT.
+	log         *logger   // Logs entries tagged with the connection and client.
+
+	privateKey *rsa.PrivateKey // The session key, set by CONNECT.
+	keys       *sessionKeys    // The keys exchanged by CONNECT, if any.
+	sequence   *sequence       // Numbers messages, if agreed by CONNECT.
+	protocol   protocol        // The version and capabilities agreed by CONNECT.
+	requestID  string          // The ID of the request being carried out, if any.
+
+	certificate *x509.Certificate // The client's TLS certificate, if required.
 }
 
 // Server establishes a TCP server using network sockets capable of receiving
-// messages from multiple clients. Using net.Listen Server listens for new
+// messages from multiple clients, or a server on a Unix domain socket if given
+// a unix:// address instead of a port. Using net.Listen Server listens for new
 // clients, creates a new client session on a new goroutine, and passes them a
-// pointer to a shared Data structure so they can be processed.
-func Server(serverPort string) {
+// pointer to a shared Data structure so they can be processed. Session keys are
+// drawn from a pool of pre-generated RSA keypairs sized by the given config.
+// If the config names a metrics address, metrics are served there over HTTP.
+// If the config names a primary, the server runs as a read-only replica of it.
+// If the config names a Raft address, the server joins a Raft group. If the
+// config names a gateway address, the store is also served over HTTP.
+func Server(serverPort string, config ServerConfig) {
+	configureLogging(config.Log)
+	s := newServer(config)
+	defer s.pool.close()
+	if config.RaftAddress != "" && !s.joinRaftGroup() {
+		os.Exit(1)
+	}
+
 	// Open server and close upon function completion.
-	fmt.Println("Server Running...")
-	server, err := net.Listen(serverType, serverHost+":"+serverPort)
-	if err != nil {
-		fmt.Println("Error listening:", err.Error())
+	s.log.info("Server running")
+	listener, ok := s.listen(listenAddress(serverPort))
+	if !ok {
 		os.Exit(1)
 	}
-	defer server.Close()
+	defer listener.Close()
+	if s.revocations != nil {
+		go s.watchRevocations()
+	}
+
+	if config.MetricsAddr != "" {
+		serveMetrics(config.MetricsAddr, s.metrics, s.store, s.pool)
+	}
+	var adminListener net.Listener
+	if config.AdminSocket != "" {
+		adminListener, ok = s.serveAdmin(config.AdminSocket)
+		if !ok {
+			os.Exit(1)
+		}
+		defer adminListener.Close()
+	}
+	s.closeOnSignal(listener, adminListener)
+	if config.GatewayAddr != "" {
+		s.serveGateway(config.GatewayAddr)
+	}
+	if config.RedisAddr != "" {
+		redisListener, ok := s.serveRedis(config.RedisAddr)
+		if !ok {
+			os.Exit(1)
+		}
+		defer redisListener.Close()
+	}
+	if config.MemcachedAddr != "" {
+		memcachedListener, ok := s.serveMemcached(config.MemcachedAddr)
+		if !ok {
+			os.Exit(1)
+		}
+		defer memcachedListener.Close()
+	}
+
+	s.serve(listener)
+	os.Exit(1)
+}
+
+// newServer creates a server with an empty store and a key pool sized by the
+// given config.
+//
+// Returns a pointer to the new server.
+func newServer(config ServerConfig) *server {
+	s := &server{
+		store:    newStore(config.ReplicationLogSize),
+		pool:     newKeyPool(config.KeyPoolSize, config.KeyPoolWorkers),
+		metrics:  newMetrics(),
+		log:      defaultLogger,
+		config:   config,
+		sessions: map[uint64]*session{},
+	}
+	s.replica.Store(config.ReplicaOf != "")
+	if config.ClusterAddress != "" {
+		// A node that is not yet a member of a ring owns nothing until one
+		// is pushed to it.
+		s.ring = newHashRing(0, config.ClusterNodes)
+		if len(config.ClusterNodes) > 0 {
+			s.ring.version = 1
+		}
+	}
+	if config.ClusterAddress != "" && config.ClusterIdentity != "" {
+		privateKey, publicKey, ok := LoadRSAKeys(config.ClusterIdentity)
+		if !ok {
+			s.log.error("Error loading node identity",
+				"path", config.ClusterIdentity)
+			os.Exit(1)
+		}
+		s.nodeKey = privateKey
+		s.log.info("Cluster node identity", "address", config.ClusterAddress,
+			"fingerprint", RSAKeyFingerprint(publicKey))
+	}
+	identityOK := true
+	switch {
+	case config.IdentityFile != "":
+		s.identity, identityOK = LoadIdentityKey(config.IdentityFile,
+			config.KeyAlgorithm)
+	case config.KeyAlgorithm == "" || config.KeyAlgorithm == keyRSA2048:
+		// Without a file the identity only lasts until the server stops, so
+		// a key of the default algorithm is taken from the pool.
+		s.identity, _ = s.pool.take()
+	default:
+		s.identity, identityOK = GenerateIdentityKey(config.KeyAlgorithm)
+	}
+	if !identityOK {
+		s.log.error("Error loading server identity",
+			"path", config.IdentityFile, "algorithm", config.KeyAlgorithm)
+		os.Exit(1)
+	}
+	s.log.info("Server identity", "type", keyType(s.identity.Public()),
+		"fingerprint", KeyFingerprint(s.identity.Public()))
+	if config.TLSCert != "" {
+		ok := true
+		s.listenerTLS, s.peerTLS, ok = serverTLSConfig(
+			config.TLSCert, config.TLSKey, config.TLSCA)
+		if !ok {
+			os.Exit(1)
+		}
+		if config.TLSClientCA != "" && !s.requireClientCertificates() {
+			os.Exit(1)
+		}
+	}
+	return s
+}
+
+// serve starts following the primary if the server is a replica, then accepts
+// clients on the given listener and establishes sessions with them. Returns if
+// the listener fails.
+func (s *server) serve(listener net.Listener) {
+	if s.replica.Load() {
+		go s.replicate()
+	}
+	go s.removeExpiredValues()
 
 	// Begin listening for clients and establishing sessions.
-	fmt.Println("Listening on " + serverHost + ":" + serverPort)
-	fmt.Println("Waiting for client...")
-	clients := map[string]ClientData{}
+	s.log.info("Waiting for clients", "address", listener.Addr().String())
 	for {
-		connection, err := server.Accept()
+		connection, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			os.Exit(1)
+			s.log.error("Error accepting", "error", err)
+			return
 		}
-		fmt.Println("Client connected")
-		go clientSession(connection, clients)
+		go s.clientSession(connection)
 	}
 }
 
 // clientSession handles a client connection by repeatedly reading the
 // connection buffer and searching for keyword prefixes.
 // "CONNECT client_id" will close the connection if the given ID exists. If not,
-// add the ID to the Data structure.
-func clientSession(connection net.Conn, clients map[string]ClientData) {
-	id := ""
+// add the ID to the Data structure and reply with a session key from the pool.
+func (s *server) clientSession(connection net.Conn) {
+	current := &session{
+		connection:  connection,
+		number:      s.connections.Add(1),
+		connectedAt: time.Now(),
+	}
+	current.log = s.log.with(
+		"conn", current.number,
+		"remote", connection.RemoteAddr().String())
 	key := ""
 	defer connection.Close()
+	s.registerSession(current)
+	defer s.unregisterSession(current)
+	s.metrics.sessionStarted()
+	defer s.metrics.sessionEnded()
+	current.log.info("Client connected")
+	if !s.peerAllowed(current) {
+		s.metrics.error("peer")
+		return
+	}
+	defer func() { current.log.info("Client disconnected") }()
 	for {
 		// If the last client message was PUT [key], the current message must
 		// be [value]. Skip validation
 		if key != "" {
-			buffer := make([]byte, 1024)
-			mLen, err := connection.Read(buffer)
-			if err != nil {
-				fmt.Println("Error reading message from "+id+": ", err.Error())
+			buffer, ok := s.readClientValue(current)
+			if !ok {
 				return
 			}
-			clients[id].clientData[key] = string(buffer[:mLen])
-
-			if !sendServerMessage(connection, id, "PUT: OK") {
+			mLen := len(buffer)
+			current.log.debug("Received value",
+				"key", key, "value", secret(buffer[:mLen]))
+			response := ""
+			switch {
+			case s.refusesWrite("PUT", key):
+				s.metrics.command("PUT", false)
+				response = replyError("PUT", categoryReadOnly,
+					"server is a read-only replica")
+			case s.movedCommand(current, "PUT", key):
+				s.metrics.command("PUT", false)
+				response = replyError("PUT", categoryMoved,
+					"key is owned by another cluster node")
+			case s.raft != nil:
+				response = s.proposeCommand(current, "PUT", key, buffer[:mLen])
+			default:
+				response = s.putCommand(current, key, buffer[:mLen])
+			}
+			if !s.sendServerMessage(current, response) {
 				return
 			}
 
@@ -79,7 +335,7 @@ func clientSession(connection net.Conn, clients map[string]ClientData) {
 			continue
 		}
 
-		buffer, mLen, ok := readClientMessage(connection, clients, id)
+		buffer, mLen, ok := s.readClientMessage(current)
 		if !ok {
 			return
 		}
@@ -88,75 +344,257 @@ func clientSession(connection net.Conn, clients map[string]ClientData) {
 		if mLen == 0 {
 			continue
 		}
-		if len(id) > 10 {
-			fmt.Printf("User %s...: %s\n", id[:10], string(buffer[:mLen]))
-		} else {
-			fmt.Printf("User %s: %s\n", id, string(buffer[:mLen]))
+		if current.protocol.has(capabilityPipelining) {
+			current.requestID, buffer, _ = cutRequestID(buffer[:mLen])
+			mLen = len(buffer)
+		}
+		command, argument, _ := strings.Cut(string(buffer[:mLen]), " ")
+		if command != "CONNECT" {
+			current.log.debug("Received command",
+				"command", command, "argument", argument)
+		}
+		// Every other command acts for a client, so it must follow CONNECT.
+		if command != "CONNECT" && current.id == "" {
+			current.log.warn("Command before CONNECT", "command", command)
+			s.metrics.error("unconnected")
+			response := replyError(command, categoryDenied, "CONNECT first")
+			_, err := connection.Write([]byte(response))
+			if err != nil {
+				current.log.warn("Error writing", "error", err)
+				s.metrics.error("write")
+			}
+			return
+		}
+		if command != "PUT" && s.refusesWrite(command, argument) {
+			current.log.info("Refused write to replica", "command", command)
+			s.metrics.command(command, false)
+			response := replyError(command, categoryReadOnly,
+				"server is a read-only replica")
+			if !s.sendServerMessage(current, response) {
+				return
+			}
+			continue
+		}
+		if command != "PUT" && s.movedCommand(current, command, argument) {
+			current.log.debug("Command for another node", "command", command)
+			s.metrics.command(command, false)
+			response := replyError(command, categoryMoved,
+				"key is owned by another cluster node")
+			if !s.sendServerMessage(current, response) {
+				return
+			}
+			continue
+		}
+		if s.raft != nil && raftCommands[command] && command != "PUT" {
+			response := s.proposeCommand(current, command, argument, nil)
+			if !s.sendServerMessage(current, response) {
+				return
+			}
+			continue
 		}
 
 		switch {
 		// CONNECT
 		case strings.HasPrefix(string(buffer[:mLen]), "CONNECT "):
-			id = string(buffer[8:mLen])
-			if idExists(clients, id) {
+			start := time.Now()
+			offer, ok := parseConnect(argument)
+			agreed, shared := negotiate(offer)
+			if !ok || !shared {
+				current.log.warn("No protocol version shared with client",
+					"versions", fmt.Sprint(offer.versions))
+				s.metrics.command("CONNECT", false)
+				_, err := connection.Write([]byte(versionError()))
+				if err != nil {
+					current.log.warn("Error writing", "error", err)
+					s.metrics.error("write")
+				}
+				return
+			}
+			// Without a key exchange, responses are encrypted to the
+			// client's key, which must then be an RSA key.
+			clientKey, ok := StringToPublicKey(offer.id)
+			if _, isRSA := clientKey.(*rsa.PublicKey); !ok ||
+				!isRSA && !agreed.has(capabilityKeyExchange) {
+				current.log.warn("Client key cannot be used",
+					"type", keyType(clientKey))
+				s.metrics.command("CONNECT", false)
+				_, err := connection.Write([]byte("CONNECT: ERROR KEY"))
+				if err != nil {
+					current.log.warn("Error writing", "error", err)
+					s.metrics.error("write")
+				}
+				return
+			}
+			// A key has one ID, whichever form the client sent it in.
+			id := PublicKeyToString(clientKey)
+			if !s.certifiedClient(current, id) {
+				current.log.warn("Client certificate does not name client ID",
+					"client", fingerprint(id)[:16])
+				s.metrics.command("CONNECT", false)
 				_, err := connection.Write([]byte("CONNECT: ERROR"))
 				if err != nil {
-					fmt.Println("Error writing:", err.Error())
+					current.log.warn("Error writing", "error", err)
+					s.metrics.error("write")
 				}
 				return
 			}
+			if agreed.has(capabilityKeyExchange) {
+				// The client's signature is checked before its ID is used.
+				if !offerSigned(string(buffer[:mLen]), offer) {
+					current.log.warn("Invalid signature on key exchange",
+						"client", fingerprint(id)[:16])
+					s.metrics.command("CONNECT", false)
+					_, err := connection.Write([]byte("CONNECT: ERROR SIGNATURE"))
+					if err != nil {
+						current.log.warn("Error writing", "error", err)
+						s.metrics.error("write")
+					}
+					return
+				}
+			}
+			s.sessionsMutex.Lock()
+			current.id = id
+			current.protocol = agreed
+			s.sessionsMutex.Unlock()
+			current.log = current.log.with(
+				"client", fingerprint(current.id)[:16])
+			privateKey, publicKey := s.pool.take()
+			current.privateKey = privateKey
+			if agreed.has(capabilitySequencing) {
+				current.sequence = newSequence(publicKey)
+			}
+			// A replica serves clients whose data it holds for the primary,
+			// so it does not register them itself. Neither are other nodes
+			// of the cluster or Raft group, which may connect several times
+			// at once. A Raft leader registers clients through its log, while
+			// other nodes of the group leave them to refuse every command.
+			// A client's data is kept when its connection fails, so that it
+			// can reconnect, and is only removed when it sends DISCONNECT.
+			switch {
+			case s.replica.Load() || s.isPeer(current.id) ||
+				s.isRaftPeer(current.id):
+			case s.raft != nil:
+				connect := raftEntry{Client: current.id, Command: "CONNECT"}
+				s.raft.propose(connect)
+			default:
+				if !s.store.connect(current.id, privateKey) {
+					current.log.warn("Client ID is already connected")
+					s.metrics.command("CONNECT", false)
+					_, err := connection.Write([]byte("CONNECT: ERROR"))
+					if err != nil {
+						current.log.warn("Error writing", "error", err)
+						s.metrics.error("write")
+					}
+					return
+				}
+				defer s.store.release(current.id, privateKey)
+			}
 
-			privateKey, publicKey := GenerateRSAKeys()
-			_, err := connection.Write([]byte("CONNECT: " + RSAKeyToString(publicKey)))
+			stats := s.pool.stats()
+			current.log.debug("Took session key from pool",
+				"pool_depth", stats.Depth, "pool_capacity", stats.Capacity)
+			reply := connectReply(offer, agreed.keyString(&publicKey), agreed)
+			if agreed.has(capabilityKeyExchange) {
+				reply, current.keys, ok = s.acceptKeyShare(
+					current, string(buffer[:mLen]), offer, reply)
+				if !ok {
+					s.metrics.command("CONNECT", false)
+					return
+				}
+			}
+			response := []byte(reply)
+			_, err := connection.Write(response)
 			if err != nil {
-				fmt.Println("Error writing:", err.Error())
+				current.log.warn("Error writing", "error", err)
+				s.metrics.error("write")
 				return
 			}
-
-			clients[id] = ClientData{
-				clientID:         id,
-				clientData:       map[string]string{},
-				serverPrivateKey: privateKey,
-			}
-			defer delete(clients, id)
+			s.metrics.add(metricBytesOut, "", float64(len(response)))
+			s.metrics.observe(metricHandshake, "", start)
+			s.metrics.command("CONNECT", true)
+			current.log.info("Client registered",
+				"protocol", agreed.String())
 		// PUT
 		case strings.HasPrefix(string(buffer[:mLen]), "PUT "):
 			key = string(buffer[4:mLen])
 		// GET
 		case strings.HasPrefix(string(buffer[:mLen]), "GET "):
-			value := []byte(clients[id].clientData[string(buffer[4:mLen])])
-
-			if string(value) == "" {
-				if !sendServerMessage(connection, id, "GET: ERROR") {
-					return
-				}
-				continue
-			}
-			if !sendServerMessage(connection, id, string(value)) {
+			if !s.sendServerMessage(current, s.getCommand(current, argument)) {
 				return
 			}
 		// DELETE
 		case strings.HasPrefix(string(buffer[:mLen]), "DELETE "):
-			_, exists := clients[id].clientData[string(buffer[7:mLen])]
-			if !exists {
-				if !sendServerMessage(connection, id, "DELETE: ERROR") {
-					return
-				}
-				continue
+			if !s.sendServerMessage(current, s.deleteCommand(current, argument)) {
+				return
+			}
+		// KEYS
+		case command == "KEYS":
+			if !s.sendServerMessage(current, s.keysCommand(current, argument)) {
+				return
+			}
+		// SHARE
+		case strings.HasPrefix(string(buffer[:mLen]), "SHARE "):
+			if !s.sendServerMessage(current, s.shareCommand(current, argument)) {
+				return
+			}
+		// UNSHARE
+		case strings.HasPrefix(string(buffer[:mLen]), "UNSHARE "):
+			if !s.sendServerMessage(current, s.unshareCommand(current, argument)) {
+				return
+			}
+		// PUBKEY
+		case strings.HasPrefix(string(buffer[:mLen]), "PUBKEY "):
+			if !s.sendServerMessage(current,
+				s.publicKeyCommand(current, argument)) {
+				return
+			}
+		// GROUP
+		case strings.HasPrefix(string(buffer[:mLen]), "GROUP "):
+			if !s.sendServerMessage(current, s.groupCommand(current, argument)) {
+				return
+			}
+		// CREATE, GRANT, REVOKE and ACCESS
+		case namespaceCommands[command]:
+			response := s.namespaceCommand(current, command, argument)
+			if !s.sendServerMessage(current, response) {
+				return
 			}
-			delete(clients[id].clientData, string(buffer[7:mLen]))
-			if !sendServerMessage(connection, id, "DELETE: OK") {
+		// NODES
+		case string(buffer[:mLen]) == "NODES":
+			if !s.sendServerMessage(current, s.nodesCommand()) {
 				return
 			}
+		// RING
+		case strings.HasPrefix(string(buffer[:mLen]), "RING "):
+			if !s.sendServerMessage(current, s.ringCommand(current, argument)) {
+				return
+			}
+		// MIGRATE
+		case string(buffer[:mLen]) == "MIGRATE":
+			s.migrateCommand(current)
+			return
+		// RAFT
+		case string(buffer[:mLen]) == "RAFT":
+			s.raftCommand(current)
+			return
+		// REPLICATE
+		case strings.HasPrefix(string(buffer[:mLen]), "REPLICATE "):
+			s.replicateCommand(current, argument)
+			return
 		// DISCONNECT
 		case strings.HasPrefix(string(buffer[:mLen]), "DISCONNECT"):
-			if !sendServerMessage(connection, id, "DISCONNECT: OK") {
+			s.disconnectClient(current)
+			s.metrics.command("DISCONNECT", true)
+			if !s.sendServerMessage(current, reply("DISCONNECT", "")) {
 				return
 			}
 			return
 		// Unknown commands.
 		default:
-			if !sendServerMessage(connection, id, "DISCONNECT: UNKNOWN COMMAND") {
+			current.log.warn("Unknown command", "command", command)
+			s.metrics.command("UNKNOWN", false)
+			response := replyError(command, categoryUnknown, "unknown command")
+			if !s.sendServerMessage(current, response) {
 				return
 			}
 			return
@@ -164,70 +602,305 @@ func clientSession(connection net.Conn, clients map[string]ClientData) {
 	}
 }
 
-// idExists checks if the given client ID string exists in the
-// Data.clientIDs slice of strings and returns true if it is found.
-func idExists(clientList map[string]ClientData, newClientID string) bool {
-	for _, client := range clientList {
-		if newClientID == client.clientID {
-			return true
+// disconnectClient removes the data of a client that sent DISCONNECT, through
+// the Raft log if the server is part of a Raft group. Clients of a replica and
+// other nodes have no data of their own to remove.
+func (s *server) disconnectClient(current *session) {
+	switch {
+	case s.replica.Load() || s.isPeer(current.id) || s.isRaftPeer(current.id):
+	case s.raft != nil:
+		s.raft.propose(raftEntry{Client: current.id, Command: "DISCONNECT"})
+	default:
+		s.store.disconnect(current.id)
+	}
+}
+
+// getCommand carries out "GET [key]".
+//
+// Returns the response to send to the client, whose payload is the value.
+func (s *server) getCommand(current *session, key string) string {
+	stored, found := s.store.get(current.id, key)
+	value, ok := stored.valueFor(current.id)
+	s.metrics.command("GET", found && ok)
+	switch {
+	case !found:
+		return replyError("GET", categoryNotFound,
+			"no value is stored under the key")
+	case !ok:
+		return replyError("GET", categoryDenied,
+			"value is not readable by this client")
+	}
+	return reply("GET", value)
+}
+
+// putCommand carries out "PUT [key]" once the value has been read.
+//
+// Returns the response to send to the client.
+func (s *server) putCommand(current *session, key string, message []byte) string {
+	value := newStoredValue(current.id, message)
+	ok := s.store.put(current.id, key, value)
+	s.metrics.command("PUT", ok)
+	if !ok {
+		return replyError("PUT", categoryDenied, "key is not writable")
+	}
+	return reply("PUT", "")
+}
+
+// deleteCommand carries out "DELETE [key]".
+//
+// Returns the response to send to the client.
+func (s *server) deleteCommand(current *session, key string) string {
+	ok := s.store.remove(current.id, key)
+	s.metrics.command("DELETE", ok)
+	if !ok {
+		return replyError("DELETE", categoryNotFound,
+			"no value is stored under the key")
+	}
+	return reply("DELETE", "")
+}
+
+// keysCommand carries out "KEYS [namespace]", which lists the client's keys
+// or those of a shared namespace it can read. It is used by the HTTP gateway
+// and by clients re-encrypting their values.
+//
+// Returns the response, whose payload holds one key per line.
+func (s *server) keysCommand(current *session, name string) string {
+	keys, ok := s.store.keys(current.id, strings.TrimPrefix(name, "@"))
+	s.metrics.command("KEYS", ok)
+	if !ok {
+		return replyError("KEYS", categoryDenied, "namespace is not readable")
+	}
+	return reply("KEYS", strings.Join(keys, "\n"))
+}
+
+// expireCommand carries out "EXPIRE [key] [time]", which sets when a value
+// expires as a Unix time in milliseconds, or removes its expiry if the time is
+// zero. The time is absolute so that every Raft node applies the same expiry.
+// It is used by the RESP listener.
+//
+// Returns the response to send to the client.
+func (s *server) expireCommand(current *session, argument string) string {
+	arguments := strings.Fields(argument)
+	if len(arguments) != 2 {
+		s.metrics.command("EXPIRE", false)
+		return replyError("EXPIRE", categoryInvalid, "expected a key and time")
+	}
+	milliseconds, err := strconv.ParseInt(arguments[1], 10, 64)
+	if err != nil || milliseconds < 0 {
+		s.metrics.command("EXPIRE", false)
+		return replyError("EXPIRE", categoryInvalid, "invalid time")
+	}
+	at := time.Time{}
+	if milliseconds > 0 {
+		at = time.UnixMilli(milliseconds)
+	}
+	ok := s.store.expire(current.id, arguments[0], at)
+	s.metrics.command("EXPIRE", ok)
+	if !ok {
+		return replyError("EXPIRE", categoryNotFound,
+			"no value is stored under the key")
+	}
+	return reply("EXPIRE", "")
+}
+
+// sessionlessCommand carries out a client command for a caller that has no
+// TCP session, such as a request to the HTTP gateway, as a session would for
+// the same command. The caller is registered as a client first if it is not
+// known.
+//
+// Returns the response the command would send over TCP.
+func (s *server) sessionlessCommand(
+	current *session,
+	command, argument string,
+	value []byte,
+) response {
+	envelope := ""
+	switch {
+	case s.refusesWrite(command, argument):
+		s.metrics.command(command, false)
+		envelope = replyError(command, categoryReadOnly,
+			"server is a read-only replica")
+	case s.movedCommand(current, command, argument):
+		s.metrics.command(command, false)
+		envelope = replyError(command, categoryMoved,
+			"key is owned by another cluster node")
+	case s.raft != nil:
+		if !s.store.hasClient(current.id) {
+			s.proposeCommand(current, "CONNECT", "", nil)
+		}
+		envelope = s.proposeCommand(current, command, argument, value)
+	default:
+		if !s.replica.Load() {
+			s.store.register(current.id)
+		}
+		envelope = s.executeCommand(current, command, argument, value)
+	}
+	outcome, ok := parseResponse(envelope)
+	if !ok {
+		current.log.error("Invalid response", "command", command)
+		return response{command: command, status: statusUnavailable,
+			category: categoryUnavailable}
+	}
+	return outcome
+}
+
+// removeExpiredValues deletes expired values once every expiryInterval, until
+// the program exits. A replica leaves this to its primary, and hides expired
+// values until their deletion is replicated.
+func (s *server) removeExpiredValues() {
+	for range time.Tick(expiryInterval) {
+		if s.replica.Load() {
+			continue
+		}
+		if removed := s.store.removeExpired(); removed > 0 {
+			s.log.debug("Removed expired values", "count", removed)
 		}
 	}
-	return false
 }
 
-// sendServerMessage applies RSA encryption to the given input, and sends it
-// along the given conection.
+// registerSession and unregisterSession add and remove a session from the set
+// of open sessions shown to admins.
+func (s *server) registerSession(current *session) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	s.sessions[current.number] = current
+}
+
+func (s *server) unregisterSession(current *session) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	delete(s.sessions, current.number)
+}
+
+// sendServerMessage numbers the given input if sequencing was agreed, encrypts
+// it with the session keys, or RSA if none were exchanged, and sends it along
+// the session's conection. Response envelopes are sent in the original
+// protocol to clients speaking a version before 3, and tagged with the ID of
+// the request they answer if pipelining was agreed.
 //
 // Returns false if an error occurs.
-func sendServerMessage(connection net.Conn, id, input string) bool {
-	publicKey, ok := StringToRSAKey(id)
-	if !ok {
-		fmt.Println("Error converting string to key")
-		return false
+func (s *server) sendServerMessage(current *session, input string) bool {
+	if current.protocol.version < protocolV3 {
+		if outcome, ok := parseResponse(input); ok {
+			input = outcome.legacy()
+		}
+	}
+	if current.requestID != "" {
+		input = "#" + current.requestID + " " + input
+	}
+	encoded := current.protocol.encode(input)
+	if current.sequence != nil {
+		encoded = current.sequence.seal(encoded)
+	}
+	start := time.Now()
+	encryptedBytes := []byte{}
+	ok := false
+	if current.keys != nil {
+		encryptedBytes, ok = EncryptAES(current.keys.send, encoded)
+		s.metrics.observe(metricCrypto, labels("operation", "aes_encrypt"), start)
+	} else if publicKey, isRSA := StringToRSAKey(current.id); isRSA {
+		encryptedBytes, ok = encryptRSABlocks(publicKey, encoded,
+			current.sequence.headerSize())
+		s.metrics.observe(metricCrypto, labels("operation", "rsa_encrypt"), start)
 	}
-	encryptedBytes, ok := EncryptRSA(publicKey, input)
 	if !ok {
-		fmt.Println("Error encrypting message")
+		current.log.error("Error encrypting message")
+		s.metrics.error("encrypt")
 		return false
 	}
-	_, err := connection.Write(encryptedBytes)
+	written, err := current.protocol.writeMessage(
+		current.connection, encryptedBytes)
 	if err != nil {
-		fmt.Println("Error writing:", err.Error())
+		current.log.warn("Error writing", "error", err)
+		s.metrics.error("write")
 		return false
 	}
-	if len(id) > 10 {
-		fmt.Printf("Send \"%s\" to %s...\n", string(input), id[:10])
-	} else {
-		fmt.Printf("Send \"%s\" to %s\n", string(input), id)
-	}
+	s.metrics.add(metricBytesOut, "", float64(written))
+	current.log.debug("Sent response", "response", secret(input))
 	return true
 }
 
-// readClientMessage reads from the given connection and RSA decrypts the
-// message if keys have been exchanged. Otherwise it returns the message as is.
+// readClientMessage reads from the session's connection and decrypts the
+// message with the session keys, or RSA if the client's key was sent without
+// a key exchange. Before CONNECT it returns the message as is.
 //
 // Returns a byte array of the clients message and a boolean indicating success.
-func readClientMessage(
-	connection net.Conn,
-	clients map[string]ClientData,
-	id string,
-) ([]byte, int, bool) {
-	buffer := make([]byte, 1024)
-	mLen, err := connection.Read(buffer)
+func (s *server) readClientMessage(current *session) ([]byte, int, bool) {
+	buffer, err := current.protocol.readMessage(current.connection)
+	mLen := len(buffer)
 	if err != nil {
-		fmt.Println("Error reading message from "+id+": ", err.Error())
+		current.log.info("Error reading message", "error", err)
+		s.metrics.error("read")
 		return []byte{}, 0, false
 	}
+	s.metrics.add(metricBytesIn, "", float64(mLen))
 
-	if id == "" {
+	if current.id == "" {
 		return buffer, mLen, true
 	}
 
-	privateKey := clients[id].serverPrivateKey
-	decryptedBytes, ok := DecryptRSA(privateKey, buffer[:mLen])
+	decryptedBytes, ok := s.decryptClientMessage(current, buffer[:mLen])
 	if !ok {
-		fmt.Println("ERROR: failed to decrypt")
 		return []byte{}, 0, false
 	}
-	return decryptedBytes, len(decryptedBytes), true
+	decodedBytes, ok := current.protocol.decode(decryptedBytes)
+	if !ok {
+		current.log.warn("Failed to decompress message")
+		s.metrics.error("decode")
+		return []byte{}, 0, false
+	}
+	return decodedBytes, len(decodedBytes), true
+}
+
+// readClientValue reads the value following PUT from the session's
+// connection. Values are already encrypted with the client's data key, so
+// they are read as they are, unless messages are numbered, in which case they
+// are decrypted and checked like any other message.
+//
+// Returns the value and true if successful.
+func (s *server) readClientValue(current *session) ([]byte, bool) {
+	buffer, err := current.protocol.readMessage(current.connection)
+	if err != nil {
+		current.log.warn("Error reading value", "error", err)
+		s.metrics.error("read")
+		return nil, false
+	}
+	s.metrics.add(metricBytesIn, "", float64(len(buffer)))
+	if current.sequence == nil {
+		return buffer, true
+	}
+	return s.decryptClientMessage(current, buffer)
+}
+
+// decryptClientMessage decrypts a message from the session's client with the
+// session keys, or RSA if none were exchanged, and checks its number if
+// messages are numbered.
+//
+// Returns the message, without its number, and true if successful.
+func (s *server) decryptClientMessage(current *session, message []byte) ([]byte, bool) {
+	start := time.Now()
+	decryptedBytes, ok := []byte{}, false
+	if current.keys != nil {
+		decryptedBytes, ok = DecryptAES(current.keys.receive, message)
+		s.metrics.observe(metricCrypto, labels("operation", "aes_decrypt"), start)
+	} else {
+		decryptedBytes, ok = decryptRSABlocks(current.privateKey, message,
+			current.sequence.headerSize())
+		s.metrics.observe(metricCrypto, labels("operation", "rsa_decrypt"), start)
+	}
+	if !ok {
+		current.log.warn("Failed to decrypt message")
+		s.metrics.error("decrypt")
+		return []byte{}, false
+	}
+	if current.sequence == nil {
+		return decryptedBytes, true
+	}
+	opened, err := current.sequence.open(decryptedBytes)
+	if err != nil {
+		current.log.warn("Message out of sequence", "error", err)
+		s.metrics.error("sequence")
+		return []byte{}, false
+	}
+	return opened, true
 }
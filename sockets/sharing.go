@@ -0,0 +1,230 @@
+package sockets
+
+import (
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+)
+
+// sealedPrefix marks a value that is encrypted with its own data key. A sealed
+// value is sent as the prefix, the length of the wrapped data key as a 2-byte
+// big endian integer, the wrapped data key and finally the value encrypted by
+// EncryptValue.
+const sealedPrefix = "SEALED"
+
+// encodeSealed combines a wrapped data key and the ciphertext it decrypts into
+// a sealed value.
+//
+// Returns the encoded value.
+func encodeSealed(wrappedKey, ciphertext []byte) []byte {
+	sealed := make([]byte, 0, len(sealedPrefix)+2+len(wrappedKey)+len(ciphertext))
+	sealed = append(sealed, sealedPrefix...)
+	sealed = binary.BigEndian.AppendUint16(sealed, uint16(len(wrappedKey)))
+	sealed = append(sealed, wrappedKey...)
+	return append(sealed, ciphertext...)
+}
+
+// decodeSealed splits a sealed value into its wrapped data key and ciphertext.
+//
+// Returns the wrapped key, the ciphertext and true if the message is a sealed
+// value. Otherwise returns empty byte arrays and false.
+func decodeSealed(message []byte) ([]byte, []byte, bool) {
+	if !strings.HasPrefix(string(message), sealedPrefix) {
+		return []byte{}, []byte{}, false
+	}
+	message = message[len(sealedPrefix):]
+	if len(message) < 2 {
+		return []byte{}, []byte{}, false
+	}
+	keyLength := int(binary.BigEndian.Uint16(message))
+	message = message[2:]
+	if len(message) < keyLength {
+		return []byte{}, []byte{}, false
+	}
+	return message[:keyLength], message[keyLength:], true
+}
+
+// sealValue encrypts plaintext with a newly generated data key and wraps the
+// data key with wrapKey so that only the holder of the given public key's
+// private key can read it.
+//
+// Returns the sealed value and true if successful.
+func sealValue(publicKey crypto.PublicKey, plaintext string) ([]byte, bool) {
+	dataKey := GenerateAESKey()
+	ciphertext, ok := EncryptValue(valueCipherSuite, dataKey, plaintext)
+	if !ok {
+		return []byte{}, false
+	}
+	wrappedKey, ok := wrapKey(publicKey, dataKey)
+	if !ok {
+		return []byte{}, false
+	}
+	return encodeSealed(wrappedKey, ciphertext), true
+}
+
+// unwrapSealedKey extracts the data key of a sealed value using the given
+// private key.
+//
+// Returns the data key, the ciphertext and true if successful.
+func unwrapSealedKey(
+	privateKey crypto.Signer,
+	sealed []byte,
+) ([]byte, []byte, bool) {
+	wrappedKey, ciphertext, ok := decodeSealed(sealed)
+	if !ok {
+		return []byte{}, []byte{}, false
+	}
+	dataKey, ok := unwrapKey(privateKey, wrappedKey)
+	if !ok {
+		return []byte{}, []byte{}, false
+	}
+	return dataKey, ciphertext, true
+}
+
+// unsealValue decrypts a sealed value using the given private key.
+//
+// Returns the plaintext and true if successful.
+func unsealValue(privateKey crypto.Signer, sealed []byte) ([]byte, bool) {
+	dataKey, ciphertext, ok := unwrapSealedKey(privateKey, sealed)
+	if !ok {
+		return []byte{}, false
+	}
+	return DecryptValue(dataKey, ciphertext)
+}
+
+// newStoredValue converts a value sent by the client with the given ID into
+// the form held by the store. A sealed value's data key is stored as wrapped
+// for its writer.
+//
+// Returns the value to store.
+func newStoredValue(id string, message []byte) storedValue {
+	wrappedKey, ciphertext, sealed := decodeSealed(message)
+	if !sealed {
+		return storedValue{data: string(message)}
+	}
+	return storedValue{
+		data:        string(ciphertext),
+		wrappedKeys: map[string][]byte{fingerprint(id): wrappedKey},
+	}
+}
+
+// valueFor prepares a stored value to be sent to the client with the given ID.
+// Sealed values are sent with the data key wrapped for that client only.
+//
+// Returns the message to send and true if the client can read the value.
+func (value storedValue) valueFor(id string) (string, bool) {
+	if len(value.wrappedKeys) == 0 {
+		return value.data, true
+	}
+	wrappedKey, exists := value.wrappedKeys[fingerprint(id)]
+	if !exists {
+		return "", false
+	}
+	return string(encodeSealed(wrappedKey, []byte(value.data))), true
+}
+
+// share stores a data key wrapped for the client with the given fingerprint
+// next to a sealed value. Only clients that can write to the value and hold a
+// wrapped key for it may share it.
+//
+// Returns false if the value is not sealed or may not be shared.
+func (s *store) share(id, key, grantee string, wrappedKey []byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, resolved, ok := s.resolve(id, key, true)
+	if !ok {
+		return false
+	}
+	value, exists := data[resolved]
+	if !exists || value.wrappedKeys[fingerprint(id)] == nil {
+		return false
+	}
+	grantee = s.canonicalFingerprint(grantee)
+	if !validFingerprint(grantee) {
+		return false
+	}
+	value.wrappedKeys[grantee] = wrappedKey
+	s.recordValue(id, key)
+	return true
+}
+
+// unshare removes the data key wrapped for the client with the given
+// fingerprint from a sealed value. Clients cannot unshare a value from
+// themselves.
+//
+// Returns false if the value was not shared with that client or the client
+// may not change it.
+func (s *store) unshare(id, key, grantee string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, resolved, ok := s.resolve(id, key, true)
+	if !ok {
+		return false
+	}
+	grantee = s.canonicalFingerprint(grantee)
+	value, exists := data[resolved]
+	if !exists || grantee == fingerprint(id) {
+		return false
+	}
+	if _, shared := value.wrappedKeys[grantee]; !shared {
+		return false
+	}
+	delete(value.wrappedKeys, grantee)
+	s.recordValue(id, key)
+	return true
+}
+
+// shareCommand carries out "SHARE [key] [fingerprint] [wrapped key]", where
+// the wrapped key is the value's data key encrypted for the recipient and
+// encoded as hexadecimal.
+//
+// Returns the response to send to the client.
+func (s *server) shareCommand(current *session, argument string) string {
+	arguments := strings.Fields(argument)
+	ok := len(arguments) == 3
+	if ok {
+		wrappedKey, err := hex.DecodeString(arguments[2])
+		ok = err == nil && s.store.share(
+			current.id, arguments[0], arguments[1], wrappedKey)
+	}
+	s.metrics.command("SHARE", ok)
+	if !ok {
+		return replyError("SHARE", categoryDenied, "value cannot be shared")
+	}
+	current.log.info("Shared value", "key", arguments[0],
+		"recipient", arguments[1])
+	return reply("SHARE", "")
+}
+
+// unshareCommand carries out "UNSHARE [key] [fingerprint]".
+//
+// Returns the response to send to the client.
+func (s *server) unshareCommand(current *session, argument string) string {
+	arguments := strings.Fields(argument)
+	ok := len(arguments) == 2 &&
+		s.store.unshare(current.id, arguments[0], arguments[1])
+	s.metrics.command("UNSHARE", ok)
+	if !ok {
+		return replyError("UNSHARE", categoryDenied, "value cannot be unshared")
+	}
+	current.log.info("Unshared value", "key", arguments[0],
+		"recipient", arguments[1])
+	return reply("UNSHARE", "")
+}
+
+// publicKeyCommand carries out "PUBKEY [fingerprint]", which looks up the
+// public key of a client that has connected before so that data keys can be
+// wrapped for it.
+//
+// Returns the response to send to the client, whose payload is the key in the
+// form the client's protocol version reads.
+func (s *server) publicKeyCommand(current *session, argument string) string {
+	id, ok := s.store.publicKey(strings.TrimSpace(argument))
+	publicKey, parsed := StringToPublicKey(id)
+	s.metrics.command("PUBKEY", ok && parsed)
+	if !ok || !parsed {
+		return replyError("PUBKEY", categoryNotFound, "unknown fingerprint")
+	}
+	return reply("PUBKEY", current.protocol.keyString(publicKey))
+}
@@ -0,0 +1,461 @@
+package sockets
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// store holds the data of every connected client and the shared namespaces.
+// Sessions run on their own goroutines, so all access to the store is guarded
+// by a mutex.
+type store struct {
+	mutex      sync.RWMutex
+	clients    map[string]ClientData
+	namespaces map[string]*sharedNamespace // Shared namespaces by name.
+	identities map[string]string           // Public keys by fingerprint.
+	log        *replicationLog             // Recent changes, sent to replicas.
+	version    uint64                      // Version of the latest stored value.
+}
+
+// storedValue is a value as held by the store. The server never sees the
+// plaintext of a value: clients encrypt values before sending them, either
+// with their own data key or with a per-value data key that is wrapped for
+// each client allowed to read it.
+type storedValue struct {
+	data        string            // The value, encrypted by the client.
+	wrappedKeys map[string][]byte // Wrapped data keys by client fingerprint.
+	expires     time.Time         // When the value expires, or zero if never.
+	flags       uint32            // Opaque flags set by memcached clients.
+	version     uint64            // Changes whenever the value is stored.
+}
+
+// expired checks whether a value's expiry time has passed.
+func (value storedValue) expired(now time.Time) bool {
+	return !value.expires.IsZero() && !now.Before(value.expires)
+}
+
+// namespaceStats describes the data held in one client's namespace.
+type namespaceStats struct {
+	keys  int // Number of stored keys.
+	bytes int // Total size of the stored keys and values.
+}
+
+// newStore creates an empty store that keeps up to logSize recent changes for
+// replicas.
+//
+// Returns a pointer to the new store.
+func newStore(logSize int) *store {
+	return &store{
+		clients:    map[string]ClientData{},
+		namespaces: map[string]*sharedNamespace{},
+		identities: map[string]string{},
+		log:        newReplicationLog(logSize),
+	}
+}
+
+// connect registers a new client with the given ID and session key. The
+// client's public key is kept after it disconnects so that other clients can
+// look it up by fingerprint. A client whose data was replicated from a former
+// primary takes over that data.
+//
+// Returns false if the ID is already taken.
+func (s *store) connect(id string, privateKey *rsa.PrivateKey) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	client, exists := s.clients[id]
+	if exists && client.serverPrivateKey != nil {
+		return false
+	}
+	if !exists {
+		client = ClientData{clientID: id, clientData: map[string]storedValue{}}
+	}
+	client.serverPrivateKey = privateKey
+	s.clients[id] = client
+	s.addIdentity(id)
+	s.record(mutation{Op: opConnect, Client: id})
+	return true
+}
+
+// register adds a client that has no session, such as a caller of the HTTP
+// gateway, unless the client is already known.
+func (s *store) register(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.clients[id]; exists {
+		return
+	}
+	s.clients[id] = ClientData{clientID: id, clientData: map[string]storedValue{}}
+	s.addIdentity(id)
+	s.record(mutation{Op: opConnect, Client: id})
+}
+
+// addIdentity records the public key of a client so that it can be looked up
+// by the fingerprint of its ID, or for RSA keys by the fingerprint of the
+// legacy form that clients before protocol version 4 know it by. The caller
+// must hold the store's mutex.
+func (s *store) addIdentity(id string) {
+	for _, keyFingerprint := range idFingerprints(id) {
+		s.identities[keyFingerprint] = id
+	}
+}
+
+// canonicalFingerprint converts a fingerprint given by a client into the
+// fingerprint of the ID of the key it names, so that keys named by the
+// fingerprint of their legacy form are recognised. The caller must hold the
+// store's mutex.
+//
+// Returns the fingerprint in lower case.
+func (s *store) canonicalFingerprint(keyFingerprint string) string {
+	keyFingerprint = strings.ToLower(keyFingerprint)
+	if id, exists := s.identities[keyFingerprint]; exists {
+		return fingerprint(id)
+	}
+	return keyFingerprint
+}
+
+// hasClient checks whether the client with the given ID is registered.
+func (s *store) hasClient(id string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, exists := s.clients[id]
+	return exists
+}
+
+// publicKey looks up the public key of a client that has connected before.
+//
+// Returns the key's string form and true if it is known.
+func (s *store) publicKey(keyFingerprint string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	id, exists := s.identities[strings.ToLower(keyFingerprint)]
+	return id, exists
+}
+
+// release ends the session of the client with the given ID and session key
+// without removing its data, so that a client whose connection failed can
+// connect again and carry on where it left off. A later session of the client
+// is left as it is.
+func (s *store) release(id string, privateKey *rsa.PrivateKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	client, exists := s.clients[id]
+	if !exists || client.serverPrivateKey != privateKey {
+		return
+	}
+	client.serverPrivateKey = nil
+	s.clients[id] = client
+}
+
+// disconnect removes the client with the given ID along with all of its data.
+// It is only called when the client sends DISCONNECT.
+func (s *store) disconnect(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.clients, id)
+	s.record(mutation{Op: opDisconnect, Client: id})
+}
+
+// get looks up the value stored under key on behalf of the given client. The
+// key may refer to a shared namespace the client can read.
+//
+// Returns the value and true if it exists, otherwise an empty value and false.
+func (s *store) get(id, key string) (storedValue, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	data, key, ok := s.resolve(id, key, false)
+	if !ok {
+		return storedValue{}, false
+	}
+	value, exists := data[key]
+	if !exists || value.expired(time.Now()) {
+		return storedValue{}, false
+	}
+	return value, true
+}
+
+// put stores value under key on behalf of the given client. The key may refer
+// to a shared namespace the client can write to.
+//
+// Returns false if the client is not connected or may not write to the key.
+func (s *store) put(id, key string, value storedValue) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, resolved, ok := s.resolve(id, key, true)
+	if !ok {
+		return false
+	}
+	value.version = s.nextVersion()
+	data[resolved] = value
+	s.recordValue(id, key)
+	return true
+}
+
+// nextVersion numbers a newly stored value. Versions only increase, so a
+// client can tell whether a value has been replaced since it was read. The
+// caller must hold the store's mutex for writing.
+//
+// Returns the new version.
+func (s *store) nextVersion() uint64 {
+	s.version++
+	return s.version
+}
+
+// remove deletes the value stored under key on behalf of the given client. The
+// key may refer to a shared namespace the client can write to.
+//
+// Returns false if no such value exists or the client may not delete it.
+func (s *store) remove(id, key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, resolved, ok := s.resolve(id, key, true)
+	if !ok {
+		return false
+	}
+	if value, exists := data[resolved]; !exists || value.expired(time.Now()) {
+		return false
+	}
+	delete(data, resolved)
+	s.recordValue(id, key)
+	return true
+}
+
+// expire sets when the value stored under key on behalf of the given client
+// expires. A zero time removes the value's expiry.
+//
+// Returns false if no such value exists or the client may not change it.
+func (s *store) expire(id, key string, at time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, resolved, ok := s.resolve(id, key, true)
+	if !ok {
+		return false
+	}
+	value, exists := data[resolved]
+	if !exists || value.expired(time.Now()) {
+		return false
+	}
+	value.expires = at
+	data[resolved] = value
+	s.recordValue(id, key)
+	return true
+}
+
+// removeExpired deletes every value whose expiry time has passed, recording
+// each deletion for replicas.
+//
+// Returns the number of values deleted.
+func (s *store) removeExpired() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	removed := 0
+	for id, client := range s.clients {
+		for key, value := range client.clientData {
+			if value.expired(now) {
+				delete(client.clientData, key)
+				s.recordValue(id, key)
+				removed++
+			}
+		}
+	}
+	for name, namespace := range s.namespaces {
+		for key, value := range namespace.data {
+			if value.expired(now) {
+				delete(namespace.data, key)
+				s.record(mutation{Op: opDelete, Namespace: name, Key: key})
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// keys lists the keys stored by the client with the given ID, or the keys in
+// the named shared namespace if name is not empty, which the client must be
+// able to read.
+//
+// Returns the sorted keys and true if the client may list them.
+func (s *store) keys(id, name string) ([]string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if name == "" {
+		client, exists := s.clients[id]
+		return liveKeys(client.clientData), exists
+	}
+	namespace := s.namespaces[name]
+	if namespace == nil || namespace.permissionOf(id) < permissionRead {
+		return nil, false
+	}
+	return liveKeys(namespace.data), true
+}
+
+// liveKeys lists the keys in a data map whose values have not expired.
+//
+// Returns the sorted keys.
+func liveKeys(data map[string]storedValue) []string {
+	now := time.Now()
+	keys := make([]string, 0, len(data))
+	for _, key := range sortedKeys(data) {
+		if !data[key].expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// stats counts the keys and bytes held by every connected client and every
+// shared namespace.
+//
+// Returns a map of client IDs, and of shared namespace names prefixed with
+// '@', to namespace statistics.
+func (s *store) stats() map[string]namespaceStats {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	stats := make(map[string]namespaceStats, len(s.clients)+len(s.namespaces))
+	for id, client := range s.clients {
+		stats[id] = dataStats(client.clientData)
+	}
+	for name, namespace := range s.namespaces {
+		stats["@"+name] = dataStats(namespace.data)
+	}
+	return stats
+}
+
+// dataStats counts the keys and bytes in a data map.
+//
+// Returns the namespace statistics.
+func dataStats(data map[string]storedValue) namespaceStats {
+	stats := namespaceStats{keys: len(data)}
+	for key, value := range data {
+		stats.bytes += len(key) + len(value.data)
+		for _, wrappedKey := range value.wrappedKeys {
+			stats.bytes += len(wrappedKey)
+		}
+	}
+	return stats
+}
+
+// snapshotFile is the JSON document written by snapshot.
+type snapshotFile struct {
+	Time       time.Time                           `json:"time"`
+	Clients    map[string]map[string]snapshotValue `json:"clients"` // Data by client ID.
+	Namespaces map[string]snapshotNamespace        `json:"namespaces"`
+}
+
+// snapshotNamespace is a shared namespace as written by snapshot.
+type snapshotNamespace struct {
+	Owner     string                   `json:"owner"`
+	Grants    map[string]string        `json:"grants"` // Permission names by fingerprint.
+	Data      map[string]snapshotValue `json:"data"`
+	GroupKeys []map[string][]byte      `json:"group_keys,omitempty"` // Wrapped keys by epoch.
+}
+
+// snapshotValue is a stored value as written by snapshot. Values are encoded
+// as base64 rather than as possibly invalid UTF-8 strings.
+type snapshotValue struct {
+	Data        []byte            `json:"data"`
+	WrappedKeys map[string][]byte `json:"wrapped_keys,omitempty"`
+	Expires     *time.Time        `json:"expires,omitempty"`
+	Flags       uint32            `json:"flags,omitempty"`
+	Version     uint64            `json:"version,omitempty"`
+}
+
+// snapshot writes the data of every connected client to the file at path as
+// JSON. The file is written to a temporary path first and renamed into place,
+// so an interrupted snapshot never replaces a complete one.
+//
+// Returns the number of namespaces written and true if successful.
+func (s *store) snapshot(path string) (int, bool) {
+	s.mutex.RLock()
+	contents := snapshotFile{
+		Time:       time.Now(),
+		Clients:    make(map[string]map[string]snapshotValue, len(s.clients)),
+		Namespaces: make(map[string]snapshotNamespace, len(s.namespaces)),
+	}
+	for id, client := range s.clients {
+		contents.Clients[id] = snapshotData(client.clientData)
+	}
+	for name, namespace := range s.namespaces {
+		copied := namespace.metadata()
+		copied.Data = snapshotData(namespace.data)
+		contents.Namespaces[name] = copied
+	}
+	s.mutex.RUnlock()
+
+	encoded, err := json.Marshal(contents)
+	if err != nil {
+		defaultLogger.error("Error encoding snapshot", "error", err)
+		return 0, false
+	}
+	err = os.WriteFile(path+".tmp", encoded, 0600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		defaultLogger.error("Error writing snapshot", "path", path, "error", err)
+		return 0, false
+	}
+	return len(contents.Clients) + len(contents.Namespaces), true
+}
+
+// snapshotData copies a data map into the form written by snapshot.
+//
+// Returns the copied map.
+func snapshotData(data map[string]storedValue) map[string]snapshotValue {
+	copied := make(map[string]snapshotValue, len(data))
+	for key, value := range data {
+		copied[key] = value.snapshot()
+	}
+	return copied
+}
+
+// snapshot copies a stored value into the form written by snapshot.
+//
+// Returns the copied value.
+func (value storedValue) snapshot() snapshotValue {
+	copied := snapshotValue{
+		Data:    []byte(value.data),
+		Flags:   value.flags,
+		Version: value.version,
+	}
+	if len(value.wrappedKeys) > 0 {
+		copied.WrappedKeys = copyWrappedKeys(value.wrappedKeys)
+	}
+	if !value.expires.IsZero() {
+		expires := value.expires
+		copied.Expires = &expires
+	}
+	return copied
+}
+
+// metadata copies the owner, grants and group keys of a shared namespace into
+// the form written by snapshot, without its data. The caller must hold the
+// store's mutex.
+//
+// Returns the copied namespace.
+func (namespace *sharedNamespace) metadata() snapshotNamespace {
+	grants := make(map[string]string, len(namespace.grants))
+	for grantee, access := range namespace.grants {
+		grants[grantee] = permissionNames[access]
+	}
+	copied := snapshotNamespace{Owner: namespace.owner, Grants: grants}
+	for _, wrappedKeys := range namespace.groupKeys {
+		copied.GroupKeys = append(copied.GroupKeys, copyWrappedKeys(wrappedKeys))
+	}
+	return copied
+}
+
+// copyWrappedKeys copies a map of wrapped keys by client fingerprint.
+//
+// Returns the copied map.
+func copyWrappedKeys(wrappedKeys map[string][]byte) map[string][]byte {
+	copied := make(map[string][]byte, len(wrappedKeys))
+	for keyFingerprint, wrappedKey := range wrappedKeys {
+		copied[keyFingerprint] = wrappedKey
+	}
+	return copied
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package sockets
+
+import "os"
+
+// restrictUmask would set the process's file mode creation mask, but only Unix
+// systems have one, so new files are created as they would be otherwise.
+//
+// Returns a function that does nothing.
+func restrictUmask(mode os.FileMode) func() {
+	return func() {}
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package sockets
+
+import (
+	"os"
+	"syscall"
+)
+
+// restrictUmask sets the process's file mode creation mask so that new files
+// are created with at most the given permissions.
+//
+// Returns a function that restores the previous mask.
+func restrictUmask(mode os.FileMode) func() {
+	previous := syscall.Umask(int(^mode.Perm() & os.ModePerm))
+	return func() { syscall.Umask(previous) }
+}
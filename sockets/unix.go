@@ -0,0 +1,221 @@
+package sockets
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Servers and clients on the same host may speak over a Unix domain socket,
+// named by an address of the form unix:///path/to/socket, so that access is
+// governed by the socket file's permissions. The server creates the socket
+// file, removes it when it stops and may also only accept clients running as
+// given users or groups, which it learns from the kernel.
+
+// unixScheme starts the addresses of Unix domain sockets.
+const unixScheme = "unix://"
+
+// defaultSocketMode is the permissions of a client socket file unless the
+// config gives others.
+const defaultSocketMode os.FileMode = 0660
+
+// transportAddress finds the network and address to dial or listen on for an
+// address, which is a Unix domain socket's path if it starts with unix://.
+//
+// Returns the network and the address within it.
+func transportAddress(address string) (string, string) {
+	if strings.HasPrefix(address, unixScheme) {
+		return "unix", strings.TrimPrefix(address, unixScheme)
+	}
+	return serverType, address
+}
+
+// listenAddress finds the address a server listens on, given a port or the
+// address of a Unix domain socket.
+//
+// Returns the address.
+func listenAddress(serverPort string) string {
+	if strings.HasPrefix(serverPort, unixScheme) {
+		return serverPort
+	}
+	return serverHost + ":" + serverPort
+}
+
+// listenSocket listens on a Unix domain socket at the given path with the
+// given permissions. A stale socket file left by a previous server is
+// removed, but a socket that is still being served is left alone. The socket
+// file is removed when the listener is closed.
+//
+// Returns the listener and true if successful.
+func (s *server) listenSocket(path string, mode os.FileMode) (net.Listener, bool) {
+	if _, err := os.Stat(path); err == nil {
+		if connection, err := net.Dial("unix", path); err == nil {
+			connection.Close()
+			s.log.error("Socket is already in use", "path", path)
+			return nil, false
+		}
+		os.Remove(path)
+	}
+
+	// The socket is created with the given permissions at most, so that no
+	// one else can connect before it is changed to exactly those.
+	restore := restrictUmask(mode)
+	listener, err := net.Listen("unix", path)
+	restore()
+	if err != nil {
+		s.log.error("Error listening on socket", "path", path, "error", err)
+		return nil, false
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		s.log.error("Error setting socket permissions", "path", path,
+			"error", err)
+		listener.Close()
+		return nil, false
+	}
+	return listener, true
+}
+
+// listen opens the listener clients connect to at the given address, either
+// a TCP address or a Unix domain socket, using TLS if configured.
+//
+// Returns the listener and true if successful.
+func (s *server) listen(address string) (net.Listener, bool) {
+	network, path := transportAddress(address)
+	var listener net.Listener
+	if network == "unix" {
+		mode := s.config.SocketMode
+		if mode == 0 {
+			mode = defaultSocketMode
+		}
+		ok := true
+		if listener, ok = s.listenSocket(filepath.Clean(path), mode); !ok {
+			return nil, false
+		}
+	} else {
+		var err error
+		if listener, err = net.Listen(network, path); err != nil {
+			s.log.error("Error listening", "error", err)
+			return nil, false
+		}
+	}
+	if s.listenerTLS != nil {
+		listener = tls.NewListener(listener, s.listenerTLS)
+	}
+	return listener, true
+}
+
+// closeOnSignal closes the given listeners and exits once the process is
+// interrupted or terminated, so that their socket files are removed.
+func (s *server) closeOnSignal(listeners ...net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		s.log.info("Server stopping", "signal", received.String())
+		for _, listener := range listeners {
+			if listener != nil {
+				listener.Close()
+			}
+		}
+		os.Exit(0)
+	}()
+}
+
+// peerAllowed checks whether a client connecting over a Unix domain socket
+// runs as one of the users or groups allowed by the config, if restricted.
+// Clients connecting over TCP are not restricted.
+func (s *server) peerAllowed(current *session) bool {
+	if len(s.config.SocketUIDs) == 0 && len(s.config.SocketGIDs) == 0 {
+		return true
+	}
+	connection := current.connection
+	if secured, ok := connection.(*tls.Conn); ok {
+		connection = secured.NetConn()
+	}
+	unix, ok := connection.(*net.UnixConn)
+	if !ok {
+		return true
+	}
+	credentials, ok := peerCredentials(unix)
+	if !ok {
+		current.log.warn("Peer credentials are unavailable")
+		return false
+	}
+	current.log.debug("Peer credentials", "uid", credentials.uid,
+		"gid", credentials.gid, "pid", credentials.pid)
+	for _, uid := range s.config.SocketUIDs {
+		if uid == credentials.uid {
+			return true
+		}
+	}
+	for _, gid := range s.config.SocketGIDs {
+		if gid == credentials.gid {
+			return true
+		}
+	}
+	current.log.warn("Refused client running as another user",
+		"uid", credentials.uid, "gid", credentials.gid, "pid", credentials.pid)
+	return false
+}
+
+// credentials identify the process at the other end of a Unix domain socket.
+type credentials struct {
+	uid, gid, pid int
+}
+
+// TestUnix runs a server on a Unix domain socket in a temporary directory and
+// creates and lists a namespace over it. It also shows a server only accepting
+// clients running as another user refusing this process.
+func TestUnix() {
+	configureLogging(LogConfig{Level: "error"})
+	directory, err := os.MkdirTemp("", "unix")
+	if err != nil {
+		fmt.Println("Error creating directory:", err.Error())
+		return
+	}
+	defer os.RemoveAll(directory)
+
+	startSocketServer := func(name string, config ServerConfig) string {
+		address := unixScheme + filepath.Join(directory, name)
+		s := newServer(config)
+		listener, ok := s.listen(address)
+		if !ok {
+			os.Exit(1)
+		}
+		go s.serve(listener)
+		return address
+	}
+	address := startSocketServer("kv.sock",
+		ServerConfig{KeyPoolSize: 2, KeyPoolWorkers: 1, SocketMode: 0600})
+	info, _ := os.Stat(strings.TrimPrefix(address, unixScheme))
+	fmt.Println("Server listening on", address, "with permissions", info.Mode())
+
+	privateKey, publicKey := GenerateRSAKeys()
+	connection, sessionKey, ok := dialServer(address, publicKey, nil)
+	if !ok {
+		fmt.Println("Error connecting over the Unix socket")
+		return
+	}
+	defer connection.Close()
+	for _, request := range []string{"CREATE team", "ACCESS team"} {
+		fmt.Printf("%s -> %s\n", request,
+			testRequest(connection, sessionKey, privateKey, request))
+	}
+
+	restricted := startSocketServer("restricted.sock", ServerConfig{
+		KeyPoolSize: 2, KeyPoolWorkers: 1, SocketUIDs: []int{os.Getuid() + 1}})
+	_, _, ok = dialServer(restricted, publicKey, nil)
+	fmt.Printf("Client running as uid %d connects to a server allowing uid %d: %t\n",
+		os.Getuid(), os.Getuid()+1, ok)
+	allowed := startSocketServer("allowed.sock", ServerConfig{
+		KeyPoolSize: 2, KeyPoolWorkers: 1, SocketUIDs: []int{os.Getuid()}})
+	_, _, ok = dialServer(allowed, publicKey, nil)
+	fmt.Printf("Client running as uid %d connects to a server allowing uid %d: %t\n",
+		os.Getuid(), os.Getuid(), ok)
+}